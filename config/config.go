@@ -0,0 +1,436 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config holds the runtime settings of the forum server
+type Config struct {
+	Addr            string   `json:"addr"`
+	DatabasePath    string   `json:"database_path"`
+	SessionLifetime Duration `json:"session_lifetime"`
+	CookieName      string   `json:"cookie_name"`
+	CookieSecure    bool     `json:"cookie_secure"`
+	CookieSameSite  string   `json:"cookie_same_site"` // "lax", "strict" or "none"
+	BcryptCost      int      `json:"bcrypt_cost"`
+	LogLevel        string   `json:"log_level"` // "debug", "info", "warn" or "error"
+	TemplateDir     string   `json:"template_dir"`
+	StaticDir       string   `json:"static_dir"`
+	MaxCommentDepth int      `json:"max_comment_depth"` // deepest reply level; 0 disables threading
+
+	// Pre-moderation holds posts by untrusted users for review. A user is trusted once their
+	// account is TrustAccountAge old and TrustApprovedPosts of their posts were approved.
+	PreModeration      bool     `json:"pre_moderation"`
+	TrustAccountAge    Duration `json:"trust_account_age"`
+	TrustApprovedPosts int      `json:"trust_approved_posts"`
+
+	// AccountDeletion decides what happens to the posts and comments of a deleted account:
+	// "anonymize" keeps them under a placeholder author, "remove" deletes them
+	AccountDeletion string `json:"account_deletion"`
+
+	// BaseURL is the public address of the forum, used for links in emails
+	BaseURL string `json:"base_url"`
+
+	// MailDriver selects how emails are sent: "file" writes them to one file each in MailDir,
+	// "log" to the log and "smtp" sends them through the SMTP server at SMTPAddr
+	MailDriver   string `json:"mail_driver"`
+	MailFrom     string `json:"mail_from"`
+	MailDir      string `json:"mail_dir"`
+	SMTPAddr     string `json:"smtp_addr"` // host:port
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"`
+}
+
+// Duration is a time.Duration written as a string such as "24h" in config files
+type Duration time.Duration
+
+// MarshalJSON writes the duration in time.Duration string form
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads a duration string such as "90m"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"24h\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default returns the settings used when nothing else is configured
+func Default() Config {
+	return Config{
+		Addr:            ":8080",
+		DatabasePath:    "./forum.db",
+		SessionLifetime: Duration(24 * time.Hour),
+		CookieName:      "session_token",
+		CookieSecure:    false,
+		CookieSameSite:  "lax",
+		BcryptCost:      bcrypt.DefaultCost,
+		LogLevel:        "info",
+		TemplateDir:     "templates",
+		StaticDir:       "static",
+		MaxCommentDepth: 5,
+
+		PreModeration:      false,
+		TrustAccountAge:    Duration(72 * time.Hour),
+		TrustApprovedPosts: 1,
+
+		AccountDeletion: "anonymize",
+
+		BaseURL:    "http://localhost:8080",
+		MailDriver: "file",
+		MailFrom:   "forum@localhost",
+		MailDir:    "mail",
+	}
+}
+
+// Options are the command line settings that are not part of Config itself
+type Options struct {
+	ConfigFile  string
+	PrintConfig bool
+	Args        []string // positional arguments left after the flags, such as "migrate status"
+}
+
+// Load builds the configuration from, in increasing order of precedence: defaults,
+// the optional JSON config file, FORUM_* environment variables and command line flags
+func Load(args []string) (*Config, *Options, error) {
+	cfg := Default()
+	opts := &Options{}
+
+	fs := flag.NewFlagSet("forum", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigFile, "config", os.Getenv("FORUM_CONFIG"), "path to a JSON config file")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration and exit")
+
+	// Flag values are captured separately so only flags given explicitly override the other sources
+	var flags Config
+	fs.StringVar(&flags.Addr, "addr", cfg.Addr, "address to listen on")
+	fs.StringVar(&flags.DatabasePath, "db", cfg.DatabasePath, "path to the SQLite database")
+	fs.DurationVar((*time.Duration)(&flags.SessionLifetime), "session-lifetime", time.Duration(cfg.SessionLifetime), "how long an unused session stays valid")
+	fs.StringVar(&flags.CookieName, "cookie-name", cfg.CookieName, "name of the session cookie")
+	fs.BoolVar(&flags.CookieSecure, "cookie-secure", cfg.CookieSecure, "only send the session cookie over HTTPS")
+	fs.StringVar(&flags.CookieSameSite, "cookie-samesite", cfg.CookieSameSite, "SameSite mode of the session cookie: lax, strict or none")
+	fs.IntVar(&flags.BcryptCost, "bcrypt-cost", cfg.BcryptCost, "bcrypt cost for password hashes")
+	fs.StringVar(&flags.LogLevel, "log-level", cfg.LogLevel, "minimum log level: debug, info, warn or error")
+	fs.StringVar(&flags.TemplateDir, "template-dir", cfg.TemplateDir, "directory holding the HTML templates")
+	fs.StringVar(&flags.StaticDir, "static-dir", cfg.StaticDir, "directory holding the static assets")
+	fs.IntVar(&flags.MaxCommentDepth, "max-comment-depth", cfg.MaxCommentDepth, "deepest level of nested comment replies; 0 disables threading")
+	fs.BoolVar(&flags.PreModeration, "pre-moderation", cfg.PreModeration, "hold posts by untrusted users until a moderator approves them")
+	fs.DurationVar((*time.Duration)(&flags.TrustAccountAge), "trust-account-age", time.Duration(cfg.TrustAccountAge), "account age after which a user's posts skip pre-moderation")
+	fs.IntVar(&flags.TrustApprovedPosts, "trust-approved-posts", cfg.TrustApprovedPosts, "approved posts after which a user's posts skip pre-moderation")
+	fs.StringVar(&flags.AccountDeletion, "account-deletion", cfg.AccountDeletion, "what happens to the content of deleted accounts: anonymize or remove")
+	fs.StringVar(&flags.BaseURL, "base-url", cfg.BaseURL, "public address of the forum, used for links in emails")
+	fs.StringVar(&flags.MailDriver, "mail-driver", cfg.MailDriver, "how emails are sent: log, file or smtp")
+	fs.StringVar(&flags.MailFrom, "mail-from", cfg.MailFrom, "sender address of emails")
+	fs.StringVar(&flags.MailDir, "mail-dir", cfg.MailDir, "directory the file mail driver writes emails to")
+	fs.StringVar(&flags.SMTPAddr, "smtp-addr", cfg.SMTPAddr, "host:port of the SMTP server")
+	fs.StringVar(&flags.SMTPUsername, "smtp-username", cfg.SMTPUsername, "SMTP username; no authentication when empty")
+	fs.StringVar(&flags.SMTPPassword, "smtp-password", cfg.SMTPPassword, "SMTP password")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	opts.Args = fs.Args()
+
+	if opts.ConfigFile != "" {
+		if err := cfg.loadFile(opts.ConfigFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = flags.Addr
+		case "db":
+			cfg.DatabasePath = flags.DatabasePath
+		case "session-lifetime":
+			cfg.SessionLifetime = flags.SessionLifetime
+		case "cookie-name":
+			cfg.CookieName = flags.CookieName
+		case "cookie-secure":
+			cfg.CookieSecure = flags.CookieSecure
+		case "cookie-samesite":
+			cfg.CookieSameSite = flags.CookieSameSite
+		case "bcrypt-cost":
+			cfg.BcryptCost = flags.BcryptCost
+		case "log-level":
+			cfg.LogLevel = flags.LogLevel
+		case "template-dir":
+			cfg.TemplateDir = flags.TemplateDir
+		case "static-dir":
+			cfg.StaticDir = flags.StaticDir
+		case "max-comment-depth":
+			cfg.MaxCommentDepth = flags.MaxCommentDepth
+		case "pre-moderation":
+			cfg.PreModeration = flags.PreModeration
+		case "trust-account-age":
+			cfg.TrustAccountAge = flags.TrustAccountAge
+		case "trust-approved-posts":
+			cfg.TrustApprovedPosts = flags.TrustApprovedPosts
+		case "account-deletion":
+			cfg.AccountDeletion = flags.AccountDeletion
+		case "base-url":
+			cfg.BaseURL = flags.BaseURL
+		case "mail-driver":
+			cfg.MailDriver = flags.MailDriver
+		case "mail-from":
+			cfg.MailFrom = flags.MailFrom
+		case "mail-dir":
+			cfg.MailDir = flags.MailDir
+		case "smtp-addr":
+			cfg.SMTPAddr = flags.SMTPAddr
+		case "smtp-username":
+			cfg.SMTPUsername = flags.SMTPUsername
+		case "smtp-password":
+			cfg.SMTPPassword = flags.SMTPPassword
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return &cfg, opts, nil
+}
+
+// loadFile overlays the settings present in a JSON config file
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// loadEnv overlays the settings present in FORUM_* environment variables
+func (c *Config) loadEnv() error {
+	stringSettings := map[string]*string{
+		"FORUM_ADDR":             &c.Addr,
+		"FORUM_DB_PATH":          &c.DatabasePath,
+		"FORUM_COOKIE_NAME":      &c.CookieName,
+		"FORUM_COOKIE_SAMESITE":  &c.CookieSameSite,
+		"FORUM_LOG_LEVEL":        &c.LogLevel,
+		"FORUM_TEMPLATE_DIR":     &c.TemplateDir,
+		"FORUM_STATIC_DIR":       &c.StaticDir,
+		"FORUM_ACCOUNT_DELETION": &c.AccountDeletion,
+		"FORUM_BASE_URL":         &c.BaseURL,
+		"FORUM_MAIL_DRIVER":      &c.MailDriver,
+		"FORUM_MAIL_FROM":        &c.MailFrom,
+		"FORUM_MAIL_DIR":         &c.MailDir,
+		"FORUM_SMTP_ADDR":        &c.SMTPAddr,
+		"FORUM_SMTP_USERNAME":    &c.SMTPUsername,
+		"FORUM_SMTP_PASSWORD":    &c.SMTPPassword,
+	}
+	for name, target := range stringSettings {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = value
+		}
+	}
+
+	if value, ok := os.LookupEnv("FORUM_SESSION_LIFETIME"); ok {
+		lifetime, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid FORUM_SESSION_LIFETIME: %v", err)
+		}
+		c.SessionLifetime = Duration(lifetime)
+	}
+	if value, ok := os.LookupEnv("FORUM_COOKIE_SECURE"); ok {
+		secure, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid FORUM_COOKIE_SECURE: %v", err)
+		}
+		c.CookieSecure = secure
+	}
+	if value, ok := os.LookupEnv("FORUM_BCRYPT_COST"); ok {
+		cost, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid FORUM_BCRYPT_COST: %v", err)
+		}
+		c.BcryptCost = cost
+	}
+	if value, ok := os.LookupEnv("FORUM_MAX_COMMENT_DEPTH"); ok {
+		depth, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid FORUM_MAX_COMMENT_DEPTH: %v", err)
+		}
+		c.MaxCommentDepth = depth
+	}
+	if value, ok := os.LookupEnv("FORUM_PRE_MODERATION"); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid FORUM_PRE_MODERATION: %v", err)
+		}
+		c.PreModeration = enabled
+	}
+	if value, ok := os.LookupEnv("FORUM_TRUST_ACCOUNT_AGE"); ok {
+		age, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid FORUM_TRUST_ACCOUNT_AGE: %v", err)
+		}
+		c.TrustAccountAge = Duration(age)
+	}
+	if value, ok := os.LookupEnv("FORUM_TRUST_APPROVED_POSTS"); ok {
+		posts, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid FORUM_TRUST_APPROVED_POSTS: %v", err)
+		}
+		c.TrustApprovedPosts = posts
+	}
+	return nil
+}
+
+// Validate checks that every setting is usable, except those ValidateServe checks
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.Addr == "" {
+		problems = append(problems, "addr must not be empty")
+	}
+	if c.DatabasePath == "" {
+		problems = append(problems, "database path must not be empty")
+	}
+	if time.Duration(c.SessionLifetime) < time.Minute {
+		problems = append(problems, "session lifetime must be at least one minute")
+	}
+	if c.CookieName == "" {
+		problems = append(problems, "cookie name must not be empty")
+	}
+	if _, err := c.SameSite(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.CookieSameSite == "none" && !c.CookieSecure {
+		problems = append(problems, "cookie SameSite none requires a secure cookie")
+	}
+	if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		problems = append(problems, fmt.Sprintf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	if _, err := c.SlogLevel(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.MaxCommentDepth < 0 || c.MaxCommentDepth > 20 {
+		problems = append(problems, "max comment depth must be between 0 and 20")
+	}
+	if c.TrustAccountAge < 0 {
+		problems = append(problems, "trust account age must not be negative")
+	}
+	if c.TrustApprovedPosts < 0 {
+		problems = append(problems, "trust approved posts must not be negative")
+	}
+	if c.AccountDeletion != "anonymize" && c.AccountDeletion != "remove" {
+		problems = append(problems, fmt.Sprintf("unknown account deletion policy %q: must be anonymize or remove", c.AccountDeletion))
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("base URL %q must be an absolute http or https URL", c.BaseURL))
+	}
+	if _, err := mail.ParseAddress(c.MailFrom); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid mail sender %q", c.MailFrom))
+	}
+	switch c.MailDriver {
+	case "log":
+	case "file":
+		if c.MailDir == "" {
+			problems = append(problems, "mail directory must not be empty with the file mail driver")
+		}
+	case "smtp":
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("SMTP address %q must be host:port", c.SMTPAddr))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown mail driver %q: must be log, file or smtp", c.MailDriver))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ValidateServe checks the settings only the HTTP server needs, such as the template and
+// static directories, so commands like "forum migrate" work from any directory
+func (c *Config) ValidateServe() error {
+	var problems []string
+
+	if !isDir(c.TemplateDir) {
+		problems = append(problems, fmt.Sprintf("template directory %q does not exist", c.TemplateDir))
+	}
+	if !isDir(c.StaticDir) {
+		problems = append(problems, fmt.Sprintf("static directory %q does not exist", c.StaticDir))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isDir reports whether path is an existing directory
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// SameSite returns the http.SameSite mode for the session cookie
+func (c *Config) SameSite() (http.SameSite, error) {
+	switch strings.ToLower(c.CookieSameSite) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown cookie SameSite mode %q", c.CookieSameSite)
+}
+
+// SlogLevel returns the configured minimum log level
+func (c *Config) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", c.LogLevel)
+	}
+	return level, nil
+}
+
+// Print writes the configuration as indented JSON, in the same format the config file uses.
+// Secrets are masked so the output can be shared.
+func (c *Config) Print(w io.Writer) error {
+	masked := *c
+	if masked.SMTPPassword != "" {
+		masked.SMTPPassword = "***"
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(masked)
+}
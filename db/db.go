@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
 
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
 )
@@ -12,10 +11,10 @@ import (
 // DB is a global variable for database connection
 var DB *sql.DB
 
-// Initialize initializes the database connection and applies the schema
-func Initialize() error {
+// Open opens the database at path without touching the schema
+func Open(path string) error {
 	var err error
-	DB, err = sql.Open("sqlite3", "./forum.db")
+	DB, err = sql.Open("sqlite3", path)
 	if err != nil {
 		return fmt.Errorf("failed to open database: %v", err)
 	}
@@ -25,30 +24,22 @@ func Initialize() error {
 	if err != nil {
 		return fmt.Errorf("failed to ping database: %v", err)
 	}
-
-	// Apply the schema
-	err = applySchema()
-	if err != nil {
-		return fmt.Errorf("failed to apply schema: %v", err)
-	}
-
-	log.Println("Database initialized successfully")
 	return nil
 }
 
-// applySchema applies the SQL schema from the schema.sql file
-func applySchema() error {
-	schemaContent, err := os.ReadFile("./db/schema.sql")
+// Initialize opens the database at path and applies any pending migrations
+func Initialize(path string) error {
+	err := Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to read schema file: %v", err)
+		return err
 	}
 
-	_, err = DB.Exec(string(schemaContent))
+	err = Migrate()
 	if err != nil {
-		return fmt.Errorf("failed to execute schema SQL: %v", err)
+		return fmt.Errorf("failed to migrate database: %v", err)
 	}
 
-	log.Println("Schema applied successfully")
+	log.Println("Database initialized successfully")
 	return nil
 }
 
@@ -0,0 +1,346 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration files are named <version>_<name>.up.sql and <version>_<name>.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a numbered schema change with the SQL to apply and revert it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus reports whether a migration has been applied to the database
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads the embedded migration files, ordered by version
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %v", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		base := strings.TrimSuffix(fileName, ".sql")
+		base, direction, found := cutLast(base, ".")
+		if !found || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+		versionStr, name, found := strings.Cut(base, "_")
+		if !found {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %q", fileName)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %v", fileName, err)
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		}
+		if migration.Name != name {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, migration.Name, name)
+		}
+		if direction == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// ensureMigrationsTable creates the schema_migrations bookkeeping table,
+// adopting databases that were created before migrations existed
+func ensureMigrationsTable() error {
+	exists, err := tableExists("schema_migrations")
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	legacy, err := tableExists("users")
+	if err != nil {
+		return err
+	}
+	if legacy {
+		log.Println("Adopting existing database into schema migrations")
+		if err := adoptLegacySchema(); err != nil {
+			return err
+		}
+	}
+
+	_, err = DB.Exec(`CREATE TABLE schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	return nil
+}
+
+// appliedMigrations returns the applied migration versions with the time they were applied
+func appliedMigrations() (map[int]time.Time, error) {
+	rows, err := DB.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations: %v", err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// requireFTS5 fails early when the SQLite driver was built without FTS5, which the search
+// indexes need
+func requireFTS5() error {
+	var enabled bool
+	if err := DB.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled); err != nil {
+		return fmt.Errorf("failed to check SQLite compile options: %v", err)
+	}
+	if !enabled {
+		return fmt.Errorf("SQLite was built without FTS5; build with -tags sqlite_fts5")
+	}
+	return nil
+}
+
+// Migrate applies every pending migration in version order
+func Migrate() error {
+	if err := requireFTS5(); err != nil {
+		return err
+	}
+	if err := ensureMigrationsTable(); err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := runMigration(migration.Up, func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+				migration.Version, migration.Name, time.Now())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+		log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+	}
+	return nil
+}
+
+// Rollback reverts the given number of most recently applied migrations
+func Rollback(steps int) error {
+	if err := ensureMigrationsTable(); err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		err := runMigration(migration.Down, func(tx *sql.Tx) error {
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to roll back migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+		log.Printf("Rolled back migration %d_%s", migration.Version, migration.Name)
+		steps--
+	}
+	return nil
+}
+
+// Status lists every known migration and when it was applied, if it was
+func Status() ([]MigrationStatus, error) {
+	if err := ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// runMigration executes a migration script and its bookkeeping in a single transaction
+func runMigration(script string, record func(tx *sql.Tx) error) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// legacyColumns lists columns that were added to tables before migrations existed.
+// Databases from that time may lack them, and CREATE TABLE IF NOT EXISTS in the
+// initial migration never alters an existing table.
+var legacyColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"sessions", "created_at", "DATETIME"},
+	{"sessions", "last_seen_at", "DATETIME"},
+	{"sessions", "user_agent", "TEXT"},
+	{"sessions", "ip_address", "TEXT"},
+	{"categories", "slug", "TEXT"},
+}
+
+// adoptLegacySchema adds any column from legacyColumns that is missing from an existing table,
+// so the initial migration can index and seed them
+func adoptLegacySchema() error {
+	for _, upgrade := range legacyColumns {
+		exists, err := tableExists(upgrade.table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		exists, err = columnExists(upgrade.table, upgrade.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		_, err = DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", upgrade.table, upgrade.column, upgrade.definition))
+		if err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %v", upgrade.table, upgrade.column, err)
+		}
+		log.Printf("Added column %s.%s", upgrade.table, upgrade.column)
+	}
+	return nil
+}
+
+// tableExists reports whether the given table exists in the database
+func tableExists(table string) (bool, error) {
+	var count int
+	err := DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check table %s: %v", table, err)
+	}
+	return count > 0, nil
+}
+
+// columnExists reports whether the given table has the given column
+func columnExists(table, column string) (bool, error) {
+	rows, err := DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("failed to read table info for %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, fmt.Errorf("failed to scan table info for %s: %v", table, err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
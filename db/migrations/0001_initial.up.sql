@@ -1,3 +1,7 @@
+-- Initial schema. Databases created before migrations existed are brought up to the
+-- columns below by db.adoptLegacySchema before this migration runs, so every statement
+-- here must stay idempotent.
+
 -- USERS Table
 CREATE TABLE IF NOT EXISTS users (
     id INTEGER PRIMARY KEY AUTOINCREMENT,      
@@ -32,9 +36,22 @@ CREATE TABLE IF NOT EXISTS comments (
 CREATE TABLE IF NOT EXISTS categories (
     id INTEGER PRIMARY KEY AUTOINCREMENT,     
     name TEXT UNIQUE NOT NULL,                
-    description TEXT                          
+    description TEXT,
+    slug TEXT
 );
 
+-- Backfill slugs for categories created before the column existed
+UPDATE categories SET slug = LOWER(REPLACE(TRIM(name), ' ', '-')) WHERE slug IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_categories_slug ON categories(slug);
+
+-- Default categories
+INSERT OR IGNORE INTO categories (name, slug, description) VALUES
+    ('General', 'general', 'Anything that does not fit elsewhere'),
+    ('Technology', 'technology', 'Software, hardware and the web'),
+    ('Lifestyle', 'lifestyle', 'Health, travel, food and everyday life'),
+    ('Gaming', 'gaming', 'Video games, board games and esports');
+
 -- POST_CATEGORIES Table
 CREATE TABLE IF NOT EXISTS post_categories (
     post_id INTEGER NOT NULL,                  
@@ -44,6 +61,8 @@ CREATE TABLE IF NOT EXISTS post_categories (
     FOREIGN KEY (category_id) REFERENCES categories(id)
 );
 
+CREATE INDEX IF NOT EXISTS idx_post_categories_category_id ON post_categories(category_id);
+
 -- POST_REACTIONS Table
 CREATE TABLE IF NOT EXISTS post_reactions (
     id INTEGER PRIMARY KEY AUTOINCREMENT,     
@@ -64,14 +83,29 @@ CREATE TABLE IF NOT EXISTS comment_reactions (
     FOREIGN KEY (user_id) REFERENCES users(id) 
 );
 
+-- A user holds at most one reaction per post and per comment; drop duplicates left by
+-- older versions (keeping the latest) before enforcing it
+DELETE FROM post_reactions WHERE id NOT IN (SELECT MAX(id) FROM post_reactions GROUP BY user_id, post_id);
+DELETE FROM comment_reactions WHERE id NOT IN (SELECT MAX(id) FROM comment_reactions GROUP BY user_id, comment_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_post_reactions_user_post ON post_reactions(user_id, post_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_comment_reactions_user_comment ON comment_reactions(user_id, comment_id);
+
+-- Indexes backing the per-post and per-comment counts in list responses
+CREATE INDEX IF NOT EXISTS idx_comments_post_id ON comments(post_id);
+CREATE INDEX IF NOT EXISTS idx_post_reactions_post_id ON post_reactions(post_id);
+CREATE INDEX IF NOT EXISTS idx_comment_reactions_comment_id ON comment_reactions(comment_id);
+
 -- SESSIONS Table
 CREATE TABLE IF NOT EXISTS sessions (
     uuid TEXT PRIMARY KEY,                    
     user_id INTEGER NOT NULL,                 
     expires_at DATETIME NOT NULL,             
+    created_at DATETIME,
+    last_seen_at DATETIME,
+    user_agent TEXT,
+    ip_address TEXT,
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
-
-
-
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
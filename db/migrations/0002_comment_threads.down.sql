@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_comments_post_path;
+DROP INDEX IF EXISTS idx_comments_parent_id;
+
+ALTER TABLE comments DROP COLUMN path;
+ALTER TABLE comments DROP COLUMN depth;
+ALTER TABLE comments DROP COLUMN parent_id;
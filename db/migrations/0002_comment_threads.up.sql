@@ -0,0 +1,11 @@
+-- Threaded comments: each comment may reply to another comment of the same post.
+-- path is the slash-separated chain of zero-padded ids from the thread root down to
+-- the comment itself, so a thread sorts depth-first by path.
+ALTER TABLE comments ADD COLUMN parent_id INTEGER;
+ALTER TABLE comments ADD COLUMN depth INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE comments ADD COLUMN path TEXT;
+
+UPDATE comments SET path = printf('%010d', id) WHERE path IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_comments_parent_id ON comments(parent_id);
+CREATE INDEX IF NOT EXISTS idx_comments_post_path ON comments(post_id, path);
@@ -0,0 +1,33 @@
+-- Authors can edit and soft-delete their posts and comments. Every edit stores the
+-- previous body as a revision.
+ALTER TABLE posts ADD COLUMN edited_at DATETIME;
+ALTER TABLE posts ADD COLUMN deleted_at DATETIME;
+ALTER TABLE comments ADD COLUMN edited_at DATETIME;
+ALTER TABLE comments ADD COLUMN deleted_at DATETIME;
+
+-- POST_REVISIONS Table
+CREATE TABLE IF NOT EXISTS post_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_id INTEGER NOT NULL,
+    editor_id INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    content TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (post_id) REFERENCES posts(id),
+    FOREIGN KEY (editor_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_post_revisions_post_id ON post_revisions(post_id);
+
+-- COMMENT_REVISIONS Table
+CREATE TABLE IF NOT EXISTS comment_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    comment_id INTEGER NOT NULL,
+    editor_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (comment_id) REFERENCES comments(id),
+    FOREIGN KEY (editor_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_comment_revisions_comment_id ON comment_revisions(comment_id);
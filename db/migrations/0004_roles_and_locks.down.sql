@@ -0,0 +1,5 @@
+ALTER TABLE comments DROP COLUMN locked_at;
+ALTER TABLE posts DROP COLUMN locked_at;
+
+DROP INDEX IF EXISTS idx_users_role;
+ALTER TABLE users DROP COLUMN role;
@@ -0,0 +1,9 @@
+-- Every user has a role: "user", "moderator" or "admin". Moderators can delete and lock any
+-- post or comment; admins can also manage categories and users.
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin'));
+
+CREATE INDEX IF NOT EXISTS idx_users_role ON users(role);
+
+-- Locked posts accept no new comments and locked posts and comments can no longer be edited
+ALTER TABLE posts ADD COLUMN locked_at DATETIME;
+ALTER TABLE comments ADD COLUMN locked_at DATETIME;
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS moderation_log_no_delete;
+DROP TRIGGER IF EXISTS moderation_log_no_update;
+DROP TABLE IF EXISTS moderation_log;
+DROP TABLE IF EXISTS user_sanctions;
+DROP TABLE IF EXISTS reports;
@@ -0,0 +1,60 @@
+-- REPORTS Table: users flag posts and comments for moderators
+CREATE TABLE IF NOT EXISTS reports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    target_type TEXT NOT NULL CHECK (target_type IN ('post', 'comment')),
+    target_id INTEGER NOT NULL,
+    reporter_id INTEGER NOT NULL,
+    reason TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'dismissed', 'actioned')),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    resolved_at DATETIME,
+    resolved_by INTEGER,
+    FOREIGN KEY (reporter_id) REFERENCES users(id),
+    FOREIGN KEY (resolved_by) REFERENCES users(id)
+);
+
+-- A user has at most one open report per target
+CREATE UNIQUE INDEX IF NOT EXISTS idx_reports_open_reporter ON reports(target_type, target_id, reporter_id) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS idx_reports_status ON reports(status, created_at);
+
+-- USER_SANCTIONS Table: restrictions placed on accounts by moderators
+CREATE TABLE IF NOT EXISTS user_sanctions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    expires_at DATETIME,
+    created_by INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    revoked_at DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (created_by) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_sanctions_user_id ON user_sanctions(user_id);
+
+-- MODERATION_LOG Table: append-only audit trail of moderator actions
+CREATE TABLE IF NOT EXISTS moderation_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    moderator_id INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target_id INTEGER NOT NULL,
+    target_user_id INTEGER,
+    details TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (moderator_id) REFERENCES users(id),
+    FOREIGN KEY (target_user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_moderation_log_target ON moderation_log(target_type, target_id);
+
+CREATE TRIGGER IF NOT EXISTS moderation_log_no_update BEFORE UPDATE ON moderation_log
+BEGIN
+    SELECT RAISE(ABORT, 'moderation log entries cannot be changed');
+END;
+
+CREATE TRIGGER IF NOT EXISTS moderation_log_no_delete BEFORE DELETE ON moderation_log
+BEGIN
+    SELECT RAISE(ABORT, 'moderation log entries cannot be deleted');
+END;
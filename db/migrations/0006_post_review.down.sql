@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS notifications;
+
+DROP INDEX IF EXISTS idx_posts_status;
+ALTER TABLE posts DROP COLUMN reviewed_at;
+ALTER TABLE posts DROP COLUMN reviewed_by;
+ALTER TABLE posts DROP COLUMN status;
@@ -0,0 +1,24 @@
+-- Posts by untrusted users wait for a moderator when pre-moderation is enabled.
+-- Existing posts are approved.
+ALTER TABLE posts ADD COLUMN status TEXT NOT NULL DEFAULT 'approved' CHECK (status IN ('pending', 'approved', 'rejected'));
+ALTER TABLE posts ADD COLUMN reviewed_by INTEGER;
+ALTER TABLE posts ADD COLUMN reviewed_at DATETIME;
+
+CREATE INDEX IF NOT EXISTS idx_posts_status ON posts(status, created_at);
+
+-- NOTIFICATIONS Table: messages to a user about activity that concerns them
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    actor_id INTEGER,
+    post_id INTEGER,
+    comment_id INTEGER,
+    message TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    read_at DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (actor_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id, created_at);
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS account_tokens;
+-- The placeholder author stays while anonymized content still points to it
+DELETE FROM users WHERE username = '[deleted]' AND email = 'deleted-user@invalid'
+AND NOT EXISTS (SELECT 1 FROM posts WHERE user_id = users.id)
+AND NOT EXISTS (SELECT 1 FROM comments WHERE user_id = users.id)
+AND NOT EXISTS (SELECT 1 FROM post_revisions WHERE editor_id = users.id)
+AND NOT EXISTS (SELECT 1 FROM comment_revisions WHERE editor_id = users.id);
+ALTER TABLE users DROP COLUMN deleted_at;
@@ -0,0 +1,24 @@
+-- Deleted accounts keep their row, scrubbed of personal data, so that moderation records
+-- still point somewhere
+ALTER TABLE users ADD COLUMN deleted_at DATETIME;
+
+-- Placeholder author for the anonymized content of deleted accounts. It has no password
+-- and cannot log in.
+INSERT INTO users (email, username, password, deleted_at)
+SELECT 'deleted-user@invalid', '[deleted]', '', CURRENT_TIMESTAMP
+WHERE NOT EXISTS (SELECT 1 FROM users WHERE username = '[deleted]');
+
+-- ACCOUNT_TOKENS Table: single-use links sent by email, such as confirming a new address.
+-- Only a hash of the token is stored.
+CREATE TABLE IF NOT EXISTS account_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    purpose TEXT NOT NULL,
+    email TEXT NOT NULL, -- the address the token was sent to
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_tokens_user_id ON account_tokens(user_id);
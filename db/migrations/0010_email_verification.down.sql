@@ -0,0 +1,2 @@
+DELETE FROM account_tokens WHERE purpose IN ('verify_email', 'password_reset');
+ALTER TABLE users DROP COLUMN email_verified_at;
@@ -0,0 +1,5 @@
+-- Accounts must confirm their email address before they can post. Existing accounts
+-- predate verification and are treated as confirmed.
+ALTER TABLE users ADD COLUMN email_verified_at DATETIME;
+
+UPDATE users SET email_verified_at = COALESCE(created_at, CURRENT_TIMESTAMP);
@@ -0,0 +1,12 @@
+-- NOTIFICATION_PREFERENCES Table: which kinds of events a user is notified about on the site
+-- and by email. Users without a row for an event get the defaults.
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id INTEGER NOT NULL,
+    event TEXT NOT NULL,
+    site BOOLEAN NOT NULL,
+    email BOOLEAN NOT NULL,
+    PRIMARY KEY (user_id, event),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_unread ON notifications(user_id, read_at);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_messages_unread;
+DROP INDEX IF EXISTS idx_messages_conversation;
+DROP INDEX IF EXISTS idx_conversations_user2;
+DROP INDEX IF EXISTS idx_conversations_user1;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS conversations;
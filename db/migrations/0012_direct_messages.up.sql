@@ -0,0 +1,31 @@
+-- CONVERSATIONS Table: private conversations between two users, stored with the lower user
+-- id first so that each pair has a single conversation
+CREATE TABLE IF NOT EXISTS conversations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user1_id INTEGER NOT NULL,
+    user2_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_message_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user1_id, user2_id),
+    CHECK (user1_id < user2_id),
+    FOREIGN KEY (user1_id) REFERENCES users(id),
+    FOREIGN KEY (user2_id) REFERENCES users(id)
+);
+
+-- MESSAGES Table: messages of a conversation; read_at is set once the other participant
+-- read the message
+CREATE TABLE IF NOT EXISTS messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    conversation_id INTEGER NOT NULL,
+    sender_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    read_at DATETIME,
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+    FOREIGN KEY (sender_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversations_user1 ON conversations(user1_id, last_message_at);
+CREATE INDEX IF NOT EXISTS idx_conversations_user2 ON conversations(user2_id, last_message_at);
+CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages(conversation_id, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_messages_unread ON messages(conversation_id, read_at);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_mentions_user;
+DROP INDEX IF EXISTS idx_mentions_comment;
+DROP INDEX IF EXISTS idx_mentions_content;
+DROP TABLE IF EXISTS mentions;
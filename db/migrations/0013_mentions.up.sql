@@ -0,0 +1,16 @@
+-- MENTIONS Table: users mentioned as @username in a post (comment_id NULL) or a comment,
+-- kept in sync with the content when it is edited
+CREATE TABLE IF NOT EXISTS mentions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    post_id INTEGER NOT NULL,
+    comment_id INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (post_id) REFERENCES posts(id),
+    FOREIGN KEY (comment_id) REFERENCES comments(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_mentions_content ON mentions(post_id, COALESCE(comment_id, 0), user_id);
+CREATE INDEX IF NOT EXISTS idx_mentions_comment ON mentions(comment_id);
+CREATE INDEX IF NOT EXISTS idx_mentions_user ON mentions(user_id, created_at);
@@ -0,0 +1,5 @@
+-- Post and comment bodies are Markdown. The sanitized HTML rendered from them is cached next
+-- to the source; NULL means it has not been rendered yet, and the server renders those rows
+-- when it starts.
+ALTER TABLE posts ADD COLUMN content_html TEXT;
+ALTER TABLE comments ADD COLUMN content_html TEXT;
@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"forum/mailer"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength     = 8
+	emailTokenLifetime    = 24 * time.Hour
+	passwordResetLifetime = time.Hour
+
+	// deletedUsername is the placeholder account anonymized content is attributed to
+	deletedUsername = "[deleted]"
+)
+
+// Purposes of account tokens stored in account_tokens.purpose
+const (
+	tokenVerifyEmail   = "verify_email"   // confirms the address an account registered with
+	tokenEmailChange   = "email_change"   // confirms the new address of an account
+	tokenPasswordReset = "password_reset" // sets a new password without knowing the old one
+)
+
+var (
+	// errWrongPassword is returned when the password confirming an account change does not match
+	errWrongPassword = errors.New("current password is incorrect")
+	// errInvalidToken is returned for account tokens that are unknown, used or expired
+	errInvalidToken = errors.New("this link is invalid or has expired")
+	// errEmailTaken is returned when changing to an address another account uses
+	errEmailTaken = errors.New("email already exists")
+	// errLastAdmin is returned when the only admin tries to delete their account
+	errLastAdmin = errors.New("the last admin cannot delete their account")
+)
+
+// checkPassword compares a password with the stored hash of a user's password
+func checkPassword(db *sql.DB, userID int, password string) error {
+	var hash string
+	if err := db.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&hash); err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return errWrongPassword
+	}
+	return nil
+}
+
+// hashToken returns the form of an account token stored in the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAccountToken stores a single-use token for purpose and returns it. Only its hash is kept.
+func newAccountToken(e execer, userID int, purpose, email string, lifetime time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	token := hex.EncodeToString(raw)
+
+	_, err := e.Exec("INSERT INTO account_tokens (token_hash, user_id, purpose, email, expires_at) VALUES (?, ?, ?, ?, ?)",
+		hashToken(token), userID, purpose, email, time.Now().Add(lifetime))
+	if err != nil {
+		return "", fmt.Errorf("failed to store token: %v", err)
+	}
+	return token, nil
+}
+
+// accountToken is what a used account token was issued for
+type accountToken struct {
+	UserID  int
+	Purpose string
+	Email   string
+}
+
+// useAccountToken marks a token for one of the given purposes as used and returns what it
+// was issued for, or errInvalidToken
+func useAccountToken(q queryRower, token string, purposes ...string) (*accountToken, error) {
+	placeholders := make([]string, len(purposes))
+	args := []interface{}{hashToken(token), time.Now()}
+	for i, purpose := range purposes {
+		placeholders[i] = "?"
+		args = append(args, purpose)
+	}
+	var t accountToken
+	err := q.QueryRow(`UPDATE account_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ? AND purpose IN (`+strings.Join(placeholders, ", ")+`)
+		RETURNING user_id, purpose, email`, args...).Scan(&t.UserID, &t.Purpose, &t.Email)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// lifetimeText describes how long a link in an email stays valid, in whole hours
+func lifetimeText(lifetime time.Duration) string {
+	if hours := int(lifetime.Hours()); hours != 1 {
+		return fmt.Sprintf("%d hours", hours)
+	}
+	return "1 hour"
+}
+
+// sendTokenEmail mails a link to path carrying token, preceded by text explaining what it is for
+func sendTokenEmail(to, subject, text, path, token string) error {
+	link := baseURL + path + "?token=" + url.QueryEscape(token)
+	return outbox.Send(mailer.Message{
+		To:      to,
+		Subject: subject,
+		Body:    text + "\n\n" + link + "\n\nIf you did not ask for this, you can ignore this email.\n",
+	})
+}
+
+// ChangePasswordHandler sets a new password for the current user after checking the
+// current one, and logs out every other session
+func ChangePasswordHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if len(req.NewPassword) < minPasswordLength {
+			http.Error(w, fmt.Sprintf("New password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+			return
+		}
+
+		user := CurrentUser(r)
+		err := checkPassword(db, user.ID, req.CurrentPassword)
+		if errors.Is(err, errWrongPassword) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to check password: %v\n", err)
+			http.Error(w, "Failed to change password", http.StatusInternalServerError)
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcryptCost)
+		if err != nil {
+			log.Printf("Failed to hash password: %v\n", err)
+			http.Error(w, "Failed to change password", http.StatusInternalServerError)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Failed to start transaction: %v\n", err)
+			http.Error(w, "Failed to change password", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var revoked int64
+		_, err = tx.Exec("UPDATE users SET password = ? WHERE id = ?", string(hash), user.ID)
+		if err == nil {
+			var res sql.Result
+			res, err = tx.Exec("DELETE FROM sessions WHERE user_id = ? AND uuid != ?", user.ID, user.SessionID)
+			if err == nil {
+				revoked, _ = res.RowsAffected()
+				err = tx.Commit()
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to change password: %v\n", err)
+			http.Error(w, "Failed to change password", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "Password changed", "revoked_sessions": revoked})
+	}
+}
+
+// ChangeEmailHandler starts changing the current user's email address. The address only
+// changes once the link sent to it is opened.
+func ChangeEmailHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Password string `json:"password"`
+			NewEmail string `json:"new_email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		req.NewEmail = strings.TrimSpace(req.NewEmail)
+		if !validEmail(req.NewEmail) {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+
+		user := CurrentUser(r)
+		err := checkPassword(db, user.ID, req.Password)
+		if errors.Is(err, errWrongPassword) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to check password: %v\n", err)
+			http.Error(w, "Failed to change email", http.StatusInternalServerError)
+			return
+		}
+
+		var taken bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", req.NewEmail).Scan(&taken); err != nil {
+			log.Printf("Failed to check email: %v\n", err)
+			http.Error(w, "Failed to change email", http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, errEmailTaken.Error(), http.StatusConflict)
+			return
+		}
+
+		token, err := newAccountToken(db, user.ID, tokenEmailChange, req.NewEmail, emailTokenLifetime)
+		if err != nil {
+			log.Printf("Failed to start email change: %v\n", err)
+			http.Error(w, "Failed to change email", http.StatusInternalServerError)
+			return
+		}
+		err = sendTokenEmail(req.NewEmail, "Confirm your new email address",
+			fmt.Sprintf("Open this link within %s to use this address for your forum account %s:", lifetimeText(emailTokenLifetime), user.Username),
+			"/account/verify-email", token)
+		if err != nil {
+			log.Printf("Failed to send email change link: %v\n", err)
+			http.Error(w, "Failed to send the confirmation email", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Open the link sent to " + req.NewEmail + " to confirm the change"})
+	}
+}
+
+// VerifyEmailHandler confirms an email address with the token from the link sent to it, either
+// the address an account registered with or the new address of an email change. Browsers
+// opening the link are sent on to the home page.
+func VerifyEmailHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		purpose, err := verifyEmail(db, r.URL.Query().Get("token"))
+		switch {
+		case errors.Is(err, errInvalidToken):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, errEmailTaken):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			log.Printf("Failed to verify email: %v\n", err)
+			http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+			return
+		}
+
+		message := "Email address confirmed"
+		if purpose == tokenEmailChange {
+			message = "Email address changed"
+		}
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/?email_verified="+purpose, http.StatusSeeOther)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": message})
+	}
+}
+
+// verifyEmail consumes an email verification or change token and marks its address as the
+// confirmed address of the account. It returns the purpose of the token.
+func verifyEmail(db *sql.DB, token string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	t, err := useAccountToken(tx, token, tokenVerifyEmail, tokenEmailChange)
+	if err != nil {
+		return "", err
+	}
+
+	var res sql.Result
+	if t.Purpose == tokenEmailChange {
+		// The address may have been taken since the link was sent
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ? AND id != ?)", t.Email, t.UserID).Scan(&taken); err != nil {
+			return "", err
+		}
+		if taken {
+			return "", errEmailTaken
+		}
+		res, err = tx.Exec("UPDATE users SET email = ?, email_verified_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL",
+			t.Email, t.UserID)
+	} else {
+		// A verification link only counts for the address the account still has
+		res, err = tx.Exec(`UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP)
+			WHERE id = ? AND email = ? AND deleted_at IS NULL`, t.UserID, t.Email)
+	}
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", errInvalidToken
+	}
+	return t.Purpose, tx.Commit()
+}
+
+// DeleteAccountHandler deletes the current user's account after checking their password.
+// Their posts and comments are anonymized or removed depending on the account deletion policy.
+func DeleteAccountHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user := CurrentUser(r)
+		err := checkPassword(db, user.ID, req.Password)
+		if err == nil {
+			err = deleteAccount(db, user)
+		}
+		switch {
+		case errors.Is(err, errWrongPassword):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, errLastAdmin):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			log.Printf("Failed to delete account: %v\n", err)
+			http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+			return
+		}
+
+		clearSessionCookie(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Account deleted"})
+	}
+}
+
+// deleteAccount removes a user's personal data in one transaction. Their posts and comments
+// move to the placeholder account, emptied first when the policy is to remove them; their
+// reactions, sessions, notifications and tokens are deleted. The users row stays, scrubbed,
+// so moderation records keep pointing at it.
+func deleteAccount(db *sql.DB, user *SessionUser) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if user.Role == RoleAdmin {
+		var admins int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'admin' AND deleted_at IS NULL").Scan(&admins); err != nil {
+			return err
+		}
+		if admins <= 1 {
+			return errLastAdmin
+		}
+	}
+
+	var placeholderID int
+	if err := tx.QueryRow("SELECT id FROM users WHERE username = ?", deletedUsername).Scan(&placeholderID); err != nil {
+		return fmt.Errorf("failed to find placeholder account: %v", err)
+	}
+
+	var statements []string
+	if accountDeletion == "remove" {
+		statements = append(statements,
+			"DELETE FROM post_revisions WHERE post_id IN (SELECT id FROM posts WHERE user_id = ?)",
+			"DELETE FROM comment_revisions WHERE comment_id IN (SELECT id FROM comments WHERE user_id = ?)",
+			"UPDATE posts SET title = '[deleted]', content = '', content_html = '', deleted_at = COALESCE(deleted_at, CURRENT_TIMESTAMP) WHERE user_id = ?",
+			"UPDATE comments SET content = '', content_html = '', deleted_at = COALESCE(deleted_at, CURRENT_TIMESTAMP) WHERE user_id = ?",
+			"DELETE FROM messages WHERE sender_id = ?",
+			"DELETE FROM mentions WHERE post_id IN (SELECT id FROM posts WHERE user_id = ?) AND comment_id IS NULL",
+			"DELETE FROM mentions WHERE comment_id IN (SELECT id FROM comments WHERE user_id = ?)",
+		)
+	}
+	statements = append(statements,
+		"DELETE FROM post_reactions WHERE user_id = ?",
+		"DELETE FROM comment_reactions WHERE user_id = ?",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM notifications WHERE user_id = ?",
+		"DELETE FROM notification_preferences WHERE user_id = ?",
+		// Content mentioning the user is rendered again without linking them
+		"UPDATE posts SET content_html = NULL WHERE id IN (SELECT post_id FROM mentions WHERE user_id = ? AND comment_id IS NULL)",
+		"UPDATE comments SET content_html = NULL WHERE id IN (SELECT comment_id FROM mentions WHERE user_id = ?)",
+		"DELETE FROM mentions WHERE user_id = ?",
+		"DELETE FROM account_tokens WHERE user_id = ?",
+	)
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, user.ID); err != nil {
+			return fmt.Errorf("failed to delete account data: %v", err)
+		}
+	}
+
+	for _, statement := range []string{
+		"UPDATE posts SET user_id = ? WHERE user_id = ?",
+		"UPDATE comments SET user_id = ? WHERE user_id = ?",
+		"UPDATE post_revisions SET editor_id = ? WHERE editor_id = ?",
+		"UPDATE comment_revisions SET editor_id = ? WHERE editor_id = ?",
+	} {
+		if _, err := tx.Exec(statement, placeholderID, user.ID); err != nil {
+			return fmt.Errorf("failed to anonymize content: %v", err)
+		}
+	}
+
+	// Neither the username nor the email address can be registered, so both are always free
+	_, err = tx.Exec(`UPDATE users SET username = '[deleted ' || id || ']', email = 'deleted-' || id || '@invalid',
+		password = '', display_name = '', bio = '', role = 'user', deleted_at = CURRENT_TIMESTAMP
+		WHERE id = ?`, user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to scrub account: %v", err)
+	}
+	return tx.Commit()
+}
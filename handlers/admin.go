@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// UserSummary is the view of an account shown to admins
+type UserSummary struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Role      Role      `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListUsersHandler returns a page of accounts that were not deleted, newest first, optionally filtered by role
+func ListUsersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		page, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query := "SELECT id, username, email, role, created_at FROM users WHERE deleted_at IS NULL"
+		var args []interface{}
+		if name := r.URL.Query().Get("role"); name != "" {
+			role, err := ParseRole(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			query += " AND role = ?"
+			args = append(args, role)
+		}
+		if condition, conditionArgs := keysetCondition(page, "created_at", "id"); condition != "" {
+			query += " AND " + condition
+			args = append(args, conditionArgs...)
+		}
+		direction, reverse := pageOrder(page, true)
+		query += fmt.Sprintf(" ORDER BY created_at %[1]s, id %[1]s LIMIT ?", direction)
+		args = append(args, page.Limit+1)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			log.Printf("Failed to fetch users: %v\n", err)
+			http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		users := []UserSummary{}
+		for rows.Next() {
+			var user UserSummary
+			if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.CreatedAt); err != nil {
+				log.Printf("Failed to scan user row: %v\n", err)
+				http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+				return
+			}
+			users = append(users, user)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to fetch users: %v\n", err)
+			http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+			return
+		}
+
+		users, next := finishPage(users, page, reverse, func(u UserSummary) (time.Time, int) { return u.CreatedAt, u.ID })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Page{Items: users, NextCursor: next})
+	}
+}
+
+// UpdateUserRoleHandler changes the role of another user
+func UpdateUserRoleHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			UserID int    `json:"user_id"`
+			Role   string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		role, err := ParseRole(req.Role)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Admins cannot demote themselves, so there is always at least one admin left
+		admin := CurrentUser(r)
+		if req.UserID == admin.ID {
+			http.Error(w, "You cannot change your own role", http.StatusBadRequest)
+			return
+		}
+
+		var user UserSummary
+		err = db.QueryRow("UPDATE users SET role = ? WHERE id = ? RETURNING id, username, email, role, created_at", role, req.UserID).
+			Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.CreatedAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to update role: %v\n", err)
+			http.Error(w, "Failed to update role", http.StatusInternalServerError)
+			return
+		}
+		logPermissionUse(admin, PermManageUsers, fmt.Sprintf("make user %d %s", user.ID, role))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	}
+}
@@ -3,11 +3,98 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"strings"
 )
 
+// Category represents a category posts can be filed under
+type Category struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	Description string `json:"description"`
+	PostCount   int    `json:"post_count"`
+}
+
+// errUnknownCategory is returned when a category reference matches no category
+var errUnknownCategory = errors.New("unknown category")
+
+// findCategoryID resolves a category reference, given as either its slug or its numeric id
+func findCategoryID(db *sql.DB, ref string) (int, error) {
+	ref = strings.TrimSpace(ref)
+	var id int
+	err := db.QueryRow("SELECT id FROM categories WHERE slug = ? OR CAST(id AS TEXT) = ?", strings.ToLower(ref), ref).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: %s", errUnknownCategory, ref)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// resolveCategoryIDs resolves a list of category references, dropping duplicates
+func resolveCategoryIDs(db *sql.DB, refs []string) ([]int, error) {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, ref := range refs {
+		id, err := findCategoryID(db, ref)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// ListCategoriesHandler returns every category with the number of posts filed under it
+func ListCategoriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := `
+            SELECT c.id, c.name, COALESCE(c.slug, ''), COALESCE(c.description, ''), COUNT(p.id)
+            FROM categories c
+            LEFT JOIN post_categories pc ON pc.category_id = c.id
+            LEFT JOIN posts p ON p.id = pc.post_id AND p.deleted_at IS NULL AND p.status = 'approved'
+            GROUP BY c.id
+            ORDER BY c.name ASC`
+
+		rows, err := db.Query(query)
+		if err != nil {
+			log.Printf("Failed to fetch categories: %v\n", err)
+			http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		categories := []Category{}
+		for rows.Next() {
+			var category Category
+			if err := rows.Scan(&category.ID, &category.Name, &category.Slug, &category.Description, &category.PostCount); err != nil {
+				log.Printf("Failed to scan category row: %v\n", err)
+				http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+				return
+			}
+			categories = append(categories, category)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(categories)
+	}
+}
+
+// GetPostsByCategoryHandler returns the posts filed under a category given by category_id or slug
 func GetPostsByCategoryHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Ensure the method is GET
@@ -16,57 +103,265 @@ func GetPostsByCategoryHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Extract category_id from query parameters
-		categoryIDStr := r.URL.Query().Get("category_id")
-		if categoryIDStr == "" {
-			http.Error(w, "Missing category_id parameter", http.StatusBadRequest)
+		// Accept either category_id or the category slug
+		ref := r.URL.Query().Get("category_id")
+		if ref == "" {
+			ref = r.URL.Query().Get("category")
+		}
+		if ref == "" {
+			http.Error(w, "Missing category_id or category parameter", http.StatusBadRequest)
 			return
 		}
 
-		// Convert category_id to an integer
-		categoryID, err := strconv.Atoi(categoryIDStr)
+		categoryID, err := findCategoryID(db, ref)
+		if errors.Is(err, errUnknownCategory) {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			http.Error(w, "Invalid category_id value", http.StatusBadRequest)
+			log.Printf("Failed to resolve category: %v\n", err)
+			http.Error(w, "Failed to fetch posts by category", http.StatusInternalServerError)
 			return
 		}
 
-		// Query to fetch posts for the given category
-		query := `
-            SELECT p.id, p.title, p.content, p.created_at, p.author_id
-            FROM posts p
-            INNER JOIN post_categories pc ON p.id = pc.post_id
-            WHERE pc.category_id = ?`
+		page, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		viewerID := 0
+		if user := CurrentUser(r); user != nil {
+			viewerID = user.ID
+		}
 
-		rows, err := db.Query(query, categoryID)
+		posts, next, err := queryPosts(db, postFilter{CategoryID: categoryID}, page, viewerID)
 		if err != nil {
 			log.Printf("Failed to fetch posts by category: %v\n", err)
 			http.Error(w, "Failed to fetch posts by category", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
 
-		// Parse rows into a slice of posts
-		type Post struct {
-			ID        int    `json:"id"`
-			Title     string `json:"title"`
-			Content   string `json:"content"`
-			CreatedAt string `json:"created_at"`
-			AuthorID  int    `json:"author_id"`
+		// Send the page of posts as JSON response
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Page{Items: posts, NextCursor: next})
+	}
+}
+
+// slugify turns a category name into its URL slug
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
 		}
-		var posts []Post
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
 
-		for rows.Next() {
-			var post Post
-			if err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt, &post.AuthorID); err != nil {
-				log.Printf("Failed to scan post row: %v\n", err)
-				http.Error(w, "Failed to process posts", http.StatusInternalServerError)
-				return
-			}
-			posts = append(posts, post)
+// categoryRequest is the body of the category management endpoints
+type categoryRequest struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Slug        string `json:"slug"` // derived from the name when empty
+	Description string `json:"description"`
+}
+
+// validate normalizes the name and slug and reports what is wrong with the request
+func (req *categoryRequest) validate() error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return errors.New("name is required")
+	}
+	if req.Slug == "" {
+		req.Slug = req.Name
+	}
+	req.Slug = slugify(req.Slug)
+	if req.Slug == "" {
+		return errors.New("slug must contain letters or digits")
+	}
+	// Numeric slugs would be ambiguous with category ids in findCategoryID
+	if strings.Trim(req.Slug, "0123456789") == "" {
+		return errors.New("slug must not be a number")
+	}
+	return nil
+}
+
+// categoryTaken reports whether another category already uses the name or slug
+func categoryTaken(q queryRower, req categoryRequest) (bool, error) {
+	var taken bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE (name = ? OR slug = ?) AND id != ?)", req.Name, req.Slug, req.ID).Scan(&taken)
+	return taken, err
+}
+
+// CreateCategoryHandler adds a category
+func CreateCategoryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req categoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		req.ID = 0
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Failed to start transaction: %v\n", err)
+			http.Error(w, "Failed to create category", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if taken, err := categoryTaken(tx, req); err != nil {
+			log.Printf("Failed to check category: %v\n", err)
+			http.Error(w, "Failed to create category", http.StatusInternalServerError)
+			return
+		} else if taken {
+			http.Error(w, "A category with this name or slug already exists", http.StatusConflict)
+			return
+		}
+
+		category := Category{Name: req.Name, Slug: req.Slug, Description: req.Description}
+		err = tx.QueryRow("INSERT INTO categories (name, slug, description) VALUES (?, ?, ?) RETURNING id",
+			req.Name, req.Slug, req.Description).Scan(&category.ID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Failed to create category: %v\n", err)
+			http.Error(w, "Failed to create category", http.StatusInternalServerError)
+			return
+		}
+		logPermissionUse(CurrentUser(r), PermManageCategories, "create category "+category.Slug)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(category)
+	}
+}
+
+// UpdateCategoryHandler renames a category or changes its slug or description
+func UpdateCategoryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req categoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Failed to start transaction: %v\n", err)
+			http.Error(w, "Failed to update category", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if taken, err := categoryTaken(tx, req); err != nil {
+			log.Printf("Failed to check category: %v\n", err)
+			http.Error(w, "Failed to update category", http.StatusInternalServerError)
+			return
+		} else if taken {
+			http.Error(w, "A category with this name or slug already exists", http.StatusConflict)
+			return
+		}
+
+		res, err := tx.Exec("UPDATE categories SET name = ?, slug = ?, description = ? WHERE id = ?",
+			req.Name, req.Slug, req.Description, req.ID)
+		if err != nil {
+			log.Printf("Failed to update category: %v\n", err)
+			http.Error(w, "Failed to update category", http.StatusInternalServerError)
+			return
+		}
+		if updated, _ := res.RowsAffected(); updated == 0 {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Failed to update category: %v\n", err)
+			http.Error(w, "Failed to update category", http.StatusInternalServerError)
+			return
+		}
+		logPermissionUse(CurrentUser(r), PermManageCategories, fmt.Sprintf("update category %d", req.ID))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Category{ID: req.ID, Name: req.Name, Slug: req.Slug, Description: req.Description})
+	}
+}
+
+// DeleteCategoryHandler removes a category. Its posts stay but are no longer filed under it.
+func DeleteCategoryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ID int `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Failed to start transaction: %v\n", err)
+			http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM post_categories WHERE category_id = ?", req.ID); err != nil {
+			log.Printf("Failed to unfile posts from category: %v\n", err)
+			http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+			return
+		}
+		res, err := tx.Exec("DELETE FROM categories WHERE id = ?", req.ID)
+		if err != nil {
+			log.Printf("Failed to delete category: %v\n", err)
+			http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+			return
+		}
+		if deleted, _ := res.RowsAffected(); deleted == 0 {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Failed to delete category: %v\n", err)
+			http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+			return
 		}
+		logPermissionUse(CurrentUser(r), PermManageCategories, fmt.Sprintf("delete category %d", req.ID))
 
-		// Send posts as JSON response
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(posts)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Category deleted successfully"})
 	}
 }
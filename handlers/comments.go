@@ -3,18 +3,110 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Comment represents a single comment on a post.
 type Comment struct {
-	ID        int    `json:"id"`
-	PostID    int    `json:"post_id"`
-	UserID    int    `json:"user_id"`
-	Content   string `json:"content"`
-	CreatedAt string `json:"created_at"`
+	ID          int       `json:"id"`
+	PostID      int       `json:"post_id"`
+	ParentID    *int      `json:"parent_id"`
+	Depth       int       `json:"depth"`
+	UserID      int       `json:"user_id"`
+	Author      string    `json:"author"`
+	Content     string    `json:"content"`      // Markdown source
+	ContentHTML string    `json:"content_html"` // Content rendered to sanitized HTML
+	CreatedAt   time.Time `json:"created_at"`
+	Likes       int       `json:"likes"`
+	Dislikes    int       `json:"dislikes"`
+
+	Edited   bool       `json:"edited"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	Deleted  bool       `json:"deleted,omitempty"` // deleted comments keep their place in the thread without author or content
+	Locked   bool       `json:"locked"`            // locked comments accept no replies or edits
+	Mentions []string   `json:"mentions"`          // usernames mentioned as @username, linked to their profiles in ContentHTML
+
+	ReplyCount     int        `json:"reply_count"`               // direct replies stored for this comment
+	Replies        []*Comment `json:"replies,omitempty"`         // replies included in this response
+	CollapsedCount int        `json:"collapsed_count,omitempty"` // replies anywhere below this comment left out of Replies
+
+	path        string
+	descendants int
+}
+
+// commentColumns lists the columns read by scanComment
+const commentColumns = `
+	comments.id, comments.post_id, comments.parent_id, comments.depth, comments.path,
+	comments.user_id, COALESCE(users.username, ''), comments.content, comments.created_at,
+	comments.edited_at, comments.deleted_at IS NOT NULL, comments.locked_at IS NOT NULL,
+	(SELECT COUNT(*) FROM comment_reactions WHERE comment_id = comments.id AND reaction_type = 'LIKE'),
+	(SELECT COUNT(*) FROM comment_reactions WHERE comment_id = comments.id AND reaction_type = 'DISLIKE'),
+	(SELECT COUNT(*) FROM comments replies WHERE replies.parent_id = comments.id),
+	(SELECT COUNT(*) FROM comments descendants
+		WHERE descendants.post_id = comments.post_id
+		AND descendants.path > comments.path || '/' AND descendants.path < comments.path || '0'),
+	(SELECT json_group_array(mentioned.username)
+		FROM mentions JOIN users mentioned ON mentioned.id = mentions.user_id
+		WHERE mentions.comment_id = comments.id AND mentioned.deleted_at IS NULL),
+	comments.content_html`
+
+// commentSelect selects a comment with its author, counts and thread position
+const commentSelect = "SELECT " + commentColumns + `
+	FROM comments
+	LEFT JOIN users ON users.id = comments.user_id`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanComment reads a comment selected with commentColumns
+func scanComment(row rowScanner) (*Comment, error) {
+	var comment Comment
+	var parentID sql.NullInt64
+	var editedAt sql.NullTime
+	var mentions string
+	var contentHTML sql.NullString
+	err := row.Scan(&comment.ID, &comment.PostID, &parentID, &comment.Depth, &comment.path,
+		&comment.UserID, &comment.Author, &comment.Content, &comment.CreatedAt,
+		&editedAt, &comment.Deleted, &comment.Locked, &comment.Likes, &comment.Dislikes, &comment.ReplyCount, &comment.descendants,
+		&mentions, &contentHTML)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(mentions), &comment.Mentions); err != nil {
+		return nil, fmt.Errorf("failed to decode mentions of comment %d: %v", comment.ID, err)
+	}
+	// Content not rendered yet is rendered on the fly
+	comment.ContentHTML = contentHTML.String
+	if !contentHTML.Valid {
+		comment.ContentHTML = renderMarkdown(comment.Content, comment.Mentions)
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		comment.ParentID = &id
+	}
+	if editedAt.Valid {
+		comment.Edited, comment.EditedAt = true, &editedAt.Time
+	}
+	if comment.Deleted {
+		comment.UserID, comment.Author, comment.Content, comment.ContentHTML, comment.Mentions = 0, "", "", "", []string{}
+	}
+	return &comment, nil
+}
+
+// commentPath builds the thread path of a comment from its parent's path
+func commentPath(parentPath string, id int64) string {
+	segment := fmt.Sprintf("%010d", id)
+	if parentPath == "" {
+		return segment
+	}
+	return parentPath + "/" + segment
 }
 
 // AddCommentHandler allows a user to add a comment to a post and immediately returns the new comment.
@@ -31,8 +123,9 @@ func AddCommentHandler(db *sql.DB) http.HandlerFunc {
 
         // Parse JSON body
         var data struct {
-            PostID  int    `json:"post_id"`
-            Content string `json:"content"`
+            PostID   int    `json:"post_id"`
+            ParentID int    `json:"parent_id"` // optional comment being replied to
+            Content  string `json:"content"`
         }
 
         decoder := json.NewDecoder(r.Body)
@@ -53,9 +146,70 @@ func AddCommentHandler(db *sql.DB) http.HandlerFunc {
             return
         }
 
-        // Insert the comment into the database
-        query := "INSERT INTO comments (post_id, user_id, content) VALUES (?, ?, ?)"
-        res, err := db.Exec(query, data.PostID, 0, data.Content) // Using userID = 0 as a placeholder
+        // Ensure the post is published and not locked
+        var postLocked bool
+        var postAuthorID int
+        var postTitle string
+        err = db.QueryRow("SELECT locked_at IS NOT NULL, user_id, title FROM posts WHERE id = ? AND deleted_at IS NULL AND status = 'approved'", data.PostID).
+            Scan(&postLocked, &postAuthorID, &postTitle)
+        if err == sql.ErrNoRows {
+            http.Error(w, "Post not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            log.Printf("Failed to check post: %v", err)
+            http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+            return
+        }
+        if postLocked {
+            http.Error(w, "Forbidden: this post is locked", http.StatusForbidden)
+            return
+        }
+
+        // Resolve where the reply sits in its thread. Replies to comments already at the
+        // maximum depth become siblings of the comment they reply to.
+        var parentID interface{}
+        depth, parentPath, parentAuthorID := 0, "", 0
+        if data.ParentID != 0 {
+            var parentPostID, parentDepth int
+            var grandparentID sql.NullInt64
+            var parentLocked bool
+            err = db.QueryRow("SELECT post_id, depth, path, parent_id, locked_at IS NOT NULL, user_id FROM comments WHERE id = ? AND deleted_at IS NULL", data.ParentID).
+                Scan(&parentPostID, &parentDepth, &parentPath, &grandparentID, &parentLocked, &parentAuthorID)
+            if err == sql.ErrNoRows || (err == nil && parentPostID != data.PostID) {
+                http.Error(w, "Parent comment not found on this post", http.StatusBadRequest)
+                return
+            }
+            if err != nil {
+                log.Printf("Failed to fetch parent comment: %v", err)
+                http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+                return
+            }
+            if parentLocked {
+                http.Error(w, "Forbidden: this comment is locked", http.StatusForbidden)
+                return
+            }
+
+            if parentDepth < maxCommentDepth {
+                parentID, depth = data.ParentID, parentDepth+1
+            } else {
+                parentID, depth = grandparentID, parentDepth
+                parentPath = parentPath[:max(strings.LastIndex(parentPath, "/"), 0)]
+            }
+        }
+
+        // Insert the comment and record its thread path in a single transaction
+        tx, err := db.Begin()
+        if err != nil {
+            log.Printf("Failed to start transaction: %v", err)
+            http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+            return
+        }
+        defer tx.Rollback()
+
+        user := CurrentUser(r)
+        query := "INSERT INTO comments (post_id, user_id, content, parent_id, depth) VALUES (?, ?, ?, ?, ?)"
+        res, err := tx.Exec(query, data.PostID, user.ID, data.Content, parentID, depth)
         if err != nil {
             log.Printf("Failed to insert comment into database: %v", err)
             http.Error(w, "Failed to add comment", http.StatusInternalServerError)
@@ -70,10 +224,47 @@ func AddCommentHandler(db *sql.DB) http.HandlerFunc {
             return
         }
 
+        _, err = tx.Exec("UPDATE comments SET path = ? WHERE id = ?", commentPath(parentPath, commentID), commentID)
+        if err != nil {
+            log.Printf("Failed to store comment thread path: %v", err)
+            http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+            return
+        }
+
+        // Notify the author of the comment replied to, the author of the post and anyone
+        // mentioned; each of them hears about the comment once
+        notifications := newNotifier(tx, user.ID, user.Username)
+        n := Notification{PostID: data.PostID, CommentID: int(commentID)}
+        if data.ParentID != 0 {
+            n.Kind, n.Message = notifyReply, fmt.Sprintf("%s replied to your comment on %q", user.Username, postTitle)
+            err = notifications.notify(parentAuthorID, n)
+        }
+        if err == nil {
+            n.Kind, n.Message = notifyComment, fmt.Sprintf("%s commented on your post %q", user.Username, postTitle)
+            err = notifications.notify(postAuthorID, n)
+        }
+        if err == nil {
+            var mentioned []int
+            if mentioned, err = storeMentions(tx, data.PostID, int(commentID), data.Content); err == nil {
+                n.Kind, n.Message = notifyMention, fmt.Sprintf("%s mentioned you in a comment on %q", user.Username, postTitle)
+                err = notifications.notifyMentions(mentioned, n)
+            }
+        }
+        if err == nil {
+            err = cacheContentHTML(tx, data.PostID, int(commentID), data.Content)
+        }
+        if err == nil {
+            err = tx.Commit()
+        }
+        if err != nil {
+            log.Printf("Failed to store comment notifications: %v", err)
+            http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+            return
+        }
+        notifications.sendEmails()
+
         // Fetch the newly inserted comment from the database
-        query = "SELECT id, post_id, user_id, content, created_at FROM comments WHERE id = ?"
-        var comment Comment
-        err = db.QueryRow(query, commentID).Scan(&comment.ID, &comment.PostID, &comment.UserID, &comment.Content, &comment.CreatedAt)
+        comment, err := scanComment(db.QueryRow(commentSelect+" WHERE comments.id = ?", commentID))
         if err != nil {
             log.Printf("Failed to retrieve inserted comment: %v", err)
             http.Error(w, "Failed to retrieve comment", http.StatusInternalServerError)
@@ -82,6 +273,7 @@ func AddCommentHandler(db *sql.DB) http.HandlerFunc {
 
         // Log the retrieved comment
         log.Printf("Successfully inserted comment: %+v", comment)
+        publishComment(db, comment)
 
         // Return the new comment as JSON
         w.Header().Set("Content-Type", "application/json")
@@ -89,7 +281,90 @@ func AddCommentHandler(db *sql.DB) http.HandlerFunc {
     }
 }
 
-// GetCommentsHandler retrieves all comments for a specific post.
+// EditCommentHandler lets the author change the content of a comment and returns the
+// updated comment. The previous version is kept in the comment's revision history.
+func EditCommentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var data struct {
+			CommentID int    `json:"comment_id"`
+			Content   string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if data.CommentID == 0 || data.Content == "" {
+			http.Error(w, "Missing comment_id or content", http.StatusBadRequest)
+			return
+		}
+
+		user := CurrentUser(r)
+		mentioned, err := reviseContent(db, commentRevisionSource, data.CommentID, user.ID, "", data.Content, "")
+		if err != nil {
+			writeContentError(w, err, "edit comment")
+			return
+		}
+
+		comment, err := scanComment(db.QueryRow(commentSelect+" WHERE comments.id = ?", data.CommentID))
+		if err != nil {
+			log.Printf("Failed to retrieve edited comment: %v", err)
+			http.Error(w, "Failed to retrieve comment", http.StatusInternalServerError)
+			return
+		}
+
+		if len(mentioned) > 0 {
+			var postTitle string
+			if err := db.QueryRow("SELECT title FROM posts WHERE id = ?", comment.PostID).Scan(&postTitle); err != nil {
+				log.Printf("Failed to fetch post of edited comment: %v", err)
+			} else {
+				n := Notification{Kind: notifyMention, PostID: comment.PostID, CommentID: comment.ID,
+					Message: fmt.Sprintf("%s mentioned you in a comment on %q", user.Username, postTitle)}
+				notifyEditMentions(db, user, mentioned, n)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(comment)
+	}
+}
+
+// DeleteCommentHandler lets the author or a moderator delete a comment. Its replies stay in place and the
+// comment itself is returned as a placeholder without author or content.
+func DeleteCommentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var data struct {
+			CommentID int `json:"comment_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.CommentID == 0 {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		if err := softDelete(db, "comments", data.CommentID, CurrentUser(r)); err != nil {
+			writeContentError(w, err, "delete comment")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Comment deleted successfully"})
+	}
+}
+
+// GetCommentsHandler retrieves a page of comment threads for a specific post. Comments of
+// deleted posts are not served, nor those of unpublished posts except to their author and
+// moderators.
 func GetCommentsHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Ensure the method is GET
@@ -112,30 +387,181 @@ func GetCommentsHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Query the database for comments related to the post
-		query := "SELECT id, post_id, user_id, content, created_at FROM comments WHERE post_id = ? ORDER BY created_at ASC"
-		rows, err := db.Query(query, postID)
+		// Comments are as visible as their post: deleted posts show none, and posts that are
+		// not published show them only to their author and moderators
+		visible, err := postVisible(db, postID, CurrentUser(r))
 		if err != nil {
-			log.Printf("Failed to retrieve comments: %v\n", err)
+			log.Printf("Failed to check post: %v\n", err)
 			http.Error(w, "Failed to retrieve comments", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
+		if !visible {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+
+		params := r.URL.Query()
+
+		// parent_id lists the replies to one comment instead of the post's top-level comments
+		var parentID int
+		if parentIDStr := params.Get("parent_id"); parentIDStr != "" {
+			parentID, err = strconv.Atoi(parentIDStr)
+			if err != nil {
+				http.Error(w, "Invalid parent_id", http.StatusBadRequest)
+				return
+			}
+		}
 
-		// Parse the results
-		var comments []Comment
-		for rows.Next() {
-			var comment Comment
-			if err := rows.Scan(&comment.ID, &comment.PostID, &comment.UserID, &comment.Content, &comment.CreatedAt); err != nil {
-				log.Printf("Failed to parse comment: %v\n", err)
-				http.Error(w, "Failed to retrieve comments", http.StatusInternalServerError)
+		// depth limits how many levels of replies are nested below each listed comment
+		depth := maxCommentDepth
+		if depthStr := params.Get("depth"); depthStr != "" {
+			depth, err = strconv.Atoi(depthStr)
+			if err != nil || depth < 0 {
+				http.Error(w, "Invalid depth", http.StatusBadRequest)
 				return
 			}
-			comments = append(comments, comment)
+			depth = min(depth, maxCommentDepth)
+		}
+
+		// replies limits how many replies are included per listed comment; the rest are collapsed
+		replies := defaultThreadReplies
+		if repliesStr := params.Get("replies"); repliesStr != "" {
+			replies, err = strconv.Atoi(repliesStr)
+			if err != nil || replies < 0 {
+				http.Error(w, "Invalid replies", http.StatusBadRequest)
+				return
+			}
+			replies = min(replies, maxPageSize)
+		}
+
+		page, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		threads, next, err := queryCommentThreads(db, postID, parentID, page, depth, replies)
+		if err != nil {
+			log.Printf("Failed to retrieve comments: %v\n", err)
+			http.Error(w, "Failed to retrieve comments", http.StatusInternalServerError)
+			return
 		}
 
-		// Return the comments as JSON
+		// Return the page of comment threads as JSON
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(comments)
+		json.NewEncoder(w).Encode(Page{Items: threads, NextCursor: next})
+	}
+}
+
+// queryCommentThreads fetches one page of comments directly below parentID (0 for the
+// post's top-level comments), oldest first, each with up to maxReplies of its replies
+// nested at most depth levels deep
+func queryCommentThreads(db *sql.DB, postID, parentID int, page pageParams, depth, maxReplies int) ([]*Comment, string, error) {
+	direction, reverse := pageOrder(page, false)
+	query := commentSelect + " WHERE comments.post_id = ?"
+	args := []interface{}{postID}
+	if parentID != 0 {
+		query += " AND comments.parent_id = ?"
+		args = append(args, parentID)
+	} else {
+		query += " AND comments.parent_id IS NULL"
+	}
+	if condition, conditionArgs := keysetCondition(page, "comments.created_at", "comments.id"); condition != "" {
+		query += " AND " + condition
+		args = append(args, conditionArgs...)
+	}
+	query += fmt.Sprintf(" ORDER BY comments.created_at %[1]s, comments.id %[1]s LIMIT ?", direction)
+	args = append(args, page.Limit+1)
+
+	roots, err := scanComments(db.Query(query, args...))
+	if err != nil {
+		return nil, "", err
+	}
+	roots, next := finishPage(roots, page, reverse, func(c *Comment) (time.Time, int) { return c.CreatedAt, c.ID })
+
+	if len(roots) > 0 && depth > 0 && maxReplies > 0 {
+		if err := attachReplies(db, roots, depth, maxReplies); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, root := range roots {
+		countCollapsed(root)
+	}
+	return roots, next, nil
+}
+
+// attachReplies loads the first maxReplies replies of every root, in thread order, with a
+// single query and nests them under their parents
+func attachReplies(db *sql.DB, roots []*Comment, depth, maxReplies int) error {
+	placeholders := make([]string, len(roots))
+	args := make([]interface{}, 0, len(roots)+2)
+	for i, root := range roots {
+		placeholders[i] = "?"
+		args = append(args, root.ID)
+	}
+	args = append(args, depth, maxReplies)
+
+	query := "SELECT " + commentColumns + `
+		FROM comments
+		LEFT JOIN users ON users.id = comments.user_id
+		JOIN (
+			SELECT reply.id, ROW_NUMBER() OVER (PARTITION BY root.id ORDER BY reply.path) AS position
+			FROM comments root
+			JOIN comments reply ON reply.post_id = root.post_id
+				AND reply.path > root.path || '/' AND reply.path < root.path || '0'
+			WHERE root.id IN (` + strings.Join(placeholders, ", ") + `)
+				AND reply.depth <= root.depth + ?
+		) thread ON thread.id = comments.id
+		WHERE thread.position <= ?
+		ORDER BY comments.path`
+
+	replies, err := scanComments(db.Query(query, args...))
+	if err != nil {
+		return err
+	}
+
+	// Thread order guarantees a parent is indexed before any of its replies
+	byID := make(map[int]*Comment, len(roots)+len(replies))
+	for _, root := range roots {
+		byID[root.ID] = root
+	}
+	for _, reply := range replies {
+		if reply.ParentID == nil {
+			continue
+		}
+		if parent, ok := byID[*reply.ParentID]; ok {
+			parent.Replies = append(parent.Replies, reply)
+			byID[reply.ID] = reply
+		}
+	}
+	return nil
+}
+
+// countCollapsed sets CollapsedCount on a comment and its included replies and returns
+// how many comments the subtree includes below the comment itself
+func countCollapsed(comment *Comment) int {
+	included := 0
+	for _, reply := range comment.Replies {
+		included += 1 + countCollapsed(reply)
+	}
+	comment.CollapsedCount = comment.descendants - included
+	return included
+}
+
+// scanComments reads every row of a query selecting commentColumns
+func scanComments(rows *sql.Rows, err error) ([]*Comment, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []*Comment{}
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
 	}
+	return comments, rows.Err()
 }
@@ -3,11 +3,13 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
 )
 
+// AddCommentReactionHandler toggles the current user's reaction on a comment and returns the updated counts
 func AddCommentReactionHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -16,7 +18,6 @@ func AddCommentReactionHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		var data struct {
-			UserID       int    `json:"user_id"`
 			CommentID    int    `json:"comment_id"`
 			ReactionType string `json:"reaction_type"` // "LIKE" or "DISLIKE"
 		}
@@ -26,7 +27,7 @@ func AddCommentReactionHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if data.UserID == 0 || data.CommentID == 0 || data.ReactionType == "" {
+		if data.CommentID == 0 || data.ReactionType == "" {
 			http.Error(w, "Missing required fields", http.StatusBadRequest)
 			return
 		}
@@ -36,26 +37,22 @@ func AddCommentReactionHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Remove existing reaction for the user on the same comment
-		deleteQuery := `DELETE FROM comment_reactions WHERE user_id = ? AND comment_id = ?`
-		_, err := db.Exec(deleteQuery, data.UserID, data.CommentID)
-		if err != nil {
-			log.Printf("Failed to remove existing reaction: %v\n", err)
-			http.Error(w, "Failed to process reaction", http.StatusInternalServerError)
+		user := CurrentUser(r)
+
+		result, err := toggleReaction(db, commentReactionTarget, user, data.CommentID, data.ReactionType)
+		if errors.Is(err, errReactionTargetNotFound) {
+			http.Error(w, "Comment not found", http.StatusNotFound)
 			return
 		}
-
-		// Insert the new reaction
-		insertQuery := `INSERT INTO comment_reactions (user_id, comment_id, reaction_type) VALUES (?, ?, ?)`
-		_, err = db.Exec(insertQuery, data.UserID, data.CommentID, data.ReactionType)
 		if err != nil {
-			log.Printf("Failed to add reaction: %v\n", err)
+			log.Printf("Failed to process reaction: %v\n", err)
 			http.Error(w, "Failed to process reaction", http.StatusInternalServerError)
 			return
 		}
+		result.CommentID = data.CommentID
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Reaction added successfully"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
 	}
 }
 
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"forum/config"
+	"forum/mailer"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Settings shared by the handlers, overridden at startup by Configure
+var (
+	sessionDuration   = 24 * time.Hour // how long a session stays valid after it was last used
+	sessionCookieName = "session_token"
+	cookieSecure      = false
+	cookieSameSite    = http.SameSiteLaxMode
+	bcryptCost        = bcrypt.DefaultCost
+	maxCommentDepth   = 5 // deepest reply level; replies below it attach to their parent's parent
+
+	preModeration      = false          // hold posts by untrusted users for review
+	trustAccountAge    = 72 * time.Hour // account age from which a user is trusted
+	trustApprovedPosts = 1              // approved posts from which a user is trusted
+
+	accountDeletion = "anonymize" // what happens to the content of deleted accounts: "anonymize" or "remove"
+
+	baseURL               = "http://localhost:8080" // public address of the forum, for links in emails
+	outbox  mailer.Mailer = &mailer.LogMailer{}     // delivers account emails
+)
+
+// defaultThreadReplies is how many replies are nested under each listed comment unless requested otherwise
+const defaultThreadReplies = 10
+
+// Configure applies the runtime configuration to the handlers
+func Configure(cfg *config.Config) {
+	sessionDuration = time.Duration(cfg.SessionLifetime)
+	sessionCookieName = cfg.CookieName
+	cookieSecure = cfg.CookieSecure
+	if sameSite, err := cfg.SameSite(); err == nil {
+		cookieSameSite = sameSite
+	}
+	bcryptCost = cfg.BcryptCost
+	maxCommentDepth = cfg.MaxCommentDepth
+	preModeration = cfg.PreModeration
+	trustAccountAge = time.Duration(cfg.TrustAccountAge)
+	trustApprovedPosts = cfg.TrustApprovedPosts
+	accountDeletion = cfg.AccountDeletion
+	baseURL = strings.TrimRight(cfg.BaseURL, "/")
+	outbox = mailer.New(cfg)
+}
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types streamed by EventsHandler
+const (
+	eventPost     = "post"     // a post was published; the data is the post
+	eventComment  = "comment"  // a comment was added; the data is the comment
+	eventReaction = "reaction" // the reaction counts of a post or comment changed
+	eventReset    = "reset"    // events were missed, so the client should reload what it shows
+)
+
+const (
+	eventHistory        = 256              // events kept for clients resuming after a reconnect
+	eventBuffer         = 64               // events queued for a slow client before it is disconnected
+	eventKeepAlive      = 25 * time.Second // interval of the comments keeping idle streams open
+	eventRetryMillisecs = 3000             // how soon browsers reconnect after losing the stream
+)
+
+// Event is something that happened on the forum, as streamed to browsers
+type Event struct {
+	ID          int64
+	Type        string
+	PostID      int   // post the event concerns
+	CategoryIDs []int // categories of that post
+	Data        interface{}
+}
+
+// eventFilter selects the events a subscriber receives; zero fields match everything
+type eventFilter struct {
+	PostID     int
+	CategoryID int
+}
+
+func (f eventFilter) matches(e Event) bool {
+	if e.Type == eventReset {
+		return true
+	}
+	if f.PostID != 0 && e.PostID != f.PostID {
+		return false
+	}
+	if f.CategoryID != 0 {
+		for _, id := range e.CategoryIDs {
+			if id == f.CategoryID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// eventSubscription is one stream's queue of events
+type eventSubscription struct {
+	filter eventFilter
+	events chan Event // closed when the subscriber fell too far behind
+}
+
+// eventHub fans out events published by the handlers to every subscribed stream. It keeps
+// the latest events so that clients reconnecting with the id of the last event they saw
+// miss nothing.
+type eventHub struct {
+	mu            sync.Mutex
+	lastID        int64
+	history       []Event
+	subscriptions map[*eventSubscription]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscriptions: map[*eventSubscription]struct{}{}}
+}
+
+// events is the hub the handlers publish to
+var events = newEventHub()
+
+// publish assigns the next id to e and delivers it to every matching subscriber. Subscribers
+// whose queue is full are dropped; their browser reconnects and resumes from the history.
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	e.ID = h.lastID
+	h.history = append(h.history, e)
+	if len(h.history) > eventHistory {
+		h.history = h.history[len(h.history)-eventHistory:]
+	}
+
+	for sub := range h.subscriptions {
+		if !sub.filter.matches(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			delete(h.subscriptions, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// subscribe registers a new subscriber and returns it with the events it missed since
+// lastID, or a reset event when they are no longer all known
+func (h *eventHub) subscribe(filter eventFilter, lastID int64) (*eventSubscription, []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &eventSubscription{filter: filter, events: make(chan Event, eventBuffer)}
+	h.subscriptions[sub] = struct{}{}
+
+	var missed []Event
+	if lastID == 0 || lastID == h.lastID {
+		return sub, missed
+	}
+	// Ids start over when the server restarts, and old events leave the history
+	if lastID > h.lastID || len(h.history) == 0 || h.history[0].ID > lastID+1 {
+		return sub, []Event{{ID: h.lastID, Type: eventReset}}
+	}
+	for _, e := range h.history {
+		if e.ID > lastID && filter.matches(e) {
+			missed = append(missed, e)
+		}
+	}
+	return sub, missed
+}
+
+func (h *eventHub) unsubscribe(sub *eventSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscriptions[sub]; ok {
+		delete(h.subscriptions, sub)
+		close(sub.events)
+	}
+}
+
+// postCategoryIDs returns the ids of the categories of a post
+func postCategoryIDs(db *sql.DB, postID int) ([]int, error) {
+	rows, err := db.Query("SELECT category_id FROM post_categories WHERE post_id = ?", postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// publishPost announces a newly published post. Failures are only logged, as the post
+// itself was stored.
+func publishPost(db *sql.DB, postID int) {
+	posts, _, err := queryPosts(db, postFilter{Status: postApproved, PostID: postID}, pageParams{Limit: 1}, 0)
+	if err != nil || len(posts) == 0 {
+		log.Printf("Failed to publish post %d: %v\n", postID, err)
+		return
+	}
+	post := posts[0]
+	categoryIDs := make([]int, len(post.Categories))
+	for i, category := range post.Categories {
+		categoryIDs[i] = category.ID
+	}
+	events.publish(Event{Type: eventPost, PostID: post.ID, CategoryIDs: categoryIDs, Data: post})
+}
+
+// publishComment announces a new comment
+func publishComment(db *sql.DB, comment *Comment) {
+	categoryIDs, err := postCategoryIDs(db, comment.PostID)
+	if err != nil {
+		log.Printf("Failed to publish comment %d: %v\n", comment.ID, err)
+		return
+	}
+	events.publish(Event{Type: eventComment, PostID: comment.PostID, CategoryIDs: categoryIDs, Data: comment})
+}
+
+// reactionCounts are the reaction counts of a post or comment, as streamed in reaction events
+type reactionCounts struct {
+	PostID    int `json:"post_id,omitempty"`
+	CommentID int `json:"comment_id,omitempty"`
+	Likes     int `json:"likes"`
+	Dislikes  int `json:"dislikes"`
+}
+
+// publishReaction announces the new reaction counts of a post, or of a comment on it
+func publishReaction(db *sql.DB, postID int, counts reactionCounts) {
+	categoryIDs, err := postCategoryIDs(db, postID)
+	if err != nil {
+		log.Printf("Failed to publish reaction on post %d: %v\n", postID, err)
+		return
+	}
+	events.publish(Event{Type: eventReaction, PostID: postID, CategoryIDs: categoryIDs, Data: counts})
+}
+
+// writeEvent writes e in the Server-Sent Events format
+func writeEvent(w http.ResponseWriter, e Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// EventsHandler streams new posts, comments and reaction counts as Server-Sent Events,
+// optionally only those concerning the post post_id or the posts of category (id or slug).
+// Clients reconnecting with Last-Event-ID first receive the events they missed.
+func EventsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var filter eventFilter
+		params := r.URL.Query()
+		if value := params.Get("post_id"); value != "" {
+			postID, err := strconv.Atoi(value)
+			if err != nil || postID <= 0 {
+				http.Error(w, "Invalid post_id", http.StatusBadRequest)
+				return
+			}
+			filter.PostID = postID
+		}
+		if ref := params.Get("category"); ref != "" {
+			categoryID, err := findCategoryID(db, ref)
+			if errors.Is(err, errUnknownCategory) {
+				http.Error(w, "Category not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to resolve category: %v\n", err)
+				http.Error(w, "Failed to subscribe to events", http.StatusInternalServerError)
+				return
+			}
+			filter.CategoryID = categoryID
+		}
+		lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		sub, missed := events.subscribe(filter, lastID)
+		defer events.unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // keep reverse proxies from buffering the stream
+		fmt.Fprintf(w, "retry: %d\n\n", eventRetryMillisecs)
+		for _, e := range missed {
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e, open := <-sub.events:
+				if !open {
+					return
+				}
+				if err := writeEvent(w, e); err != nil {
+					log.Printf("Failed to stream event: %v\n", err)
+					return
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
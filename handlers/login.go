@@ -45,8 +45,10 @@ func LoginHandler(db *sql.DB) http.HandlerFunc {
 		// Query the database for the user
 		var userID int
 		var hashedPassword, username string
-		query := "SELECT id, password, username FROM users WHERE email = ?"
-		err = db.QueryRow(query, req.Email).Scan(&userID, &hashedPassword, &username)
+		var role Role
+		var verified bool
+		query := "SELECT id, password, username, role, email_verified_at IS NOT NULL FROM users WHERE email = ?"
+		err = db.QueryRow(query, req.Email).Scan(&userID, &hashedPassword, &username, &role, &verified)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				http.Error(w, "Invalid email or password", http.StatusUnauthorized)
@@ -64,13 +66,39 @@ func LoginHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Banned and suspended accounts cannot start new sessions; they are told why and until when
+		sanction, err := activeSanction(db, userID, sanctionBan, sanctionSuspend)
+		if err != nil {
+			log.Println("Failed to check sanctions:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if sanction != nil {
+			message := "This account has been banned"
+			if sanction.Kind == sanctionSuspend {
+				message = "This account has been suspended"
+			}
+			writeSanctionError(w, message, sanction)
+			return
+		}
+
+		// Muted accounts can log in, but learn that they cannot post
+		mute, err := activeSanction(db, userID, sanctionMute)
+		if err != nil {
+			log.Println("Failed to check sanctions:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 		// Generate a session token
 		sessionToken := uuid.New().String()
-		expiresAt := time.Now().Add(24 * time.Hour)
+		expiresAt := time.Now().Add(sessionDuration)
 
 		// Insert session into the database
-		_, err = db.Exec("INSERT INTO sessions (uuid, user_id, expires_at) VALUES (?, ?, ?)",
-			sessionToken, userID, expiresAt)
+		now := time.Now()
+		_, err = db.Exec(`INSERT INTO sessions (uuid, user_id, expires_at, created_at, last_seen_at, user_agent, ip_address)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			sessionToken, userID, expiresAt, now, now, r.UserAgent(), clientIP(r))
 		if err != nil {
 			log.Println("Failed to store session:", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -78,20 +106,22 @@ func LoginHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Set the session token as a cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_token",
-			Value:    sessionToken,
-			Expires:  expiresAt,
-			HttpOnly: true, // Prevent JavaScript access for security
-		})
-
-		// Respond with a success message and the username
+		setSessionCookie(w, sessionToken, expiresAt)
+
+		// Respond with a success message, the username, the user's role, whether their email
+		// address is confirmed and any mute
 		response := struct {
-			Message  string `json:"message"`
-			Username string `json:"username"`
+			Message  string    `json:"message"`
+			Username string    `json:"username"`
+			Role     Role      `json:"role"`
+			Verified bool      `json:"email_verified"`
+			Mute     *Sanction `json:"mute,omitempty"`
 		}{
 			Message:  "Login successful",
 			Username: username,
+			Role:     role,
+			Verified: verified,
+			Mute:     mute,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -104,7 +134,7 @@ func LoginHandler(db *sql.DB) http.HandlerFunc {
 func LogoutHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the session token from the cookie
-		cookie, err := r.Cookie("session_token")
+		cookie, err := r.Cookie(sessionCookieName)
 		if err != nil {
 			http.Error(w, "Session not found", http.StatusUnauthorized)
 			return
@@ -118,12 +148,7 @@ func LogoutHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Remove the session cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_token",
-			Value:    "",
-			Expires:  time.Unix(0, 0), // Expire the cookie
-			HttpOnly: true,
-		})
+		clearSessionCookie(w)
 
 		// Respond with a success message
 		response := struct {
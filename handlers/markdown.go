@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"forum/markdown"
+)
+
+// renderBatchSize is how many posts or comments RenderMissingContent renders per transaction
+const renderBatchSize = 100
+
+// renderMarkdown renders the Markdown of a post or comment to sanitized HTML, linking the
+// mentions of the given users to their profiles
+func renderMarkdown(content string, mentions []string) string {
+	mentioned := make(map[string]bool, len(mentions))
+	for _, username := range mentions {
+		mentioned[username] = true
+	}
+	return markdown.Render(content, markdown.Options{MentionURL: func(username string) string {
+		if !mentioned[username] {
+			return ""
+		}
+		return profileURL(username)
+	}})
+}
+
+// storedMentions returns the usernames of the existing users a post (commentID 0) or
+// comment mentions, as recorded by storeMentions
+func storedMentions(tx *sql.Tx, postID, commentID int) ([]string, error) {
+	rows, err := tx.Query(`SELECT users.username FROM mentions
+		JOIN users ON users.id = mentions.user_id
+		WHERE mentions.post_id = ? AND COALESCE(mentions.comment_id, 0) = ? AND users.deleted_at IS NULL`, postID, commentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// cacheContentHTML renders the content of a post (commentID 0) or comment and stores the HTML
+// next to it. Its mentions must already be stored.
+func cacheContentHTML(tx *sql.Tx, postID, commentID int, content string) error {
+	mentions, err := storedMentions(tx, postID, commentID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch mentions: %v", err)
+	}
+	table, id := "posts", postID
+	if commentID != 0 {
+		table, id = "comments", commentID
+	}
+	_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET content_html = ? WHERE id = ?", table), renderMarkdown(content, mentions), id)
+	if err != nil {
+		return fmt.Errorf("failed to store rendered %s: %v", table, err)
+	}
+	return nil
+}
+
+// RenderMissingContent renders and caches the HTML of the posts and comments that have none,
+// such as those written before Markdown was supported
+func RenderMissingContent(db *sql.DB) error {
+	for _, table := range []string{"posts", "comments"} {
+		total := 0
+		for {
+			rendered, err := renderMissingBatch(db, table)
+			if err != nil {
+				return err
+			}
+			if rendered == 0 {
+				break
+			}
+			total += rendered
+		}
+		if total > 0 {
+			log.Printf("Rendered the content of %d %s", total, table)
+		}
+	}
+	return nil
+}
+
+// renderMissingBatch renders up to renderBatchSize rows of table without cached HTML and
+// returns how many it rendered
+func renderMissingBatch(db *sql.DB, table string) (int, error) {
+	postColumn := "id"
+	if table == "comments" {
+		postColumn = "post_id"
+	}
+	rows, err := db.Query(fmt.Sprintf("SELECT id, %s, content FROM %s WHERE content_html IS NULL ORDER BY id LIMIT ?", postColumn, table),
+		renderBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch %s to render: %v", table, err)
+	}
+	type source struct {
+		id, postID int
+		content    string
+	}
+	var sources []source
+	for rows.Next() {
+		var s source
+		if err := rows.Scan(&s.id, &s.postID, &s.content); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sources = append(sources, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, s := range sources {
+		commentID := 0
+		if table == "comments" {
+			commentID = s.id
+		}
+		if err := cacheContentHTML(tx, s.postID, commentID, s.content); err != nil {
+			return 0, err
+		}
+	}
+	return len(sources), tx.Commit()
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxMentions            = 10 // users a single post or comment can mention, and so notify
+	maxUsernameSuggestions = 10
+)
+
+// mentionPattern matches @username. The @ must not follow a letter or digit, so email
+// addresses are not mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([\w.-]+)`)
+
+// usernamePrefixPattern matches what can follow the @ of a mention being typed
+var usernamePrefixPattern = regexp.MustCompile(`^[\w.-]*$`)
+
+// likeEscaper escapes the wildcards of a LIKE pattern, for use with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// mentionedUsernames returns the distinct usernames mentioned in text in order of appearance
+func mentionedUsernames(text string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		// Punctuation ending a sentence is not part of the name
+		name := strings.TrimRight(match[1], ".-")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// storeMentions replaces the mention records of a post (commentID 0) or comment with the
+// existing users mentioned in text, at most maxMentions of them, and returns the ids of
+// those who were not mentioned there before
+func storeMentions(tx *sql.Tx, postID, commentID int, text string) ([]int, error) {
+	previous := map[int]bool{}
+	rows, err := tx.Query("SELECT user_id FROM mentions WHERE post_id = ? AND COALESCE(comment_id, 0) = ?", postID, commentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch mentions: %v", err)
+	}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		previous[userID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM mentions WHERE post_id = ? AND COALESCE(comment_id, 0) = ?", postID, commentID); err != nil {
+		return nil, fmt.Errorf("failed to remove mentions: %v", err)
+	}
+
+	var added []int
+	stored := 0
+	for _, name := range mentionedUsernames(text) {
+		var userID int
+		err := tx.QueryRow("SELECT id FROM users WHERE username = ? AND deleted_at IS NULL", name).Scan(&userID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec("INSERT INTO mentions (user_id, post_id, comment_id) VALUES (?, ?, NULLIF(?, 0))", userID, postID, commentID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store mention: %v", err)
+		}
+		if !previous[userID] {
+			added = append(added, userID)
+		}
+		if stored++; stored == maxMentions {
+			break
+		}
+	}
+	return added, nil
+}
+
+// postMentions returns the ids of the users mentioned in a post itself
+func postMentions(tx *sql.Tx, postID int) ([]int, error) {
+	rows, err := tx.Query("SELECT user_id FROM mentions WHERE post_id = ? AND comment_id IS NULL ORDER BY id", postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// notifyMentions notifies the given mentioned users of n
+func (nt *notifier) notifyMentions(userIDs []int, n Notification) error {
+	for _, userID := range userIDs {
+		if err := nt.notify(userID, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyEditMentions notifies the users newly mentioned by an edit of a published post or
+// comment. The edit itself is already stored, so failures are only logged.
+func notifyEditMentions(db *sql.DB, editor *SessionUser, userIDs []int, n Notification) {
+	if len(userIDs) == 0 {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Failed to notify mentioned users: %v\n", err)
+		return
+	}
+	defer tx.Rollback()
+
+	notifications := newNotifier(tx, editor.ID, editor.Username)
+	if err := notifications.notifyMentions(userIDs, n); err != nil {
+		log.Printf("Failed to notify mentioned users: %v\n", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to notify mentioned users: %v\n", err)
+		return
+	}
+	notifications.sendEmails()
+}
+
+// UsernameSuggestion is a user suggested while typing a mention
+type UsernameSuggestion struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+// SearchUsernamesHandler suggests the users whose username starts with prefix, ignoring
+// case, for completing mentions
+func SearchUsernamesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		prefix := strings.TrimPrefix(r.URL.Query().Get("prefix"), "@")
+		if !usernamePrefixPattern.MatchString(prefix) {
+			http.Error(w, "Invalid prefix", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := db.Query(`SELECT username, display_name FROM users
+			WHERE username LIKE ? ESCAPE '\' AND deleted_at IS NULL
+			ORDER BY username = ? DESC, username COLLATE NOCASE, username
+			LIMIT ?`, likeEscaper.Replace(prefix)+"%", prefix, maxUsernameSuggestions)
+		if err != nil {
+			log.Printf("Failed to search usernames: %v\n", err)
+			http.Error(w, "Failed to search usernames", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		suggestions := []UsernameSuggestion{}
+		for rows.Next() {
+			var s UsernameSuggestion
+			if err := rows.Scan(&s.Username, &s.DisplayName); err != nil {
+				log.Printf("Failed to scan username row: %v\n", err)
+				http.Error(w, "Failed to search usernames", http.StatusInternalServerError)
+				return
+			}
+			s.AvatarURL = avatarURL(s.Username)
+			suggestions = append(suggestions, s)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to search usernames: %v\n", err)
+			http.Error(w, "Failed to search usernames", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(suggestions)
+	}
+}
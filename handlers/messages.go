@@ -0,0 +1,437 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxMessageLength = 2000 // characters
+
+var (
+	errConversationNotFound = errors.New("conversation not found")
+	errRecipientNotFound    = errors.New("recipient not found")
+	errMessageToSelf        = errors.New("cannot message yourself")
+	errEmptyMessage         = errors.New("message is empty")
+	errMessageTooLong       = fmt.Errorf("message is longer than %d characters", maxMessageLength)
+)
+
+// Message is a private message in a conversation between two users
+type Message struct {
+	ID             int        `json:"id"`
+	ConversationID int        `json:"conversation_id"`
+	Sender         string     `json:"sender"`
+	Content        string     `json:"content"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ReadAt         *time.Time `json:"read_at"` // when the recipient read the message
+}
+
+// Conversation is a user's private conversation with another user
+type Conversation struct {
+	ID            int       `json:"id"`
+	With          Presence  `json:"with"` // the other participant
+	LastMessage   Message   `json:"last_message"`
+	LastMessageAt time.Time `json:"last_message_at"`
+	UnreadCount   int       `json:"unread_count"` // messages the user has not read yet
+}
+
+// ReadReceipt tells the participants of a conversation that one of them read its messages
+// up to MessageID
+type ReadReceipt struct {
+	ConversationID int       `json:"conversation_id"`
+	Reader         string    `json:"reader"`
+	MessageID      int       `json:"message_id"`
+	ReadAt         time.Time `json:"read_at"`
+}
+
+// messageRequest is a message to send, addressed either to an existing conversation or to a
+// user by username
+type messageRequest struct {
+	ConversationID int    `json:"conversation_id"`
+	To             string `json:"to"`
+	Content        string `json:"content"`
+}
+
+// conversationPartner returns the other participant of a conversation of userID
+func conversationPartner(q queryRower, conversationID, userID int) (int, error) {
+	var partnerID int
+	err := q.QueryRow(`SELECT CASE WHEN user1_id = ? THEN user2_id ELSE user1_id END
+		FROM conversations WHERE id = ? AND ? IN (user1_id, user2_id)`, userID, conversationID, userID).Scan(&partnerID)
+	if err == sql.ErrNoRows {
+		return 0, errConversationNotFound
+	}
+	return partnerID, err
+}
+
+// conversationPartners returns the ids of everyone userID has a conversation with
+func conversationPartners(db *sql.DB, userID int) ([]int, error) {
+	rows, err := db.Query(`SELECT CASE WHEN user1_id = ? THEN user2_id ELSE user1_id END
+		FROM conversations WHERE ? IN (user1_id, user2_id)`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// sendMessage stores a message from sender, starting a conversation with the recipient
+// unless they already have one, and returns it with the id of its recipient
+func sendMessage(db *sql.DB, sender *SessionUser, req messageRequest) (*Message, int, error) {
+	content := strings.TrimSpace(req.Content)
+	if content == "" {
+		return nil, 0, errEmptyMessage
+	}
+	if !utf8.ValidString(content) || utf8.RuneCountInString(content) > maxMessageLength {
+		return nil, 0, errMessageTooLong
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var recipientID int
+	if req.ConversationID != 0 {
+		if recipientID, err = conversationPartner(tx, req.ConversationID, sender.ID); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		err = tx.QueryRow("SELECT id FROM users WHERE username = ? AND deleted_at IS NULL", strings.TrimSpace(req.To)).Scan(&recipientID)
+		if err == sql.ErrNoRows {
+			return nil, 0, errRecipientNotFound
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if recipientID == sender.ID {
+		return nil, 0, errMessageToSelf
+	}
+	var deleted bool
+	if err := tx.QueryRow("SELECT deleted_at IS NOT NULL FROM users WHERE id = ?", recipientID).Scan(&deleted); err != nil {
+		return nil, 0, err
+	}
+	if deleted {
+		return nil, 0, errRecipientNotFound
+	}
+
+	conversationID := req.ConversationID
+	if conversationID == 0 {
+		user1, user2 := min(sender.ID, recipientID), max(sender.ID, recipientID)
+		_, err := tx.Exec("INSERT INTO conversations (user1_id, user2_id) VALUES (?, ?) ON CONFLICT (user1_id, user2_id) DO NOTHING", user1, user2)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to start conversation: %v", err)
+		}
+		err = tx.QueryRow("SELECT id FROM conversations WHERE user1_id = ? AND user2_id = ?", user1, user2).Scan(&conversationID)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to fetch conversation: %v", err)
+		}
+	}
+
+	msg := Message{ConversationID: conversationID, Sender: sender.Username, Content: content}
+	err = tx.QueryRow("INSERT INTO messages (conversation_id, sender_id, content) VALUES (?, ?, ?) RETURNING id, created_at",
+		conversationID, sender.ID, content).Scan(&msg.ID, &msg.CreatedAt)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to store message: %v", err)
+	}
+	_, err = tx.Exec("UPDATE conversations SET last_message_at = (SELECT created_at FROM messages WHERE id = ?) WHERE id = ?", msg.ID, conversationID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to update conversation: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	return &msg, recipientID, nil
+}
+
+// markConversationRead marks the messages user received in a conversation as read, up to
+// and including upTo or all of them when it is zero. It returns the receipt to deliver to
+// the conversation's participants and their ids, or a nil receipt when there was nothing to mark.
+func markConversationRead(db *sql.DB, user *SessionUser, conversationID, upTo int) (*ReadReceipt, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	partnerID, err := conversationPartner(tx, conversationID, user.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	receipt := ReadReceipt{ConversationID: conversationID, Reader: user.Username, ReadAt: time.Now().UTC()}
+	err = tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM messages
+		WHERE conversation_id = ? AND sender_id != ? AND read_at IS NULL AND (? = 0 OR id <= ?)`,
+		conversationID, user.ID, upTo, upTo).Scan(&receipt.MessageID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if receipt.MessageID == 0 {
+		return nil, partnerID, nil
+	}
+
+	_, err = tx.Exec(`UPDATE messages SET read_at = ?
+		WHERE conversation_id = ? AND sender_id != ? AND read_at IS NULL AND id <= ?`,
+		receipt.ReadAt, conversationID, user.ID, receipt.MessageID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to mark messages read: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	return &receipt, partnerID, nil
+}
+
+// writeMessageError maps the errors of sendMessage and markConversationRead to HTTP responses
+func writeMessageError(w http.ResponseWriter, err error, failure string) {
+	switch {
+	case errors.Is(err, errConversationNotFound):
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+	case errors.Is(err, errRecipientNotFound):
+		http.Error(w, "Recipient not found", http.StatusNotFound)
+	case errors.Is(err, errMessageToSelf), errors.Is(err, errEmptyMessage), errors.Is(err, errMessageTooLong):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("%s: %v\n", failure, err)
+		http.Error(w, failure, http.StatusInternalServerError)
+	}
+}
+
+// ListConversationsHandler lists the current user's conversations, most recently active first
+func ListConversationsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		page, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		userID := CurrentUser(r).ID
+		query := `
+			SELECT c.id, c.last_message_at, other.id, other.username,
+				m.id, sender.username, m.content, m.created_at, m.read_at,
+				(SELECT COUNT(*) FROM messages WHERE conversation_id = c.id AND sender_id != ? AND read_at IS NULL)
+			FROM conversations c
+			JOIN users other ON other.id = CASE WHEN c.user1_id = ? THEN c.user2_id ELSE c.user1_id END
+			JOIN messages m ON m.id = (SELECT id FROM messages WHERE conversation_id = c.id ORDER BY created_at DESC, id DESC LIMIT 1)
+			JOIN users sender ON sender.id = m.sender_id
+			WHERE ? IN (c.user1_id, c.user2_id)`
+		args := []interface{}{userID, userID, userID}
+		if condition, conditionArgs := keysetCondition(page, "c.last_message_at", "c.id"); condition != "" {
+			query += " AND " + condition
+			args = append(args, conditionArgs...)
+		}
+		direction, reverse := pageOrder(page, true)
+		query += fmt.Sprintf(" ORDER BY c.last_message_at %[1]s, c.id %[1]s LIMIT ?", direction)
+		args = append(args, page.Limit+1)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			log.Printf("Failed to fetch conversations: %v\n", err)
+			http.Error(w, "Failed to fetch conversations", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		conversations := []Conversation{}
+		partnerIDs := []int{}
+		for rows.Next() {
+			var c Conversation
+			var partnerID int
+			err := rows.Scan(&c.ID, &c.LastMessageAt, &partnerID, &c.With.Username,
+				&c.LastMessage.ID, &c.LastMessage.Sender, &c.LastMessage.Content, &c.LastMessage.CreatedAt, &c.LastMessage.ReadAt,
+				&c.UnreadCount)
+			if err != nil {
+				log.Printf("Failed to scan conversation row: %v\n", err)
+				http.Error(w, "Failed to fetch conversations", http.StatusInternalServerError)
+				return
+			}
+			c.LastMessage.ConversationID = c.ID
+			conversations = append(conversations, c)
+			partnerIDs = append(partnerIDs, partnerID)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to fetch conversations: %v\n", err)
+			http.Error(w, "Failed to fetch conversations", http.StatusInternalServerError)
+			return
+		}
+
+		presences, err := userPresences(db, partnerIDs)
+		if err != nil {
+			log.Printf("Failed to fetch presence: %v\n", err)
+			http.Error(w, "Failed to fetch conversations", http.StatusInternalServerError)
+			return
+		}
+		for i := range conversations {
+			presence := presences[partnerIDs[i]]
+			presence.Username = conversations[i].With.Username
+			conversations[i].With = presence
+		}
+
+		conversations, next := finishPage(conversations, page, reverse, func(c Conversation) (time.Time, int) { return c.LastMessageAt, c.ID })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Page{Items: conversations, NextCursor: next})
+	}
+}
+
+// ListMessagesHandler returns the messages of one of the current user's conversations,
+// newest first
+func ListMessagesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		conversationID, err := strconv.Atoi(r.URL.Query().Get("conversation_id"))
+		if err != nil || conversationID <= 0 {
+			http.Error(w, "Invalid conversation_id", http.StatusBadRequest)
+			return
+		}
+		page, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := conversationPartner(db, conversationID, CurrentUser(r).ID); err != nil {
+			writeMessageError(w, err, "Failed to fetch messages")
+			return
+		}
+
+		query := `
+			SELECT m.id, m.conversation_id, u.username, m.content, m.created_at, m.read_at
+			FROM messages m
+			JOIN users u ON u.id = m.sender_id
+			WHERE m.conversation_id = ?`
+		args := []interface{}{conversationID}
+		if condition, conditionArgs := keysetCondition(page, "m.created_at", "m.id"); condition != "" {
+			query += " AND " + condition
+			args = append(args, conditionArgs...)
+		}
+		direction, reverse := pageOrder(page, true)
+		query += fmt.Sprintf(" ORDER BY m.created_at %[1]s, m.id %[1]s LIMIT ?", direction)
+		args = append(args, page.Limit+1)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			log.Printf("Failed to fetch messages: %v\n", err)
+			http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		messages := []Message{}
+		for rows.Next() {
+			var m Message
+			if err := rows.Scan(&m.ID, &m.ConversationID, &m.Sender, &m.Content, &m.CreatedAt, &m.ReadAt); err != nil {
+				log.Printf("Failed to scan message row: %v\n", err)
+				http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+				return
+			}
+			messages = append(messages, m)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to fetch messages: %v\n", err)
+			http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+			return
+		}
+
+		messages, next := finishPage(messages, page, reverse, func(m Message) (time.Time, int) { return m.CreatedAt, m.ID })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Page{Items: messages, NextCursor: next})
+	}
+}
+
+// SendMessageHandler sends a message to a conversation or, starting one if needed, to a
+// user, and delivers it to both participants' open message sockets
+func SendMessageHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req messageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.ConversationID == 0 && strings.TrimSpace(req.To) == "" {
+			http.Error(w, "Missing conversation_id or to", http.StatusBadRequest)
+			return
+		}
+
+		user := CurrentUser(r)
+		msg, recipientID, err := sendMessage(db, user, req)
+		if err != nil {
+			writeMessageError(w, err, "Failed to send message")
+			return
+		}
+		messenger.deliver(socketEvent{Type: socketMessage, Data: msg}, user.ID, recipientID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(msg)
+	}
+}
+
+// MarkMessagesReadHandler marks the messages the current user received in a conversation as
+// read, up to message_id or all of them, and sends the read receipt to both participants
+func MarkMessagesReadHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ConversationID int `json:"conversation_id"`
+			MessageID      int `json:"message_id"` // optional last message read
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		user := CurrentUser(r)
+		receipt, partnerID, err := markConversationRead(db, user, req.ConversationID, req.MessageID)
+		if err != nil {
+			writeMessageError(w, err, "Failed to mark messages read")
+			return
+		}
+		if receipt != nil {
+			messenger.deliver(socketEvent{Type: socketRead, Data: receipt}, user.ID, partnerID)
+		}
+
+		// The receipt is null when there was nothing left to mark
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "Messages marked read", "receipt": receipt})
+	}
+}
@@ -0,0 +1,368 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"forum/websocket"
+)
+
+// Types of the events exchanged over message sockets. Clients send message, typing and read
+// requests; the server sends events of every type.
+const (
+	socketMessage  = "message"  // a message was sent; the data is the message
+	socketTyping   = "typing"   // a participant started or stopped typing; the data is a TypingIndicator
+	socketRead     = "read"     // messages were read; the data is the read receipt
+	socketPresence = "presence" // a conversation partner came online or went offline; the data is their Presence
+	socketError    = "error"    // a request sent over the socket failed; the data describes why
+)
+
+const (
+	socketPingInterval = 30 * time.Second // also how often the session behind a socket is checked
+	socketReadTimeout  = 75 * time.Second // sockets not even answering pings for this long are dropped
+	socketWriteTimeout = 10 * time.Second
+	socketSendBuffer   = 32       // events queued for a slow client before it is disconnected
+	maxSocketRequest   = 16 << 10 // bytes
+)
+
+// socketEvent is the envelope of everything sent over a message socket
+type socketEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// socketRequest is a request sent by a client over its message socket
+type socketRequest struct {
+	Type string `json:"type"` // "message", "typing" or "read"
+	messageRequest
+	Typing    bool `json:"typing"`     // for typing requests
+	MessageID int  `json:"message_id"` // for read requests, the last message read
+}
+
+// TypingIndicator tells a participant whether the other one is typing a message
+type TypingIndicator struct {
+	ConversationID int    `json:"conversation_id"`
+	User           string `json:"user"`
+	Typing         bool   `json:"typing"`
+}
+
+// Presence is whether a user is online, meaning they have a message socket open on an active
+// session, and when any of their active sessions was last used
+type Presence struct {
+	Username   string     `json:"username"`
+	Online     bool       `json:"online"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
+
+// socketClient is one open message socket
+type socketClient struct {
+	conn *websocket.Conn
+	user atomic.Pointer[SessionUser] // refreshed whenever the session is checked
+	send chan []byte
+	done chan struct{} // closed once the socket is gone
+}
+
+// messageHub keeps track of the open message sockets of every user
+type messageHub struct {
+	mu      sync.Mutex
+	clients map[int]map[*socketClient]struct{}
+}
+
+func newMessageHub() *messageHub {
+	return &messageHub{clients: map[int]map[*socketClient]struct{}{}}
+}
+
+// messenger is the hub messages, typing indicators, read receipts and presence go through
+var messenger = newMessageHub()
+
+// add registers a socket and reports whether it is the user's first
+func (h *messageHub) add(userID int, c *socketClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[userID] == nil {
+		h.clients[userID] = map[*socketClient]struct{}{}
+	}
+	h.clients[userID][c] = struct{}{}
+	return len(h.clients[userID]) == 1
+}
+
+// remove unregisters a socket and reports whether it was the user's last
+func (h *messageHub) remove(userID int, c *socketClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[userID][c]; !ok {
+		return false
+	}
+	delete(h.clients[userID], c)
+	if len(h.clients[userID]) > 0 {
+		return false
+	}
+	delete(h.clients, userID)
+	return true
+}
+
+func (h *messageHub) online(userID int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients[userID]) > 0
+}
+
+// deliver sends an event to every open socket of the given users. Sockets whose queue is
+// full are disconnected; their page reconnects and reloads what it shows.
+func (h *messageHub) deliver(event socketEvent, userIDs ...int) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", event.Type, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delivered := map[int]bool{}
+	for _, userID := range userIDs {
+		if delivered[userID] {
+			continue
+		}
+		delivered[userID] = true
+		for c := range h.clients[userID] {
+			select {
+			case c.send <- data:
+			default:
+				c.conn.Close()
+			}
+		}
+	}
+}
+
+// touchSession records that a session is in use
+func touchSession(db *sql.DB, sessionID string) {
+	if _, err := db.Exec("UPDATE sessions SET last_seen_at = ? WHERE uuid = ?", time.Now(), sessionID); err != nil {
+		log.Printf("Failed to update session activity: %v\n", err)
+	}
+}
+
+// userPresences returns the presence of the given users, without their usernames
+func userPresences(db *sql.DB, userIDs []int) (map[int]Presence, error) {
+	presences := make(map[int]Presence, len(userIDs))
+	if len(userIDs) == 0 {
+		return presences, nil
+	}
+
+	placeholders := make([]string, len(userIDs))
+	args := []interface{}{time.Now()}
+	for i, id := range userIDs {
+		placeholders[i] = "?"
+		args = append(args, id)
+		presences[id] = Presence{Online: messenger.online(id)}
+	}
+	rows, err := db.Query(`SELECT user_id, last_seen_at FROM sessions
+		WHERE expires_at > ? AND last_seen_at IS NOT NULL AND user_id IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		var lastSeen time.Time
+		if err := rows.Scan(&userID, &lastSeen); err != nil {
+			return nil, err
+		}
+		presence := presences[userID]
+		if presence.LastSeenAt == nil || lastSeen.After(*presence.LastSeenAt) {
+			presence.LastSeenAt = &lastSeen
+		}
+		presences[userID] = presence
+	}
+	return presences, rows.Err()
+}
+
+// announcePresence tells everyone user has a conversation with whether they are online
+func announcePresence(db *sql.DB, user *SessionUser) {
+	partners, err := conversationPartners(db, user.ID)
+	if err != nil {
+		log.Printf("Failed to fetch conversation partners: %v\n", err)
+		return
+	}
+	presences, err := userPresences(db, []int{user.ID})
+	if err != nil {
+		log.Printf("Failed to fetch presence: %v\n", err)
+		return
+	}
+	presence := presences[user.ID]
+	presence.Username = user.Username
+	messenger.deliver(socketEvent{Type: socketPresence, Data: presence}, partners...)
+}
+
+// MessagesSocketHandler upgrades the request to a WebSocket over which the current user
+// sends and receives messages, typing indicators and read receipts in real time, and
+// learns when conversation partners come online or go offline. The socket is closed once
+// its session ends.
+func MessagesSocketHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := CurrentUser(r)
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			log.Printf("Failed to open message socket: %v\n", err)
+			return
+		}
+		conn.MaxMessageSize = maxSocketRequest
+		conn.ReadTimeout = socketReadTimeout
+		conn.WriteTimeout = socketWriteTimeout
+
+		c := &socketClient{conn: conn, send: make(chan []byte, socketSendBuffer), done: make(chan struct{})}
+		c.user.Store(user)
+		touchSession(db, user.SessionID)
+		if messenger.add(user.ID, c) {
+			announcePresence(db, user)
+		}
+		go c.writeLoop(db, r)
+
+		defer func() {
+			close(c.done)
+			conn.Close()
+			touchSession(db, user.SessionID)
+			if messenger.remove(user.ID, c) {
+				announcePresence(db, user)
+			}
+		}()
+
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if !errors.As(err, &closeErr) && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					log.Printf("Failed to read from message socket: %v\n", err)
+				}
+				return
+			}
+			if messageType != websocket.TextMessage {
+				conn.WriteClose(websocket.CloseUnsupportedData, "expected JSON text messages")
+				return
+			}
+
+			var req socketRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				c.reply(socketEvent{Type: socketError, Data: "Invalid request payload"})
+				continue
+			}
+			c.handle(db, req)
+		}
+	}
+}
+
+// writeLoop writes the events queued for the socket and keeps it alive, for as long as its
+// session stays valid
+func (c *socketClient) writeLoop(db *sql.DB, r *http.Request) {
+	ticker := time.NewTicker(socketPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.send:
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			user, err := userFromSession(db, r)
+			if err != nil {
+				log.Println("Session lookup failed:", err)
+			} else if user == nil {
+				// Logged out, expired, revoked or locked out
+				c.conn.WriteClose(websocket.ClosePolicyViolation, "session ended")
+				c.conn.Close()
+				return
+			} else {
+				c.user.Store(user)
+				touchSession(db, user.SessionID)
+			}
+			if err := c.conn.WritePing(); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// reply queues an event for this socket only
+func (c *socketClient) reply(event socketEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", event.Type, err)
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		c.conn.Close()
+	}
+}
+
+// handle carries out a request sent over the socket
+func (c *socketClient) handle(db *sql.DB, req socketRequest) {
+	user := c.user.Load()
+	switch req.Type {
+	case socketMessage:
+		// The same rules as for posting apply
+		if !user.Verified {
+			c.reply(socketEvent{Type: socketError, Data: "Forbidden: confirm your email address before posting"})
+			return
+		}
+		if user.Muted {
+			c.reply(socketEvent{Type: socketError, Data: "Forbidden: your account is muted"})
+			return
+		}
+		msg, recipientID, err := sendMessage(db, user, req.messageRequest)
+		if err != nil {
+			c.replyError(err, "Failed to send message")
+			return
+		}
+		messenger.deliver(socketEvent{Type: socketMessage, Data: msg}, user.ID, recipientID)
+
+	case socketTyping:
+		partnerID, err := conversationPartner(db, req.ConversationID, user.ID)
+		if err != nil {
+			c.replyError(err, "Failed to send typing indicator")
+			return
+		}
+		indicator := TypingIndicator{ConversationID: req.ConversationID, User: user.Username, Typing: req.Typing}
+		messenger.deliver(socketEvent{Type: socketTyping, Data: indicator}, partnerID)
+
+	case socketRead:
+		receipt, partnerID, err := markConversationRead(db, user, req.ConversationID, req.MessageID)
+		if err != nil {
+			c.replyError(err, "Failed to mark messages read")
+			return
+		}
+		if receipt != nil {
+			messenger.deliver(socketEvent{Type: socketRead, Data: receipt}, user.ID, partnerID)
+		}
+
+	default:
+		c.reply(socketEvent{Type: socketError, Data: "Unknown request type"})
+	}
+}
+
+// replyError tells the client why its request failed, hiding unexpected errors behind failure
+func (c *socketClient) replyError(err error, failure string) {
+	switch {
+	case errors.Is(err, errConversationNotFound), errors.Is(err, errRecipientNotFound), errors.Is(err, errMessageToSelf),
+		errors.Is(err, errEmptyMessage), errors.Is(err, errMessageTooLong):
+		c.reply(socketEvent{Type: socketError, Data: err.Error()})
+	default:
+		log.Printf("%s: %v\n", failure, err)
+		c.reply(socketEvent{Type: socketError, Data: failure})
+	}
+}
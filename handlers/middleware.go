@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// SessionUser represents the authenticated user behind a session cookie
+type SessionUser struct {
+	ID        int
+	Username  string
+	Email     string
+	Role      Role
+	Muted     bool // muted users can read but not post, comment or react
+	Verified  bool // users who have not confirmed their email address cannot post either
+	SessionID string
+	ExpiresAt time.Time
+}
+
+type contextKey string
+
+const sessionUserKey contextKey = "session_user"
+
+// userFromSession resolves the session cookie to a user, returning nil if there is no valid session
+func userFromSession(db *sql.DB, r *http.Request) (*SessionUser, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+
+	query := `
+		SELECT users.id, users.username, users.email, users.role, ` + mutedCondition + `, users.email_verified_at IS NOT NULL, sessions.uuid, sessions.expires_at
+		FROM sessions
+		JOIN users ON users.id = sessions.user_id
+		WHERE sessions.uuid = ? AND sessions.expires_at > ? AND NOT ` + lockedOutCondition
+
+	now := time.Now()
+	var user SessionUser
+	err = db.QueryRow(query, now, cookie.Value, now, now).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Muted,
+		&user.Verified, &user.SessionID, &user.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CurrentUser returns the user injected into the request context by RequireAuth or WithUser, or nil
+func CurrentUser(r *http.Request) *SessionUser {
+	user, _ := r.Context().Value(sessionUserKey).(*SessionUser)
+	return user
+}
+
+// RequireAuth rejects requests without a valid session, renews the session and injects its user into the context
+func RequireAuth(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := userFromSession(db, r)
+		if err != nil {
+			log.Println("Session lookup failed:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			http.Error(w, "Unauthorized: Please log in first", http.StatusUnauthorized)
+			return
+		}
+
+		if err := renewSession(db, w, user); err != nil {
+			log.Println("Failed to renew session:", err)
+		}
+
+		ctx := context.WithValue(r.Context(), sessionUserKey, user)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// WithUser injects the session user into the context when there is one, but lets anonymous requests through
+func WithUser(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := userFromSession(db, r)
+		if err != nil {
+			log.Println("Session lookup failed:", err)
+		}
+		if user != nil {
+			if err := renewSession(db, w, user); err != nil {
+				log.Println("Failed to renew session:", err)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), sessionUserKey, user))
+		}
+		next(w, r)
+	}
+}
+
+// RequireCanPost works like RequireAuth but also rejects users who have not confirmed their
+// email address or are muted. It guards every handler that publishes content or reactions.
+func RequireCanPost(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		user := CurrentUser(r)
+		if !user.Verified {
+			http.Error(w, "Forbidden: confirm your email address before posting", http.StatusForbidden)
+			return
+		}
+		if !user.Muted {
+			next(w, r)
+			return
+		}
+
+		sanction, err := activeSanction(db, user.ID, sanctionMute)
+		if err != nil {
+			log.Println("Failed to fetch mute:", err)
+		}
+		writeSanctionError(w, "Forbidden: your account is muted", sanction)
+	})
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Moderation actions recorded in moderation_log.action. Sanctions are logged against target
+// type "user" with the sanction kind as action, or "un" + kind when revoked early.
+const (
+	actionDismiss   = "dismiss"    // reports on the target were rejected
+	actionHide      = "hide"       // the reported content was removed
+	actionBanAuthor = "ban_author" // the author of the reported content was banned
+	actionDelete    = "delete"     // a moderator deleted someone else's content
+	actionLock      = "lock"
+	actionUnlock    = "unlock"
+	actionApprove   = "approve" // a pending post was published
+	actionReject    = "reject"  // a pending post was turned down
+)
+
+// contentTables maps the target types of reports and log entries to their tables
+var contentTables = map[string]string{"post": "posts", "comment": "comments"}
+
+// targetType returns the target type stored for content from table
+func targetType(table string) string {
+	return strings.TrimSuffix(table, "s")
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// ModerationLogEntry is one action in the moderation audit trail
+type ModerationLogEntry struct {
+	ID           int       `json:"id"`
+	ModeratorID  int       `json:"moderator_id"`
+	Moderator    string    `json:"moderator"`
+	Action       string    `json:"action"`
+	TargetType   string    `json:"target_type"` // "post", "comment" or "user"
+	TargetID     int       `json:"target_id"`
+	TargetUserID *int      `json:"target_user_id,omitempty"` // author of the target, or the user itself
+	Details      string    `json:"details,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// recordModeration appends an action to the moderation log. The author of the target is
+// looked up so the log can also be searched by affected user.
+func recordModeration(e execer, moderatorID int, action, target string, targetID int, details string) error {
+	affectedUser := "SELECT id FROM users WHERE id = ?"
+	if table, ok := contentTables[target]; ok {
+		affectedUser = fmt.Sprintf("SELECT user_id FROM %s WHERE id = ?", table)
+	}
+	_, err := e.Exec(`INSERT INTO moderation_log (moderator_id, action, target_type, target_id, target_user_id, details)
+		VALUES (?, ?, ?, ?, (`+affectedUser+`), ?)`,
+		moderatorID, action, target, targetID, targetID, details)
+	if err != nil {
+		return fmt.Errorf("failed to record moderation action: %v", err)
+	}
+	return nil
+}
+
+// setLocked locks or unlocks a post or comment that has not been deleted and logs the action
+func setLocked(db *sql.DB, table string, id int, locked bool, moderator *SessionUser) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("UPDATE %s SET locked_at = NULL WHERE id = ? AND deleted_at IS NULL", table)
+	action := actionUnlock
+	if locked {
+		query = fmt.Sprintf("UPDATE %s SET locked_at = COALESCE(locked_at, CURRENT_TIMESTAMP) WHERE id = ? AND deleted_at IS NULL", table)
+		action = actionLock
+	}
+	res, err := tx.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	if changed, err := res.RowsAffected(); err != nil {
+		return err
+	} else if changed == 0 {
+		return errContentNotFound
+	}
+
+	if err := recordModeration(tx, moderator.ID, action, targetType(table), id, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LockPostHandler locks or unlocks a post given by post_id. Locked posts stay visible but
+// accept no new comments and can no longer be edited.
+func LockPostHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the request method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			PostID int  `json:"post_id"`
+			Locked bool `json:"locked"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PostID == 0 {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if err := setLocked(db, "posts", req.PostID, req.Locked, CurrentUser(r)); err != nil {
+			writeContentError(w, err, "lock post")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"post_id": req.PostID, "locked": req.Locked})
+	}
+}
+
+// LockCommentHandler locks or unlocks a comment given by comment_id. Locked comments stay
+// visible but accept no replies and can no longer be edited.
+func LockCommentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the request method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			CommentID int  `json:"comment_id"`
+			Locked    bool `json:"locked"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CommentID == 0 {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if err := setLocked(db, "comments", req.CommentID, req.Locked, CurrentUser(r)); err != nil {
+			writeContentError(w, err, "lock comment")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"comment_id": req.CommentID, "locked": req.Locked})
+	}
+}
+
+// ModerationLogHandler returns a page of the moderation log, newest first. It can be narrowed
+// down to one target with target_type and target_id, or to one moderator with moderator_id.
+func ModerationLogHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		page, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		params := r.URL.Query()
+		query := `
+			SELECT l.id, l.moderator_id, COALESCE(u.username, ''), l.action, l.target_type, l.target_id,
+				l.target_user_id, l.details, l.created_at
+			FROM moderation_log l
+			LEFT JOIN users u ON u.id = l.moderator_id
+			WHERE 1 = 1`
+		var args []interface{}
+		if target := params.Get("target_type"); target != "" {
+			if _, ok := contentTables[target]; !ok && target != "user" {
+				http.Error(w, "Invalid target_type", http.StatusBadRequest)
+				return
+			}
+			targetID, err := strconv.Atoi(params.Get("target_id"))
+			if err != nil {
+				http.Error(w, "Invalid target_id", http.StatusBadRequest)
+				return
+			}
+			query += " AND l.target_type = ? AND l.target_id = ?"
+			args = append(args, target, targetID)
+		}
+		if moderator := params.Get("moderator_id"); moderator != "" {
+			moderatorID, err := strconv.Atoi(moderator)
+			if err != nil {
+				http.Error(w, "Invalid moderator_id", http.StatusBadRequest)
+				return
+			}
+			query += " AND l.moderator_id = ?"
+			args = append(args, moderatorID)
+		}
+		if condition, conditionArgs := keysetCondition(page, "l.created_at", "l.id"); condition != "" {
+			query += " AND " + condition
+			args = append(args, conditionArgs...)
+		}
+		direction, reverse := pageOrder(page, true)
+		query += fmt.Sprintf(" ORDER BY l.created_at %[1]s, l.id %[1]s LIMIT ?", direction)
+		args = append(args, page.Limit+1)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			log.Printf("Failed to fetch moderation log: %v\n", err)
+			http.Error(w, "Failed to fetch moderation log", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		entries := []ModerationLogEntry{}
+		for rows.Next() {
+			var entry ModerationLogEntry
+			var targetUserID sql.NullInt64
+			err := rows.Scan(&entry.ID, &entry.ModeratorID, &entry.Moderator, &entry.Action, &entry.TargetType, &entry.TargetID,
+				&targetUserID, &entry.Details, &entry.CreatedAt)
+			if err != nil {
+				log.Printf("Failed to scan moderation log row: %v\n", err)
+				http.Error(w, "Failed to fetch moderation log", http.StatusInternalServerError)
+				return
+			}
+			if targetUserID.Valid {
+				id := int(targetUserID.Int64)
+				entry.TargetUserID = &id
+			}
+			entries = append(entries, entry)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to fetch moderation log: %v\n", err)
+			http.Error(w, "Failed to fetch moderation log", http.StatusInternalServerError)
+			return
+		}
+
+		entries, next := finishPage(entries, page, reverse, func(e ModerationLogEntry) (time.Time, int) { return e.CreatedAt, e.ID })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Page{Items: entries, NextCursor: next})
+	}
+}
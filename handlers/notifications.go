@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"forum/mailer"
+)
+
+// Notification kinds stored in notifications.kind
+const (
+	notifyComment      = "comment"  // someone commented on the user's post
+	notifyReply        = "reply"    // someone replied to the user's comment
+	notifyReaction     = "reaction" // someone liked or disliked the user's post or comment
+	notifyMention      = "mention"  // someone mentioned the user in a post or comment
+	notifyPostApproved = "post_approved"
+	notifyPostRejected = "post_rejected"
+)
+
+// notificationEvents are the events users choose how to be notified about, in display order.
+// Each notification kind belongs to one of them.
+var notificationEvents = []string{notifyComment, notifyReply, notifyReaction, notifyMention, "moderation"}
+
+// notificationEvent returns the event a notification kind belongs to
+func notificationEvent(kind string) string {
+	if kind == notifyPostApproved || kind == notifyPostRejected {
+		return "moderation"
+	}
+	return kind
+}
+
+// NotificationPreference says how a user wants to be notified about one event
+type NotificationPreference struct {
+	Site  bool `json:"site"`
+	Email bool `json:"email"`
+}
+
+// defaultNotificationPreference applies to events a user has not chosen for
+var defaultNotificationPreference = NotificationPreference{Site: true, Email: false}
+
+// Notification tells a user about activity that concerns them
+type Notification struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	ActorID   int       `json:"actor_id,omitempty"` // user who caused the notification
+	Actor     string    `json:"actor,omitempty"`
+	PostID    int       `json:"post_id,omitempty"`
+	CommentID int       `json:"comment_id,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Read      bool      `json:"read"`
+}
+
+// storeNotification stores a notification for userID. Zero ids are stored as NULL.
+func storeNotification(e execer, userID int, n Notification) error {
+	_, err := e.Exec(`INSERT INTO notifications (user_id, kind, actor_id, post_id, comment_id, message)
+		VALUES (?, ?, NULLIF(?, 0), NULLIF(?, 0), NULLIF(?, 0), ?)`,
+		userID, n.Kind, n.ActorID, n.PostID, n.CommentID, n.Message)
+	if err != nil {
+		return fmt.Errorf("failed to store notification: %v", err)
+	}
+	return nil
+}
+
+// notifier records the notifications caused by one user's action in the transaction making
+// the change. Emails for them are only sent by sendEmails, once the transaction committed.
+type notifier struct {
+	tx        *sql.Tx
+	actorID   int
+	actorName string
+	notified  map[int]bool
+	emails    []mailer.Message
+}
+
+func newNotifier(tx *sql.Tx, actorID int, actorName string) *notifier {
+	return &notifier{tx: tx, actorID: actorID, actorName: actorName, notified: map[int]bool{}}
+}
+
+// notify notifies userID of n as their preferences for its event say. Users are not notified
+// of their own actions, nor more than once about the same action, nor after deleting their account.
+// Users who turned off one kind of notification can still receive another about the same action.
+func (nt *notifier) notify(userID int, n Notification) error {
+	if userID == nt.actorID || nt.notified[userID] {
+		return nil
+	}
+	n.ActorID = nt.actorID
+
+	var username, email string
+	pref := defaultNotificationPreference
+	err := nt.tx.QueryRow(`
+		SELECT users.username, users.email, COALESCE(p.site, ?), COALESCE(p.email, ?)
+		FROM users
+		LEFT JOIN notification_preferences p ON p.user_id = users.id AND p.event = ?
+		WHERE users.id = ? AND users.deleted_at IS NULL`,
+		pref.Site, pref.Email, notificationEvent(n.Kind), userID).Scan(&username, &email, &pref.Site, &pref.Email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch notification preferences: %v", err)
+	}
+	if !pref.Site && !pref.Email {
+		return nil
+	}
+	nt.notified[userID] = true
+
+	if pref.Site {
+		if err := storeNotification(nt.tx, userID, n); err != nil {
+			return err
+		}
+	}
+	if pref.Email {
+		nt.emails = append(nt.emails, mailer.Message{
+			To:      email,
+			Subject: n.Message,
+			Body: n.Message + "\n\n" + baseURL + "/\n\n" +
+				"You can choose which notifications you receive by email on your profile: " + baseURL + profileURL(username) + "\n",
+		})
+	}
+	return nil
+}
+
+// sendEmails sends the notification emails collected by notify
+func (nt *notifier) sendEmails() {
+	for _, msg := range nt.emails {
+		if err := outbox.Send(msg); err != nil {
+			log.Printf("Failed to email notification: %v\n", err)
+		}
+	}
+	nt.emails = nil
+}
+
+// ListNotificationsHandler returns a page of the current user's notifications, newest first.
+// status=unread or status=read lists only those.
+func ListNotificationsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		page, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		if status != "" && status != "read" && status != "unread" {
+			http.Error(w, "Invalid status: must be read or unread", http.StatusBadRequest)
+			return
+		}
+
+		query := `
+			SELECT n.id, n.kind, COALESCE(n.actor_id, 0), COALESCE(u.username, ''), COALESCE(n.post_id, 0),
+				COALESCE(n.comment_id, 0), n.message, n.created_at, n.read_at IS NOT NULL
+			FROM notifications n
+			LEFT JOIN users u ON u.id = n.actor_id
+			WHERE n.user_id = ?`
+		args := []interface{}{CurrentUser(r).ID}
+		if status == "read" {
+			query += " AND n.read_at IS NOT NULL"
+		} else if status == "unread" {
+			query += " AND n.read_at IS NULL"
+		}
+		if condition, conditionArgs := keysetCondition(page, "n.created_at", "n.id"); condition != "" {
+			query += " AND " + condition
+			args = append(args, conditionArgs...)
+		}
+		direction, reverse := pageOrder(page, true)
+		query += fmt.Sprintf(" ORDER BY n.created_at %[1]s, n.id %[1]s LIMIT ?", direction)
+		args = append(args, page.Limit+1)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			log.Printf("Failed to fetch notifications: %v\n", err)
+			http.Error(w, "Failed to fetch notifications", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		notifications := []Notification{}
+		for rows.Next() {
+			var n Notification
+			err := rows.Scan(&n.ID, &n.Kind, &n.ActorID, &n.Actor, &n.PostID, &n.CommentID, &n.Message, &n.CreatedAt, &n.Read)
+			if err != nil {
+				log.Printf("Failed to scan notification row: %v\n", err)
+				http.Error(w, "Failed to fetch notifications", http.StatusInternalServerError)
+				return
+			}
+			notifications = append(notifications, n)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to fetch notifications: %v\n", err)
+			http.Error(w, "Failed to fetch notifications", http.StatusInternalServerError)
+			return
+		}
+
+		notifications, next := finishPage(notifications, page, reverse, func(n Notification) (time.Time, int) { return n.CreatedAt, n.ID })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Page{Items: notifications, NextCursor: next})
+	}
+}
+
+// UnreadNotificationsHandler returns how many unread notifications the current user has
+func UnreadNotificationsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var unread int
+		err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", CurrentUser(r).ID).Scan(&unread)
+		if err != nil {
+			log.Printf("Failed to count notifications: %v\n", err)
+			http.Error(w, "Failed to count notifications", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+	}
+}
+
+// MarkNotificationsReadHandler marks the current user's notifications with the given ids as
+// read, or all of them when all is true
+func MarkNotificationsReadHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			IDs []int `json:"ids"`
+			All bool  `json:"all"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if !req.All && len(req.IDs) == 0 {
+			http.Error(w, "Missing ids or all", http.StatusBadRequest)
+			return
+		}
+
+		query := "UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = ? AND read_at IS NULL"
+		args := []interface{}{CurrentUser(r).ID}
+		if !req.All {
+			placeholders := make([]string, len(req.IDs))
+			for i, id := range req.IDs {
+				placeholders[i] = "?"
+				args = append(args, id)
+			}
+			query += " AND id IN (" + strings.Join(placeholders, ", ") + ")"
+		}
+
+		res, err := db.Exec(query, args...)
+		if err != nil {
+			log.Printf("Failed to mark notifications read: %v\n", err)
+			http.Error(w, "Failed to mark notifications read", http.StatusInternalServerError)
+			return
+		}
+		marked, _ := res.RowsAffected()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "Notifications marked read", "marked": marked})
+	}
+}
+
+// notificationPreferences returns how a user is notified about every event
+func notificationPreferences(db *sql.DB, userID int) (map[string]NotificationPreference, error) {
+	prefs := make(map[string]NotificationPreference, len(notificationEvents))
+	for _, event := range notificationEvents {
+		prefs[event] = defaultNotificationPreference
+	}
+
+	rows, err := db.Query("SELECT event, site, email FROM notification_preferences WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event string
+		var pref NotificationPreference
+		if err := rows.Scan(&event, &pref.Site, &pref.Email); err != nil {
+			return nil, err
+		}
+		if _, known := prefs[event]; known {
+			prefs[event] = pref
+		}
+	}
+	return prefs, rows.Err()
+}
+
+// NotificationPreferencesHandler returns how the current user is notified about each event,
+// on the site and by email
+func NotificationPreferencesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		prefs, err := notificationPreferences(db, CurrentUser(r).ID)
+		if err != nil {
+			log.Printf("Failed to fetch notification preferences: %v\n", err)
+			http.Error(w, "Failed to fetch notification preferences", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(prefs)
+	}
+}
+
+// UpdateNotificationPreferencesHandler changes how the current user is notified about the
+// events in the request, such as {"reaction": {"site": false, "email": false}}, and returns
+// all preferences
+func UpdateNotificationPreferencesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req map[string]NotificationPreference
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		for event := range req {
+			if !slices.Contains(notificationEvents, event) {
+				http.Error(w, fmt.Sprintf("Unknown event %q: must be one of %s", event, strings.Join(notificationEvents, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+
+		user := CurrentUser(r)
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Failed to start transaction: %v\n", err)
+			http.Error(w, "Failed to update notification preferences", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		for event, pref := range req {
+			_, err = tx.Exec(`INSERT INTO notification_preferences (user_id, event, site, email) VALUES (?, ?, ?, ?)
+				ON CONFLICT (user_id, event) DO UPDATE SET site = excluded.site, email = excluded.email`,
+				user.ID, event, pref.Site, pref.Email)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Failed to update notification preferences: %v\n", err)
+			http.Error(w, "Failed to update notification preferences", http.StatusInternalServerError)
+			return
+		}
+
+		prefs, err := notificationPreferences(db, user.ID)
+		if err != nil {
+			log.Printf("Failed to fetch notification preferences: %v\n", err)
+			http.Error(w, "Failed to fetch notification preferences", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(prefs)
+	}
+}
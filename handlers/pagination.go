@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// sqliteTimestampLayout matches the format CURRENT_TIMESTAMP stores, so cursors compare correctly against created_at
+const sqliteTimestampLayout = "2006-01-02 15:04:05"
+
+// Page is the response envelope for paginated list endpoints.
+// NextCursor continues in the same direction as the request and is empty on the last page.
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// cursor is a position in a list ordered by (created_at, id)
+type cursor struct {
+	CreatedAt string
+	ID        int
+}
+
+// pageParams holds the limit and at most one of the before/after cursors of a list request
+type pageParams struct {
+	Limit  int
+	Before *cursor // items strictly older than this position
+	After  *cursor // items strictly newer than this position
+}
+
+// encodeCursor builds an opaque cursor for the given row position
+func encodeCursor(createdAt time.Time, id int) string {
+	raw := fmt.Sprintf("%s|%d", createdAt.UTC().Format(sqliteTimestampLayout), id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor parses a cursor built by encodeCursor
+func decodeCursor(value string) (*cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	createdAt, idStr, found := strings.Cut(string(raw), "|")
+	if !found {
+		return nil, errors.New("invalid cursor")
+	}
+	if _, err := time.Parse(sqliteTimestampLayout, createdAt); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &cursor{CreatedAt: createdAt, ID: id}, nil
+}
+
+// parseLimit reads the page size from the limit query parameter, capped at maxPageSize
+func parseLimit(params url.Values) (int, error) {
+	limitStr := params.Get("limit")
+	if limitStr == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("invalid limit")
+	}
+	return min(limit, maxPageSize), nil
+}
+
+// parsePageParams reads limit, before and after from the query string
+func parsePageParams(r *http.Request) (pageParams, error) {
+	params := r.URL.Query()
+	page := pageParams{Limit: defaultPageSize}
+
+	limit, err := parseLimit(params)
+	if err != nil {
+		return page, err
+	}
+	page.Limit = limit
+
+	before, after := params.Get("before"), params.Get("after")
+	if before != "" && after != "" {
+		return page, errors.New("before and after cannot be combined")
+	}
+
+	if before != "" {
+		page.Before, err = decodeCursor(before)
+	}
+	if after != "" {
+		page.After, err = decodeCursor(after)
+	}
+	return page, err
+}
+
+// keysetCondition returns the WHERE clause and arguments restricting a (created_at, id) list to the page's cursor
+func keysetCondition(page pageParams, createdAtColumn, idColumn string) (string, []interface{}) {
+	switch {
+	case page.Before != nil:
+		return fmt.Sprintf("(%s, %s) < (?, ?)", createdAtColumn, idColumn), []interface{}{page.Before.CreatedAt, page.Before.ID}
+	case page.After != nil:
+		return fmt.Sprintf("(%s, %s) > (?, ?)", createdAtColumn, idColumn), []interface{}{page.After.CreatedAt, page.After.ID}
+	}
+	return "", nil
+}
+
+// pageOrder returns the direction to run a list query in, and whether the fetched rows
+// must be reversed afterwards to restore the list's natural order
+func pageOrder(page pageParams, newestFirst bool) (direction string, reverse bool) {
+	if newestFirst {
+		if page.After != nil {
+			return "ASC", true
+		}
+		return "DESC", false
+	}
+	if page.Before != nil {
+		return "DESC", true
+	}
+	return "ASC", false
+}
+
+// finishPage drops the look-ahead row fetched beyond the limit, derives the next cursor
+// from the last row kept and restores the list's natural order
+func finishPage[T any](items []T, page pageParams, reverse bool, position func(T) (time.Time, int)) ([]T, string) {
+	next := ""
+	if len(items) > page.Limit {
+		items = items[:page.Limit]
+		createdAt, id := position(items[len(items)-1])
+		next = encodeCursor(createdAt, id)
+	}
+	if reverse {
+		slices.Reverse(items)
+	}
+	return items, next
+}
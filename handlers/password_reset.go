@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// forgotPasswordMessage is the answer to every password reset request, so that it does not
+// reveal which addresses have an account
+const forgotPasswordMessage = "If an account uses this address, a link to reset its password was sent to it"
+
+// ForgotPasswordHandler mails a password reset link to the account with the given email address
+func ForgotPasswordHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if req.Email == "" {
+			http.Error(w, "Email is required", http.StatusBadRequest)
+			return
+		}
+
+		var userID int
+		var username string
+		err := db.QueryRow("SELECT id, username FROM users WHERE email = ? AND deleted_at IS NULL", req.Email).Scan(&userID, &username)
+		if err == nil {
+			var token string
+			token, err = newAccountToken(db, userID, tokenPasswordReset, req.Email, passwordResetLifetime)
+			if err == nil {
+				err = sendTokenEmail(req.Email, "Reset your password",
+					fmt.Sprintf("Open this link within %s to choose a new password for your forum account %s:", lifetimeText(passwordResetLifetime), username),
+					"/account/reset-password", token)
+			}
+		}
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Failed to send password reset link: %v\n", err)
+			http.Error(w, "Failed to send the password reset email", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": forgotPasswordMessage})
+	}
+}
+
+// ResetPasswordHandler sets a new password with the token from a password reset link and logs
+// the account out everywhere
+func ResetPasswordHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Token       string `json:"token"`
+			NewPassword string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if len(req.NewPassword) < minPasswordLength {
+			http.Error(w, fmt.Sprintf("New password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcryptCost)
+		if err != nil {
+			log.Printf("Failed to hash password: %v\n", err)
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			return
+		}
+
+		err = resetPassword(db, req.Token, string(hash))
+		if errors.Is(err, errInvalidToken) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to reset password: %v\n", err)
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Password changed, please log in"})
+	}
+}
+
+// resetPassword consumes a password reset token and stores the new password hash. Opening the
+// link proves the user controls the address, so it also counts as confirming it. Other reset
+// links and all sessions of the account stop working.
+func resetPassword(db *sql.DB, token, hash string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	t, err := useAccountToken(tx, token, tokenPasswordReset)
+	if err != nil {
+		return err
+	}
+
+	// A reset link only counts for the address the account still has
+	res, err := tx.Exec(`UPDATE users SET password = ?, email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP)
+		WHERE id = ? AND email = ? AND deleted_at IS NULL`, hash, t.UserID, t.Email)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errInvalidToken
+	}
+
+	if _, err := tx.Exec("DELETE FROM account_tokens WHERE user_id = ? AND purpose = ? AND used_at IS NULL", t.UserID, tokenPasswordReset); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", t.UserID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
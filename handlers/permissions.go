@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Role is the level of trust given to a user
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// Permission is an action restricted to some roles
+type Permission string
+
+const (
+	PermModerateContent  Permission = "moderate_content"  // delete or lock any post or comment
+	PermManageCategories Permission = "manage_categories" // create, rename and delete categories
+	PermManageUsers      Permission = "manage_users"      // list users and change their roles
+)
+
+// rolePermissions lists what each role may do on top of acting on its own content
+var rolePermissions = map[Role][]Permission{
+	RoleUser:      nil,
+	RoleModerator: {PermModerateContent},
+	RoleAdmin:     {PermModerateContent, PermManageCategories, PermManageUsers},
+}
+
+// errUnknownRole is returned when a role name is not one of the defined roles
+var errUnknownRole = errors.New("unknown role")
+
+// ParseRole validates a role name
+func ParseRole(name string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(name)))
+	if _, ok := rolePermissions[role]; !ok {
+		return "", fmt.Errorf("%w %q: must be user, moderator or admin", errUnknownRole, name)
+	}
+	return role, nil
+}
+
+// Can reports whether the user's role grants a permission
+func (u *SessionUser) Can(permission Permission) bool {
+	if u == nil {
+		return false
+	}
+	for _, granted := range rolePermissions[u.Role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission works like RequireAuth but also rejects users whose role lacks the permission
+func RequirePermission(db *sql.DB, permission Permission, next http.HandlerFunc) http.HandlerFunc {
+	return RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		if !CurrentUser(r).Can(permission) {
+			http.Error(w, "Forbidden: insufficient permissions", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// SetUserRole changes the role of the user given by username or email and returns the user's id.
+// It refuses to guess when ref is the username of one user and the email of another.
+func SetUserRole(db *sql.DB, ref string, role Role) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM users WHERE username = ? OR email = ?", ref, ref)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	switch {
+	case len(ids) == 0:
+		return 0, fmt.Errorf("no user with username or email %q", ref)
+	case len(ids) > 1:
+		return 0, fmt.Errorf("%q is the username of one user and the email of another; no role was changed", ref)
+	}
+
+	if _, err := tx.Exec("UPDATE users SET role = ? WHERE id = ?", role, ids[0]); err != nil {
+		return 0, err
+	}
+	return ids[0], tx.Commit()
+}
+
+// logPermissionUse records actions taken through a permission rather than ownership
+func logPermissionUse(user *SessionUser, permission Permission, action string) {
+	log.Printf("User %d (%s) used %s to %s\n", user.ID, user.Role, permission, action)
+}
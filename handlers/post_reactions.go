@@ -3,11 +3,13 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
 )
 
+// AddReactionHandler toggles the current user's reaction on a post or comment and returns the updated counts
 func AddReactionHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -16,7 +18,6 @@ func AddReactionHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		var data struct {
-			UserID       int    `json:"user_id"`
 			PostID       *int   `json:"post_id,omitempty"`
 			CommentID    *int   `json:"comment_id,omitempty"`
 			ReactionType string `json:"reaction_type"` // "LIKE" or "DISLIKE"
@@ -26,7 +27,7 @@ func AddReactionHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if data.UserID == 0 || data.ReactionType == "" ||
+		if data.ReactionType == "" ||
 			(data.PostID == nil && data.CommentID == nil) {
 			http.Error(w, "Missing required fields", http.StatusBadRequest)
 			return
@@ -37,39 +38,35 @@ func AddReactionHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var table, column string
-		var id interface{}
+		user := CurrentUser(r)
 
+		target := postReactionTarget
+		var id int
 		if data.PostID != nil {
-			table = "post_reactions"
-			column = "post_id"
-			id = data.PostID
-		} else if data.CommentID != nil {
-			table = "comment_reactions"
-			column = "comment_id"
-			id = data.CommentID
+			id = *data.PostID
+		} else {
+			target = commentReactionTarget
+			id = *data.CommentID
 		}
 
-		// Remove existing reaction for the user on the same post/comment
-		deleteQuery := `DELETE FROM ` + table + ` WHERE user_id = ? AND ` + column + ` = ?`
-		_, err := db.Exec(deleteQuery, data.UserID, id)
-		if err != nil {
-			log.Printf("Failed to remove existing reaction: %v\n", err)
-			http.Error(w, "Failed to process reaction", http.StatusInternalServerError)
+		result, err := toggleReaction(db, target, user, id, data.ReactionType)
+		if errors.Is(err, errReactionTargetNotFound) {
+			http.Error(w, "Post or comment not found", http.StatusNotFound)
 			return
 		}
-
-		// Insert the new reaction
-		insertQuery := `INSERT INTO ` + table + ` (user_id, ` + column + `, reaction_type) VALUES (?, ?, ?)`
-		_, err = db.Exec(insertQuery, data.UserID, id, data.ReactionType)
 		if err != nil {
-			log.Printf("Failed to add reaction: %v\n", err)
+			log.Printf("Failed to process reaction: %v\n", err)
 			http.Error(w, "Failed to process reaction", http.StatusInternalServerError)
 			return
 		}
+		if data.PostID != nil {
+			result.PostID = id
+		} else {
+			result.CommentID = id
+		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Reaction added successfully"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
 	}
 }
 
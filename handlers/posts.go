@@ -3,18 +3,39 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
 // Post represents the structure of a post
 type Post struct {
-	ID        int       `json:"id"`
-	Title     string    `json:"title"`
-	Content   string    `json:"content"`
-	Author    string    `json:"author"`
-	CreatedAt time.Time `json:"created_at"`
+	ID             int            `json:"id"`
+	Title          string         `json:"title"`
+	Content        string         `json:"content"`      // Markdown source
+	ContentHTML    string         `json:"content_html"` // Content rendered to sanitized HTML
+	Author         string         `json:"author"`
+	CreatedAt      time.Time      `json:"created_at"`
+	Categories     []PostCategory `json:"categories"`
+	Likes          int            `json:"likes"`
+	Dislikes       int            `json:"dislikes"`
+	CommentCount   int            `json:"comment_count"`
+	ViewerReaction string         `json:"viewer_reaction,omitempty"` // "LIKE", "DISLIKE" or empty
+	Edited         bool           `json:"edited"`
+	EditedAt       *time.Time     `json:"edited_at,omitempty"`
+	Locked         bool           `json:"locked"`   // locked posts accept no new comments or edits
+	Status         string         `json:"status"`   // "approved", or "pending"/"rejected" under pre-moderation
+	Mentions       []string       `json:"mentions"` // usernames mentioned as @username, linked to their profiles in ContentHTML
+}
+
+// PostCategory is the short form of a category embedded in a post
+type PostCategory struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
 }
 
 // CreatePostHandler handles creating a new post
@@ -28,34 +49,18 @@ func CreatePostHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		
-
-		// Retrieve session token from cookie
-		cookie, err := r.Cookie("session_token")
-		if err != nil {
-			log.Println("Failed to retrieve session token:", err)
-			http.Error(w, "Unauthorized: Please log in first", http.StatusUnauthorized)
-			return
-		}
-		log.Println("Session token received:", cookie.Value)
 
-		// Validate the session token in the database
-		var userID int
-		query := "SELECT user_id FROM sessions WHERE uuid = ? AND expires_at > DATETIME('now')"
-		err = db.QueryRow(query, cookie.Value).Scan(&userID)
-		if err != nil {
-			log.Println("Session validation failed. Token might be invalid or expired:", err)
-			http.Error(w, "Unauthorized: Please log in first", http.StatusUnauthorized)
-			return
-		}
-		log.Println("Session validated successfully. User ID:", userID)
+		// The session user is injected by RequireAuth
+		user := CurrentUser(r)
+		userID := user.ID
 
 		// Parse and decode the request body
 		var req struct {
-			Title   string `json:"title"`
-			Content string `json:"content"`
+			Title      string   `json:"title"`
+			Content    string   `json:"content"`
+			Categories []string `json:"categories"` // category slugs or ids
 		}
-		err = json.NewDecoder(r.Body).Decode(&req)
+		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
 			log.Println("Failed to decode request body:", err)
 			http.Error(w, "Invalid request payload", http.StatusBadRequest)
@@ -70,20 +75,105 @@ func CreatePostHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Insert the new post into the database
-		query = "INSERT INTO posts (user_id, title, content) VALUES (?, ?, ?)"
-		_, err = db.Exec(query, userID, req.Title, req.Content)
+		// Resolve the requested categories before writing anything
+		categoryIDs, err := resolveCategoryIDs(db, req.Categories)
+		if errors.Is(err, errUnknownCategory) {
+			log.Println("Validation failed:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("Error resolving categories:", err)
+			http.Error(w, "Failed to create post", http.StatusInternalServerError)
+			return
+		}
+
+		// Under pre-moderation, posts by untrusted users wait for review
+		status, err := newPostStatus(db, user)
+		if err != nil {
+			log.Println("Error checking post status:", err)
+			http.Error(w, "Failed to create post", http.StatusInternalServerError)
+			return
+		}
+
+		// Insert the post and its categories in a single transaction
+		tx, err := db.Begin()
+		if err != nil {
+			log.Println("Error starting transaction:", err)
+			http.Error(w, "Failed to create post", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		query := "INSERT INTO posts (user_id, title, content, status) VALUES (?, ?, ?, ?)"
+		res, err := tx.Exec(query, userID, req.Title, req.Content, status)
 		if err != nil {
 			log.Println("Error inserting post into database:", err)
 			http.Error(w, "Failed to create post", http.StatusInternalServerError)
 			return
 		}
+
+		postID, err := res.LastInsertId()
+		if err != nil {
+			log.Println("Error retrieving inserted post ID:", err)
+			http.Error(w, "Failed to create post", http.StatusInternalServerError)
+			return
+		}
+
+		for _, categoryID := range categoryIDs {
+			_, err = tx.Exec("INSERT INTO post_categories (post_id, category_id) VALUES (?, ?)", postID, categoryID)
+			if err != nil {
+				log.Println("Error assigning category to post:", err)
+				http.Error(w, "Failed to create post", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		mentioned, err := storeMentions(tx, int(postID), 0, req.Title+"\n"+req.Content)
+		if err != nil {
+			log.Println("Error storing mentions:", err)
+			http.Error(w, "Failed to create post", http.StatusInternalServerError)
+			return
+		}
+
+		if err = cacheContentHTML(tx, int(postID), 0, req.Content); err != nil {
+			log.Println("Error rendering post:", err)
+			http.Error(w, "Failed to create post", http.StatusInternalServerError)
+			return
+		}
+
+		// Users mentioned in a post waiting for review are notified once it is approved
+		notifications := newNotifier(tx, userID, user.Username)
+		if status == postApproved {
+			n := Notification{Kind: notifyMention, PostID: int(postID), Message: fmt.Sprintf("%s mentioned you in the post %q", user.Username, req.Title)}
+			if err = notifications.notifyMentions(mentioned, n); err != nil {
+				log.Println("Error notifying mentioned users:", err)
+				http.Error(w, "Failed to create post", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err = tx.Commit(); err != nil {
+			log.Println("Error committing post:", err)
+			http.Error(w, "Failed to create post", http.StatusInternalServerError)
+			return
+		}
+		notifications.sendEmails()
+		if status == postApproved {
+			publishPost(db, int(postID))
+		}
 		log.Println("Post successfully created for user ID:", userID)
 
 		// Respond with a success message
+		message := "Post created successfully"
+		if status == postPending {
+			message = "Post submitted for review"
+		}
 		w.Header().Set("Content-Type", "application/json")
-		response := map[string]string{
-			"message": "Post created successfully",
+		response := map[string]interface{}{
+			"message": message,
+			"id":      postID,
+			"status":  status,
 		}
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			log.Println("Failed to encode response:", err)
@@ -92,7 +182,103 @@ func CreatePostHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// GetPostsHandler handles fetching posts from the database
+// EditPostHandler lets the author change the title and content of a post. The previous
+// version is kept in the post's revision history.
+func EditPostHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the request method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user := CurrentUser(r)
+
+		var req struct {
+			PostID  int    `json:"post_id"`
+			Title   string `json:"title"`
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.PostID == 0 || req.Title == "" || req.Content == "" {
+			http.Error(w, "post_id, title and content are required", http.StatusBadRequest)
+			return
+		}
+
+		// Edits by untrusted users go back through review, so approval cannot be used to
+		// publish different content
+		trusted, err := isTrusted(db, user)
+		if err != nil {
+			log.Println("Error checking trust:", err)
+			http.Error(w, "Failed to edit post", http.StatusInternalServerError)
+			return
+		}
+		status := ""
+		if !trusted {
+			status = postPending
+		}
+
+		mentioned, err := reviseContent(db, postRevisionSource, req.PostID, user.ID, req.Title, req.Content, status)
+		if err != nil {
+			writeContentError(w, err, "edit post")
+			return
+		}
+		log.Println("Post", req.PostID, "edited by user ID:", user.ID)
+
+		// Respond with the updated post
+		posts, _, err := queryPosts(db, postFilter{PostID: req.PostID}, pageParams{Limit: 1}, user.ID)
+		if err != nil || len(posts) == 0 {
+			log.Println("Error fetching edited post:", err)
+			http.Error(w, "Failed to fetch edited post", http.StatusInternalServerError)
+			return
+		}
+
+		// Mentions in edits that went back to review are notified on approval
+		if posts[0].Status == postApproved {
+			n := Notification{Kind: notifyMention, PostID: req.PostID, Message: fmt.Sprintf("%s mentioned you in the post %q", user.Username, req.Title)}
+			notifyEditMentions(db, user, mentioned, n)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(posts[0])
+	}
+}
+
+// DeletePostHandler lets the author or a moderator delete a post. The post is hidden from every listing
+// but kept in the database together with its revisions.
+func DeletePostHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the request method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user := CurrentUser(r)
+
+		var req struct {
+			PostID int `json:"post_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PostID == 0 {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if err := softDelete(db, "posts", req.PostID, user); err != nil {
+			writeContentError(w, err, "delete post")
+			return
+		}
+		log.Println("Post", req.PostID, "deleted by user ID:", user.ID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Post deleted successfully"})
+	}
+}
+
+// GetPostsHandler handles fetching posts from the database, optionally filtered by
+// category, by posts the current user created or by posts the current user liked
 func GetPostsHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Incoming request to fetch posts")
@@ -104,58 +290,168 @@ func GetPostsHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Query to fetch posts with author name
-		query := `
-			SELECT 
-				posts.id, 
-				posts.title, 
-				posts.content, 
-				users.username AS author, 
-				posts.created_at
-			FROM 
-				posts
-			JOIN 
-				users 
-			ON 
-				posts.user_id = users.id
-			ORDER BY 
-				posts.created_at DESC
-		`
-
-		// Execute the query
-		rows, err := db.Query(query)
+		page, err := parsePageParams(r)
 		if err != nil {
-			log.Println("Error executing query:", err)
-			http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer rows.Close()
 
-		// Prepare the response
-		var posts []Post
-		for rows.Next() {
-			var post Post
-			err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.Author, &post.CreatedAt)
+		// Build the filter from the query string; every filter can be combined with the others
+		var filter postFilter
+		params := r.URL.Query()
+
+		if ref := params.Get("category"); ref != "" {
+			categoryID, err := findCategoryID(db, ref)
+			if errors.Is(err, errUnknownCategory) {
+				http.Error(w, "Category not found", http.StatusNotFound)
+				return
+			}
 			if err != nil {
-				log.Println("Error scanning row:", err)
+				log.Println("Error resolving category:", err)
 				http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
 				return
 			}
-			posts = append(posts, post)
+			filter.CategoryID = categoryID
+		}
+
+		created := params.Get("created") == "true"
+		liked := params.Get("liked") == "true"
+		if created || liked {
+			user := CurrentUser(r)
+			if user == nil {
+				http.Error(w, "Unauthorized: Please log in first", http.StatusUnauthorized)
+				return
+			}
+			if created {
+				filter.AuthorID = user.ID
+			}
+			if liked {
+				filter.LikedBy = user.ID
+			}
 		}
 
-		// Check for errors after row iteration
-		if err = rows.Err(); err != nil {
-			log.Println("Row iteration error:", err)
+		viewerID := 0
+		if user := CurrentUser(r); user != nil {
+			viewerID = user.ID
+		}
+
+		posts, next, err := queryPosts(db, filter, page, viewerID)
+		if err != nil {
+			log.Println("Error fetching posts:", err)
 			http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
 			return
 		}
 
-		// Respond with the posts in JSON format
+		// Respond with the page of posts in JSON format
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(posts); err != nil {
+		if err := json.NewEncoder(w).Encode(Page{Items: posts, NextCursor: next}); err != nil {
 			log.Println("Failed to encode response:", err)
 			http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
 		}
 	}
 }
+
+// postFilter narrows down the posts returned by queryPosts
+type postFilter struct {
+	Status     string // only posts in this status; by default approved posts and the viewer's own
+	PostID     int    // only this post
+	CategoryID int
+	AuthorID   int // only posts written by this user
+	LikedBy    int // only posts this user reacted LIKE to
+}
+
+// queryPosts fetches one page of posts, newest first, and returns the cursor of the following page.
+// Each post carries its author, categories, reaction and comment counts and the reaction of
+// viewerID (0 for anonymous viewers), all computed by the same query.
+func queryPosts(db *sql.DB, filter postFilter, page pageParams, viewerID int) ([]Post, string, error) {
+	args := []interface{}{viewerID}
+	conditions := []string{"posts.deleted_at IS NULL"}
+	if filter.Status != "" {
+		conditions = append(conditions, "posts.status = ?")
+		args = append(args, filter.Status)
+	} else {
+		conditions = append(conditions, "(posts.status = 'approved' OR posts.user_id = ?)")
+		args = append(args, viewerID)
+	}
+	if filter.PostID != 0 {
+		conditions = append(conditions, "posts.id = ?")
+		args = append(args, filter.PostID)
+	}
+	if filter.CategoryID != 0 {
+		conditions = append(conditions, "posts.id IN (SELECT post_id FROM post_categories WHERE category_id = ?)")
+		args = append(args, filter.CategoryID)
+	}
+	if filter.AuthorID != 0 {
+		conditions = append(conditions, "posts.user_id = ?")
+		args = append(args, filter.AuthorID)
+	}
+	if filter.LikedBy != 0 {
+		conditions = append(conditions, "posts.id IN (SELECT post_id FROM post_reactions WHERE user_id = ? AND reaction_type = 'LIKE')")
+		args = append(args, filter.LikedBy)
+	}
+	if condition, conditionArgs := keysetCondition(page, "posts.created_at", "posts.id"); condition != "" {
+		conditions = append(conditions, condition)
+		args = append(args, conditionArgs...)
+	}
+
+	direction, reverse := pageOrder(page, true)
+
+	query := `
+		SELECT posts.id, posts.title, posts.content, posts.content_html, users.username AS author, posts.created_at, posts.edited_at, posts.locked_at IS NOT NULL, posts.status,
+			(SELECT json_group_array(json_object('id', c.id, 'name', c.name, 'slug', c.slug))
+				FROM post_categories pc JOIN categories c ON c.id = pc.category_id
+				WHERE pc.post_id = posts.id) AS categories,
+			(SELECT json_group_array(u.username)
+				FROM mentions m JOIN users u ON u.id = m.user_id
+				WHERE m.post_id = posts.id AND m.comment_id IS NULL AND u.deleted_at IS NULL) AS mentions,
+			(SELECT COUNT(*) FROM post_reactions WHERE post_id = posts.id AND reaction_type = 'LIKE') AS likes,
+			(SELECT COUNT(*) FROM post_reactions WHERE post_id = posts.id AND reaction_type = 'DISLIKE') AS dislikes,
+			(SELECT COUNT(*) FROM comments WHERE post_id = posts.id AND deleted_at IS NULL) AS comment_count,
+			(SELECT reaction_type FROM post_reactions WHERE post_id = posts.id AND user_id = ? LIMIT 1) AS viewer_reaction
+		FROM posts
+		JOIN users ON posts.user_id = users.id`
+	query += " WHERE " + strings.Join(conditions, " AND ")
+	query += fmt.Sprintf(" ORDER BY posts.created_at %[1]s, posts.id %[1]s LIMIT ?", direction)
+	args = append(args, page.Limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	posts := []Post{}
+	for rows.Next() {
+		var post Post
+		var categories, mentions string
+		var viewerReaction, contentHTML sql.NullString
+		var editedAt sql.NullTime
+		err := rows.Scan(&post.ID, &post.Title, &post.Content, &contentHTML, &post.Author, &post.CreatedAt, &editedAt, &post.Locked, &post.Status,
+			&categories, &mentions, &post.Likes, &post.Dislikes, &post.CommentCount, &viewerReaction)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := json.Unmarshal([]byte(categories), &post.Categories); err != nil {
+			return nil, "", fmt.Errorf("failed to decode categories of post %d: %v", post.ID, err)
+		}
+		if err := json.Unmarshal([]byte(mentions), &post.Mentions); err != nil {
+			return nil, "", fmt.Errorf("failed to decode mentions of post %d: %v", post.ID, err)
+		}
+		// Content not rendered yet is rendered on the fly
+		post.ContentHTML = contentHTML.String
+		if !contentHTML.Valid {
+			post.ContentHTML = renderMarkdown(post.Content, post.Mentions)
+		}
+		post.ViewerReaction = viewerReaction.String
+		if editedAt.Valid {
+			post.Edited, post.EditedAt = true, &editedAt.Time
+		}
+		posts = append(posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	posts, next := finishPage(posts, page, reverse, func(p Post) (time.Time, int) { return p.CreatedAt, p.ID })
+	return posts, next, nil
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayName      = 50  // characters
+	maxBio              = 500 // characters
+	recentActivityLimit = 10
+)
+
+// Profile is the public view of a user
+type Profile struct {
+	ID             int        `json:"id"`
+	Username       string     `json:"username"`
+	DisplayName    string     `json:"display_name"` // empty when the user has not set one
+	Bio            string     `json:"bio"`
+	AvatarURL      string     `json:"avatar_url"`
+	Role           Role       `json:"role"`
+	JoinedAt       time.Time  `json:"joined_at"`
+	PostCount      int        `json:"post_count"`
+	CommentCount   int        `json:"comment_count"`
+	Reputation     int        `json:"reputation"` // likes received from other users
+	RecentActivity []Activity `json:"recent_activity"`
+}
+
+// Activity is a post or comment in a user's recent activity
+type Activity struct {
+	Type      string    `json:"type"` // "post" or "comment"
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	PostTitle string    `json:"post_title"`
+	Excerpt   string    `json:"excerpt"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// profileURL returns the path of a user's profile page
+func profileURL(username string) string {
+	return "/users/" + url.PathEscape(username)
+}
+
+// avatarURL returns where the generated avatar of a user is served
+func avatarURL(username string) string {
+	return profileURL(username) + "/avatar"
+}
+
+// queryProfile fetches the profile of the user with the given username, or nil if there is none.
+// Only published content counts towards the numbers and the activity.
+func queryProfile(db *sql.DB, username string) (*Profile, error) {
+	var p Profile
+	err := db.QueryRow(`
+		SELECT users.id, users.username, users.display_name, users.bio, users.role, users.created_at,
+			(SELECT COUNT(*) FROM posts WHERE posts.user_id = users.id AND posts.deleted_at IS NULL AND posts.status = 'approved'),
+			(SELECT COUNT(*) FROM comments
+				JOIN posts ON posts.id = comments.post_id
+				WHERE comments.user_id = users.id AND comments.deleted_at IS NULL
+				AND posts.deleted_at IS NULL AND posts.status = 'approved'),
+			(SELECT COUNT(*) FROM post_reactions
+				JOIN posts ON posts.id = post_reactions.post_id
+				WHERE posts.user_id = users.id AND post_reactions.user_id != users.id
+				AND post_reactions.reaction_type = 'LIKE' AND posts.deleted_at IS NULL)
+			+ (SELECT COUNT(*) FROM comment_reactions
+				JOIN comments ON comments.id = comment_reactions.comment_id
+				WHERE comments.user_id = users.id AND comment_reactions.user_id != users.id
+				AND comment_reactions.reaction_type = 'LIKE' AND comments.deleted_at IS NULL)
+		FROM users WHERE users.username = ? AND users.deleted_at IS NULL`, username).Scan(
+		&p.ID, &p.Username, &p.DisplayName, &p.Bio, &p.Role, &p.JoinedAt, &p.PostCount, &p.CommentCount, &p.Reputation)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.AvatarURL = avatarURL(p.Username)
+
+	rows, err := db.Query(`
+		SELECT 'post' AS type, id, id AS post_id, title, substr(content, 1, 200), created_at
+		FROM posts
+		WHERE user_id = ? AND deleted_at IS NULL AND status = 'approved'
+		UNION ALL
+		SELECT 'comment', comments.id, comments.post_id, posts.title, substr(comments.content, 1, 200), comments.created_at
+		FROM comments
+		JOIN posts ON posts.id = comments.post_id
+		WHERE comments.user_id = ? AND comments.deleted_at IS NULL AND posts.deleted_at IS NULL AND posts.status = 'approved'
+		ORDER BY created_at DESC, type DESC, id DESC
+		LIMIT ?`, p.ID, p.ID, recentActivityLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recent activity: %v", err)
+	}
+	defer rows.Close()
+
+	p.RecentActivity = []Activity{}
+	for rows.Next() {
+		var a Activity
+		if err := rows.Scan(&a.Type, &a.ID, &a.PostID, &a.PostTitle, &a.Excerpt, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan activity row: %v", err)
+		}
+		p.RecentActivity = append(p.RecentActivity, a)
+	}
+	return &p, rows.Err()
+}
+
+// GetProfileHandler returns the public profile of the user named in the path
+func GetProfileHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		profile, err := queryProfile(db, r.PathValue("username"))
+		if err != nil {
+			log.Printf("Failed to fetch profile: %v\n", err)
+			http.Error(w, "Failed to fetch profile", http.StatusInternalServerError)
+			return
+		}
+		if profile == nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+	}
+}
+
+// validProfileText reports whether text from a profile field fits in max characters and holds
+// no control characters other than line breaks, which only the bio may contain
+func validProfileText(text string, max int, multiline bool) bool {
+	if !utf8.ValidString(text) || utf8.RuneCountInString(text) > max {
+		return false
+	}
+	return !strings.ContainsFunc(text, func(r rune) bool {
+		return unicode.IsControl(r) && !(multiline && (r == '\n' || r == '\r' || r == '\t'))
+	})
+}
+
+// EditProfileHandler updates the display name and bio of the current user
+func EditProfileHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			DisplayName string `json:"display_name"`
+			Bio         string `json:"bio"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		req.DisplayName = strings.TrimSpace(req.DisplayName)
+		req.Bio = strings.TrimSpace(req.Bio)
+		if !validProfileText(req.DisplayName, maxDisplayName, false) {
+			http.Error(w, fmt.Sprintf("Display name must be at most %d characters on one line", maxDisplayName), http.StatusBadRequest)
+			return
+		}
+		if !validProfileText(req.Bio, maxBio, true) {
+			http.Error(w, fmt.Sprintf("Bio must be at most %d characters", maxBio), http.StatusBadRequest)
+			return
+		}
+
+		user := CurrentUser(r)
+		if _, err := db.Exec("UPDATE users SET display_name = ?, bio = ? WHERE id = ?", req.DisplayName, req.Bio, user.ID); err != nil {
+			log.Printf("Failed to update profile: %v\n", err)
+			http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+			return
+		}
+
+		profile, err := queryProfile(db, user.Username)
+		if err != nil || profile == nil {
+			log.Printf("Failed to fetch profile: %v\n", err)
+			http.Error(w, "Failed to fetch profile", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+	}
+}
+
+// AvatarHandler serves a generated SVG avatar for the user named in the path: the initial of
+// their display name or username on a background colour derived from the username
+func AvatarHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var username, displayName string
+		err := db.QueryRow("SELECT username, display_name FROM users WHERE username = ? AND deleted_at IS NULL", r.PathValue("username")).Scan(&username, &displayName)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to fetch avatar: %v\n", err)
+			http.Error(w, "Failed to fetch avatar", http.StatusInternalServerError)
+			return
+		}
+
+		name := displayName
+		if name == "" {
+			name = username
+		}
+		initial, _ := utf8.DecodeRuneInString(name)
+		hash := fnv.New32a()
+		hash.Write([]byte(username))
+
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="96" height="96" viewBox="0 0 96 96">`+
+			`<rect width="96" height="96" rx="48" fill="hsl(%d, 55%%, 50%%)"/>`+
+			`<text x="48" y="48" dy="0.35em" text-anchor="middle" font-family="sans-serif" font-size="44" fill="#fff">%s</text></svg>`,
+			hash.Sum32()%360, html.EscapeString(string(unicode.ToUpper(initial))))
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// reactionTarget describes a reactions table and the table of the content it reacts to
+type reactionTarget struct {
+	table  string // reactions table
+	column string // column referencing the reacted content
+	parent string // table holding the reacted content
+	live   string // condition on the parent table matching content that can be reacted to
+
+	owner       string // query for the author of the content, its post and the post's title
+	notified    string // condition on notifications matching those about the content
+	description string // how notifications refer to the content, given the post title
+}
+
+var (
+	postReactionTarget = reactionTarget{table: "post_reactions", column: "post_id", parent: "posts",
+		live:        "deleted_at IS NULL AND status = 'approved'",
+		owner:       "SELECT user_id, id, title FROM posts WHERE id = ?",
+		notified:    "post_id = ? AND comment_id IS NULL",
+		description: "your post %q"}
+	commentReactionTarget = reactionTarget{table: "comment_reactions", column: "comment_id", parent: "comments",
+		live:        "deleted_at IS NULL AND post_id IN (SELECT id FROM posts WHERE deleted_at IS NULL AND status = 'approved')",
+		owner:       "SELECT comments.user_id, comments.post_id, posts.title FROM comments JOIN posts ON posts.id = comments.post_id WHERE comments.id = ?",
+		notified:    "comment_id = ?",
+		description: "your comment on %q"}
+)
+
+// errReactionTargetNotFound is returned when reacting to a post or comment that does not exist, was deleted or is not published
+var errReactionTargetNotFound = errors.New("reaction target not found")
+
+// ReactionResult is the state of a post or comment after a reaction was toggled
+type ReactionResult struct {
+	PostID         int    `json:"post_id,omitempty"`
+	CommentID      int    `json:"comment_id,omitempty"`
+	Likes          int    `json:"likes"`
+	Dislikes       int    `json:"dislikes"`
+	ViewerReaction string `json:"viewer_reaction"` // "LIKE", "DISLIKE" or empty when removed
+}
+
+// toggleReaction applies a reaction atomically: reacting again with the same type removes
+// the reaction, reacting with the opposite type switches it. The author of the content is
+// notified of new reactions and the new counts are published to live viewers.
+func toggleReaction(db *sql.DB, target reactionTarget, user *SessionUser, targetID int, reactionType string) (*ReactionResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Removing an identical reaction is the toggle-off case and also takes the write lock
+	// for the rest of the transaction
+	res, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id = ? AND %s = ? AND reaction_type = ?", target.table, target.column),
+		user.ID, targetID, reactionType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove reaction: %v", err)
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if removed == 0 {
+		var exists bool
+		err = tx.QueryRow(fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE id = ? AND %s)", target.parent, target.live), targetID).Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check reaction target: %v", err)
+		}
+		if !exists {
+			return nil, errReactionTargetNotFound
+		}
+
+		query := fmt.Sprintf(`INSERT INTO %[1]s (user_id, %[2]s, reaction_type) VALUES (?, ?, ?)
+			ON CONFLICT (user_id, %[2]s) DO UPDATE SET reaction_type = excluded.reaction_type`, target.table, target.column)
+		if _, err := tx.Exec(query, user.ID, targetID, reactionType); err != nil {
+			return nil, fmt.Errorf("failed to store reaction: %v", err)
+		}
+	}
+
+	// Any unread notification about the user's previous reaction to the content is replaced
+	// by one about the new reaction, or withdrawn with the reaction
+	_, err = tx.Exec("DELETE FROM notifications WHERE kind = ? AND actor_id = ? AND read_at IS NULL AND "+target.notified,
+		notifyReaction, user.ID, targetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to withdraw reaction notification: %v", err)
+	}
+	var authorID, postID int
+	var title string
+	if err := tx.QueryRow(target.owner, targetID).Scan(&authorID, &postID, &title); err != nil {
+		return nil, fmt.Errorf("failed to fetch reaction target: %v", err)
+	}
+	notifications := newNotifier(tx, user.ID, user.Username)
+	if removed == 0 {
+		verb := "liked"
+		if reactionType == "DISLIKE" {
+			verb = "disliked"
+		}
+		n := Notification{Kind: notifyReaction, PostID: postID, Message: fmt.Sprintf("%s %s "+target.description, user.Username, verb, title)}
+		if target.column == "comment_id" {
+			n.CommentID = targetID
+		}
+		if err := notifications.notify(authorID, n); err != nil {
+			return nil, err
+		}
+	}
+
+	result := ReactionResult{}
+	query := fmt.Sprintf(`
+		SELECT
+			COUNT(CASE WHEN reaction_type = 'LIKE' THEN 1 END),
+			COUNT(CASE WHEN reaction_type = 'DISLIKE' THEN 1 END),
+			COALESCE(MAX(CASE WHEN user_id = ? THEN reaction_type END), '')
+		FROM %s
+		WHERE %s = ?`, target.table, target.column)
+	if err := tx.QueryRow(query, user.ID, targetID).Scan(&result.Likes, &result.Dislikes, &result.ViewerReaction); err != nil {
+		return nil, fmt.Errorf("failed to count reactions: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	notifications.sendEmails()
+
+	counts := reactionCounts{Likes: result.Likes, Dislikes: result.Dislikes}
+	if target.column == "comment_id" {
+		counts.CommentID = targetID
+	} else {
+		counts.PostID = targetID
+	}
+	publishReaction(db, postID, counts)
+	return &result, nil
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxReportReason bounds the length of the reason given with a report
+const maxReportReason = 500
+
+// ReportHandler lets a user flag a post or comment for moderators, given by post_id or
+// comment_id, with a reason
+func ReportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			PostID    int    `json:"post_id"`
+			CommentID int    `json:"comment_id"`
+			Reason    string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		target, targetID := "post", req.PostID
+		if req.CommentID != 0 {
+			target, targetID = "comment", req.CommentID
+		}
+		if (req.PostID == 0) == (req.CommentID == 0) {
+			http.Error(w, "Exactly one of post_id or comment_id is required", http.StatusBadRequest)
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if req.Reason == "" || len(req.Reason) > maxReportReason {
+			http.Error(w, fmt.Sprintf("A reason of at most %d characters is required", maxReportReason), http.StatusBadRequest)
+			return
+		}
+
+		// Only content the reporter can see may be reported, so reports do not reveal
+		// whether hidden content exists
+		postColumn := "id"
+		if target == "comment" {
+			postColumn = "post_id"
+		}
+		var postID int
+		visible := false
+		err := db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id = ? AND deleted_at IS NULL", postColumn, contentTables[target]), targetID).Scan(&postID)
+		if err == nil {
+			visible, err = postVisible(db, postID, CurrentUser(r))
+		}
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Failed to check reported %s: %v\n", target, err)
+			http.Error(w, "Failed to store report", http.StatusInternalServerError)
+			return
+		}
+		if !visible {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		res, err := db.Exec(`INSERT INTO reports (target_type, target_id, reporter_id, reason) VALUES (?, ?, ?, ?)
+			ON CONFLICT (target_type, target_id, reporter_id) WHERE status = 'open' DO NOTHING`,
+			target, targetID, CurrentUser(r).ID, req.Reason)
+		if err != nil {
+			log.Printf("Failed to store report: %v\n", err)
+			http.Error(w, "Failed to store report", http.StatusInternalServerError)
+			return
+		}
+		if stored, _ := res.RowsAffected(); stored == 0 {
+			http.Error(w, "You already reported this "+target, http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Report received"})
+	}
+}
+
+// ReportEntry is a single report inside a ReportGroup
+type ReportEntry struct {
+	ID        int       `json:"id"`
+	Reporter  string    `json:"reporter"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReportGroup gathers the open reports about one post or comment
+type ReportGroup struct {
+	TargetType      string        `json:"target_type"` // "post" or "comment"
+	TargetID        int           `json:"target_id"`
+	PostID          int           `json:"post_id"` // the post itself, or the post a comment belongs to
+	AuthorID        int           `json:"author_id"`
+	Author          string        `json:"author"`
+	Excerpt         string        `json:"excerpt"`
+	Deleted         bool          `json:"deleted"`
+	ReportCount     int           `json:"report_count"`
+	FirstReportedAt time.Time     `json:"first_reported_at"`
+	LastReportedAt  time.Time     `json:"last_reported_at"`
+	Reports         []ReportEntry `json:"reports"`
+
+	firstReportID int
+}
+
+// ModerationQueueHandler lists the open reports grouped by target, oldest first
+func ModerationQueueHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		page, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		groups, next, err := queryReportGroups(db, page)
+		if err != nil {
+			log.Printf("Failed to fetch moderation queue: %v\n", err)
+			http.Error(w, "Failed to fetch moderation queue", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Page{Items: groups, NextCursor: next})
+	}
+}
+
+// queryReportGroups fetches one page of open report groups, ordered by their first report
+func queryReportGroups(db *sql.DB, page pageParams) ([]ReportGroup, string, error) {
+	query := `
+		SELECT q.target_type, q.target_id, COALESCE(p.id, c.post_id, 0),
+			COALESCE(a.id, 0), COALESCE(a.username, ''),
+			substr(COALESCE(p.title || ': ' || p.content, c.content, ''), 1, 200),
+			COALESCE(p.deleted_at, c.deleted_at) IS NOT NULL,
+			q.report_count, q.first_reported_at, q.first_report_id, q.last_reported_at, q.reports
+		FROM (
+			SELECT r.target_type, r.target_id, COUNT(*) AS report_count,
+				MIN(r.created_at) AS first_reported_at, MIN(r.id) AS first_report_id, MAX(r.created_at) AS last_reported_at,
+				json_group_array(json_object('id', r.id, 'reporter', COALESCE(u.username, ''), 'reason', r.reason,
+					'created_at', strftime('%Y-%m-%dT%H:%M:%SZ', r.created_at))) AS reports
+			FROM reports r
+			LEFT JOIN users u ON u.id = r.reporter_id
+			WHERE r.status = 'open'
+			GROUP BY r.target_type, r.target_id
+		) q
+		LEFT JOIN posts p ON q.target_type = 'post' AND p.id = q.target_id
+		LEFT JOIN comments c ON q.target_type = 'comment' AND c.id = q.target_id
+		LEFT JOIN users a ON a.id = COALESCE(p.user_id, c.user_id)`
+	var args []interface{}
+	if condition, conditionArgs := keysetCondition(page, "q.first_reported_at", "q.first_report_id"); condition != "" {
+		query += " WHERE " + condition
+		args = append(args, conditionArgs...)
+	}
+	direction, reverse := pageOrder(page, false)
+	query += fmt.Sprintf(" ORDER BY q.first_reported_at %[1]s, q.first_report_id %[1]s LIMIT ?", direction)
+	args = append(args, page.Limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	groups := []ReportGroup{}
+	for rows.Next() {
+		var group ReportGroup
+		var firstReportedAt, lastReportedAt, reports string
+		err := rows.Scan(&group.TargetType, &group.TargetID, &group.PostID, &group.AuthorID, &group.Author,
+			&group.Excerpt, &group.Deleted, &group.ReportCount, &firstReportedAt, &group.firstReportID, &lastReportedAt, &reports)
+		if err != nil {
+			return nil, "", err
+		}
+		// Aggregates lose the DATETIME column type, so the driver returns them as text
+		if group.FirstReportedAt, err = time.Parse(sqliteTimestampLayout, firstReportedAt); err != nil {
+			return nil, "", err
+		}
+		if group.LastReportedAt, err = time.Parse(sqliteTimestampLayout, lastReportedAt); err != nil {
+			return nil, "", err
+		}
+		if err := json.Unmarshal([]byte(reports), &group.Reports); err != nil {
+			return nil, "", fmt.Errorf("failed to decode reports on %s %d: %v", group.TargetType, group.TargetID, err)
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	groups, next := finishPage(groups, page, reverse, func(g ReportGroup) (time.Time, int) { return g.FirstReportedAt, g.firstReportID })
+	return groups, next, nil
+}
+
+// ModerationActionHandler resolves every open report on a post or comment with one of the
+// actions dismiss, hide (remove the content) or ban_author. The action is recorded in the
+// moderation log together with the optional note.
+func ModerationActionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			TargetType string `json:"target_type"`
+			TargetID   int    `json:"target_id"`
+			Action     string `json:"action"`
+			Note       string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TargetID == 0 {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		table, ok := contentTables[req.TargetType]
+		if !ok {
+			http.Error(w, "Invalid target_type", http.StatusBadRequest)
+			return
+		}
+		if req.Action != actionDismiss && req.Action != actionHide && req.Action != actionBanAuthor {
+			http.Error(w, "Invalid action: must be dismiss, hide or ban_author", http.StatusBadRequest)
+			return
+		}
+
+		resolved, err := resolveReports(db, CurrentUser(r), table, req.TargetID, req.Action, strings.TrimSpace(req.Note))
+		switch {
+		case errors.Is(err, errContentNotFound):
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errCannotSanctionStaff):
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			log.Printf("Failed to apply moderation action: %v\n", err)
+			http.Error(w, "Failed to apply moderation action", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"target_type":      req.TargetType,
+			"target_id":        req.TargetID,
+			"action":           req.Action,
+			"resolved_reports": resolved,
+		})
+	}
+}
+
+// resolveReports applies a moderation action to a post or comment, closes its open reports
+// and records the action, all in one transaction. It returns the number of reports closed.
+func resolveReports(db *sql.DB, moderator *SessionUser, table string, targetID int, action, note string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var authorID int
+	err = tx.QueryRow(fmt.Sprintf("SELECT user_id FROM %s WHERE id = ?", table), targetID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		return 0, errContentNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	status := "actioned"
+	switch action {
+	case actionDismiss:
+		status = "dismissed"
+	case actionHide:
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET deleted_at = COALESCE(deleted_at, CURRENT_TIMESTAMP) WHERE id = ?", table), targetID)
+	case actionBanAuthor:
+		reason := note
+		if reason == "" {
+			reason = "Banned for reported " + targetType(table)
+		}
+		_, err = sanctionUser(tx, authorID, moderator.ID, sanctionBan, reason, nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`UPDATE reports SET status = ?, resolved_at = CURRENT_TIMESTAMP, resolved_by = ?
+		WHERE target_type = ? AND target_id = ? AND status = 'open'`, status, moderator.ID, targetType(table), targetID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve reports: %v", err)
+	}
+	resolved, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	details := fmt.Sprintf("resolved %d report(s)", resolved)
+	if note != "" {
+		details += ": " + note
+	}
+	if err := recordModeration(tx, moderator.ID, action, targetType(table), targetID, details); err != nil {
+		return 0, err
+	}
+	return resolved, tx.Commit()
+}
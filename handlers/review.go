@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Post statuses stored in posts.status
+const (
+	postPending  = "pending"
+	postApproved = "approved"
+	postRejected = "rejected"
+)
+
+// isTrusted reports whether a user's posts are published without review. Everyone is
+// trusted unless pre-moderation is enabled; then moderators are, and users whose account
+// is old enough and who have enough approved posts.
+func isTrusted(db *sql.DB, user *SessionUser) (bool, error) {
+	if !preModeration || user.Can(PermModerateContent) {
+		return true, nil
+	}
+
+	var joined time.Time
+	var approved int
+	err := db.QueryRow(`SELECT created_at,
+			(SELECT COUNT(*) FROM posts WHERE user_id = users.id AND status = 'approved' AND deleted_at IS NULL)
+		FROM users WHERE id = ?`, user.ID).Scan(&joined, &approved)
+	if err != nil {
+		return false, err
+	}
+	return time.Since(joined) >= trustAccountAge && approved >= trustApprovedPosts, nil
+}
+
+// newPostStatus returns the status a post by user starts in
+func newPostStatus(db *sql.DB, user *SessionUser) (string, error) {
+	trusted, err := isTrusted(db, user)
+	if err != nil {
+		return "", fmt.Errorf("failed to check trust: %v", err)
+	}
+	if trusted {
+		return postApproved, nil
+	}
+	return postPending, nil
+}
+
+// postVisible reports whether viewer, nil for visitors, may see a post and its comments.
+// Deleted posts are hidden from everyone, and posts that are not published from all but
+// their author and moderators.
+func postVisible(q queryRower, postID int, viewer *SessionUser) (bool, error) {
+	var authorID int
+	var status string
+	err := q.QueryRow("SELECT user_id, status FROM posts WHERE id = ? AND deleted_at IS NULL", postID).Scan(&authorID, &status)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return status == postApproved || viewer != nil && (viewer.ID == authorID || viewer.Can(PermModerateContent)), nil
+}
+
+// PendingPostsHandler lists the posts waiting for review, newest first
+func PendingPostsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		page, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		posts, next, err := queryPosts(db, postFilter{Status: postPending}, page, CurrentUser(r).ID)
+		if err != nil {
+			log.Printf("Failed to fetch pending posts: %v\n", err)
+			http.Error(w, "Failed to fetch pending posts", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Page{Items: posts, NextCursor: next})
+	}
+}
+
+// errNotPending is returned when reviewing a post that is not waiting for review
+var errNotPending = errors.New("post is not pending review")
+
+// ReviewPostHandler approves or rejects a pending post and notifies its author
+func ReviewPostHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			PostID   int    `json:"post_id"`
+			Decision string `json:"decision"` // "approve" or "reject"
+			Reason   string `json:"reason"`   // shown to the author
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PostID == 0 {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var status string
+		switch req.Decision {
+		case "approve":
+			status = postApproved
+		case "reject":
+			status = postRejected
+		default:
+			http.Error(w, "Invalid decision: must be approve or reject", http.StatusBadRequest)
+			return
+		}
+
+		err := reviewPost(db, CurrentUser(r), req.PostID, status, strings.TrimSpace(req.Reason))
+		switch {
+		case errors.Is(err, errContentNotFound):
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errNotPending):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			log.Printf("Failed to review post: %v\n", err)
+			http.Error(w, "Failed to review post", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"post_id": req.PostID, "status": status})
+	}
+}
+
+// reviewPost moves a pending post to status, notifies the author and records the decision
+// in the moderation log, all in one transaction. Users mentioned in an approved post are
+// notified as if it was just posted.
+func reviewPost(db *sql.DB, moderator *SessionUser, postID int, status, reason string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var authorID int
+	var title string
+	err = tx.QueryRow(`UPDATE posts SET status = ?, reviewed_by = ?, reviewed_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = 'pending' AND deleted_at IS NULL RETURNING user_id, title`,
+		status, moderator.ID, postID).Scan(&authorID, &title)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = ? AND deleted_at IS NULL)", postID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return errContentNotFound
+		}
+		return errNotPending
+	}
+	if err != nil {
+		return err
+	}
+
+	action, kind, message := actionApprove, notifyPostApproved, fmt.Sprintf("Your post %q was approved", title)
+	if status == postRejected {
+		action, kind, message = actionReject, notifyPostRejected, fmt.Sprintf("Your post %q was rejected", title)
+		if reason != "" {
+			message += ": " + reason
+		}
+	}
+	review := newNotifier(tx, moderator.ID, moderator.Username)
+	if err := review.notify(authorID, Notification{Kind: kind, PostID: postID, Message: message}); err != nil {
+		return err
+	}
+
+	var author string
+	if err := tx.QueryRow("SELECT username FROM users WHERE id = ?", authorID).Scan(&author); err != nil {
+		return err
+	}
+	mentions := newNotifier(tx, authorID, author)
+	if status == postApproved {
+		mentioned, err := postMentions(tx, postID)
+		if err != nil {
+			return err
+		}
+		n := Notification{Kind: notifyMention, PostID: postID, Message: fmt.Sprintf("%s mentioned you in the post %q", author, title)}
+		if err := mentions.notifyMentions(mentioned, n); err != nil {
+			return err
+		}
+	}
+
+	if err := recordModeration(tx, moderator.ID, action, "post", postID, reason); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	review.sendEmails()
+	mentions.sendEmails()
+	if status == postApproved {
+		publishPost(db, postID)
+	}
+	return nil
+}
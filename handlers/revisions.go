@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// errContentNotFound is returned when changing a post or comment that does not exist or was deleted
+	errContentNotFound = errors.New("content not found")
+	// errNotAuthor is returned when changing a post or comment written by another user
+	errNotAuthor = errors.New("only the author can change this content")
+	// errContentLocked is returned when editing a post or comment a moderator locked
+	errContentLocked = errors.New("this content is locked")
+)
+
+// Revision is a previous version of an edited post or comment
+type Revision struct {
+	ID        int       `json:"id"`
+	EditorID  int       `json:"editor_id"`
+	Editor    string    `json:"editor"`
+	Title     string    `json:"title,omitempty"` // posts only
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"` // when the edit replaced this version
+}
+
+// revisionSource describes a table of editable content and the table keeping its revisions
+type revisionSource struct {
+	table     string // table holding the content
+	revisions string // table holding its previous versions
+	column    string // revisions column referencing the content
+	title     string // title column, empty when the content has none
+	post      string // query for the post the content belongs to, for its mention records
+}
+
+var (
+	postRevisionSource = revisionSource{table: "posts", revisions: "post_revisions", column: "post_id", title: "title",
+		post: "SELECT id FROM posts WHERE id = ?"}
+	commentRevisionSource = revisionSource{table: "comments", revisions: "comment_revisions", column: "comment_id",
+		post: "SELECT post_id FROM comments WHERE id = ?"}
+)
+
+// queryRower is implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// contentAccessError explains why a change guarded by author, deleted_at and locked_at matched no row
+func contentAccessError(q queryRower, table string, id, userID int) error {
+	var authorID int
+	var locked bool
+	err := q.QueryRow(fmt.Sprintf("SELECT user_id, locked_at IS NOT NULL FROM %s WHERE id = ? AND deleted_at IS NULL", table), id).
+		Scan(&authorID, &locked)
+	if err == sql.ErrNoRows {
+		return errContentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if authorID != userID {
+		return errNotAuthor
+	}
+	if locked {
+		return errContentLocked
+	}
+	return fmt.Errorf("%s %d was changed concurrently", table, id)
+}
+
+// reviseContent stores the current version of a post or comment as a revision and replaces
+// it with the new one, updating its mention records and rendered HTML. It returns the ids of
+// the users the new version mentions for the first time. A post is also given status unless
+// it is empty, in the same transaction. Only the author can edit, and deleted or locked
+// content cannot be edited.
+func reviseContent(db *sql.DB, source revisionSource, id, editorID int, title, content, status string) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Copying the current version first also takes the write lock for the update below
+	columns := "content"
+	if source.title != "" {
+		columns = source.title + ", content"
+	}
+	query := fmt.Sprintf(`INSERT INTO %[1]s (%[2]s, editor_id, %[3]s)
+		SELECT id, ?, %[3]s FROM %[4]s WHERE id = ? AND user_id = ? AND deleted_at IS NULL AND locked_at IS NULL`,
+		source.revisions, source.column, columns, source.table)
+	res, err := tx.Exec(query, editorID, id, editorID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store revision: %v", err)
+	}
+	if stored, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if stored == 0 {
+		return nil, contentAccessError(tx, source.table, id, editorID)
+	}
+
+	if source.title != "" {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ?, content = ?, edited_at = CURRENT_TIMESTAMP WHERE id = ?", source.table, source.title),
+			title, content, id)
+	} else {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET content = ?, edited_at = CURRENT_TIMESTAMP WHERE id = ?", source.table),
+			content, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update %s: %v", source.table, err)
+	}
+	if status != "" {
+		if _, err := tx.Exec("UPDATE posts SET status = ? WHERE id = ?", status, id); err != nil {
+			return nil, fmt.Errorf("failed to update post status: %v", err)
+		}
+	}
+
+	var postID, commentID int
+	if err := tx.QueryRow(source.post, id).Scan(&postID); err != nil {
+		return nil, err
+	}
+	text := content
+	if source.title != "" {
+		text = title + "\n" + content
+	} else {
+		commentID = id
+	}
+	mentioned, err := storeMentions(tx, postID, commentID, text)
+	if err != nil {
+		return nil, err
+	}
+	if err := cacheContentHTML(tx, postID, commentID, content); err != nil {
+		return nil, err
+	}
+	return mentioned, tx.Commit()
+}
+
+// softDelete marks a post or comment as deleted while keeping the row and its revisions.
+// Authors can delete their own content; users allowed to moderate can delete anything,
+// which is recorded in the moderation log.
+func softDelete(db *sql.DB, table string, id int, user *SessionUser) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("UPDATE %s SET deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL", table)
+	args := []interface{}{id}
+	if !user.Can(PermModerateContent) {
+		query += " AND user_id = ?"
+		args = append(args, user.ID)
+	}
+
+	var authorID int
+	err = tx.QueryRow(query+" RETURNING user_id", args...).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		return contentAccessError(tx, table, id, user.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if authorID != user.ID {
+		if err := recordModeration(tx, user.ID, actionDelete, targetType(table), id, ""); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// writeContentError responds to a failed edit or delete with the matching status code
+func writeContentError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, errContentNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, errNotAuthor), errors.Is(err, errContentLocked):
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("Failed to %s: %v\n", action, err)
+		http.Error(w, "Failed to "+action, http.StatusInternalServerError)
+	}
+}
+
+// revisionsHandler lists the previous versions of a post or comment, newest first.
+// The id is read from the query parameter named after the revisions column.
+func revisionsHandler(db *sql.DB, source revisionSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := strconv.Atoi(r.URL.Query().Get(source.column))
+		if err != nil {
+			http.Error(w, "Invalid "+source.column, http.StatusBadRequest)
+			return
+		}
+
+		page, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The history of deleted content is not public, and that of other content is as
+		// visible as the post it belongs to
+		var exists bool
+		err = db.QueryRow(fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE id = ? AND deleted_at IS NULL)", source.table), id).Scan(&exists)
+		if err != nil {
+			log.Printf("Failed to check %s: %v\n", source.table, err)
+			http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+			return
+		}
+		visible := false
+		if exists {
+			var postID int
+			err := db.QueryRow(source.post, id).Scan(&postID)
+			if err == nil {
+				visible, err = postVisible(db, postID, CurrentUser(r))
+			}
+			if err != nil {
+				log.Printf("Failed to check post: %v\n", err)
+				http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+				return
+			}
+		}
+		if !visible {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		revisions, next, err := queryRevisions(db, source, id, page)
+		if err != nil {
+			log.Printf("Failed to fetch revisions: %v\n", err)
+			http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Page{Items: revisions, NextCursor: next})
+	}
+}
+
+// GetPostRevisionsHandler lists the previous versions of a post given by post_id
+func GetPostRevisionsHandler(db *sql.DB) http.HandlerFunc {
+	return revisionsHandler(db, postRevisionSource)
+}
+
+// GetCommentRevisionsHandler lists the previous versions of a comment given by comment_id
+func GetCommentRevisionsHandler(db *sql.DB) http.HandlerFunc {
+	return revisionsHandler(db, commentRevisionSource)
+}
+
+// queryRevisions fetches one page of revisions, newest first
+func queryRevisions(db *sql.DB, source revisionSource, id int, page pageParams) ([]Revision, string, error) {
+	titleColumn := "''"
+	if source.title != "" {
+		titleColumn = "r.title"
+	}
+	query := fmt.Sprintf(`
+		SELECT r.id, r.editor_id, COALESCE(users.username, ''), %s, r.content, r.created_at
+		FROM %s r
+		LEFT JOIN users ON users.id = r.editor_id
+		WHERE r.%s = ?`, titleColumn, source.revisions, source.column)
+	args := []interface{}{id}
+	if condition, conditionArgs := keysetCondition(page, "r.created_at", "r.id"); condition != "" {
+		query += " AND " + condition
+		args = append(args, conditionArgs...)
+	}
+	direction, reverse := pageOrder(page, true)
+	query += fmt.Sprintf(" ORDER BY r.created_at %[1]s, r.id %[1]s LIMIT ?", direction)
+	args = append(args, page.Limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		var revision Revision
+		err := rows.Scan(&revision.ID, &revision.EditorID, &revision.Editor, &revision.Title, &revision.Content, &revision.CreatedAt)
+		if err != nil {
+			return nil, "", err
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	revisions, next := finishPage(revisions, page, reverse, func(r Revision) (time.Time, int) { return r.CreatedAt, r.ID })
+	return revisions, next, nil
+}
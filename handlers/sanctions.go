@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sanction kinds stored in user_sanctions.kind
+const (
+	sanctionBan     = "ban"     // the account can no longer log in
+	sanctionSuspend = "suspend" // like a ban, but always until a date
+	sanctionMute    = "mute"    // the account can read but not post, comment or react
+)
+
+// sanctionInEffect matches user_sanctions rows that currently apply; it takes the current time as its argument
+const sanctionInEffect = `user_sanctions.revoked_at IS NULL
+	AND (user_sanctions.expires_at IS NULL OR user_sanctions.expires_at > ?)`
+
+// lockedOutCondition matches users who are banned or suspended; it takes the current time as its argument
+const lockedOutCondition = `EXISTS (SELECT 1 FROM user_sanctions
+	WHERE user_sanctions.user_id = users.id AND user_sanctions.kind IN ('ban', 'suspend')
+	AND ` + sanctionInEffect + `)`
+
+// mutedCondition matches users who are muted; it takes the current time as its argument
+const mutedCondition = `EXISTS (SELECT 1 FROM user_sanctions
+	WHERE user_sanctions.user_id = users.id AND user_sanctions.kind = 'mute'
+	AND ` + sanctionInEffect + `)`
+
+// errCannotSanctionStaff is returned when a moderator tries to sanction a moderator or admin
+var errCannotSanctionStaff = errors.New("moderators and admins cannot be sanctioned")
+
+// Sanction is a restriction placed on an account
+type Sanction struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Kind      string     `json:"kind"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"` // nil for permanent sanctions
+	CreatedBy int        `json:"created_by"`
+	Moderator string     `json:"moderator"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Active    bool       `json:"active"`
+}
+
+// sanctionQuery selects the columns read by scanSanction; its first argument is the current time
+const sanctionQuery = `
+	SELECT user_sanctions.id, user_sanctions.user_id, user_sanctions.kind, user_sanctions.reason,
+		user_sanctions.expires_at, user_sanctions.created_by, COALESCE(users.username, ''),
+		user_sanctions.created_at, user_sanctions.revoked_at, ` + sanctionInEffect + `
+	FROM user_sanctions
+	LEFT JOIN users ON users.id = user_sanctions.created_by`
+
+// scanSanction reads a sanction selected with sanctionQuery
+func scanSanction(row rowScanner) (*Sanction, error) {
+	var s Sanction
+	var expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&s.ID, &s.UserID, &s.Kind, &s.Reason, &expiresAt, &s.CreatedBy, &s.Moderator, &s.CreatedAt, &revokedAt, &s.Active)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		s.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		s.RevokedAt = &revokedAt.Time
+	}
+	return &s, nil
+}
+
+// activeSanction returns the sanction of one of the given kinds currently applying to a user,
+// preferring the one that lasts longest, or nil when there is none
+func activeSanction(db *sql.DB, userID int, kinds ...string) (*Sanction, error) {
+	now := time.Now()
+	placeholders := make([]string, len(kinds))
+	args := []interface{}{now, userID, now}
+	for i, kind := range kinds {
+		placeholders[i] = "?"
+		args = append(args, kind)
+	}
+
+	query := sanctionQuery + `
+		WHERE user_sanctions.user_id = ? AND ` + sanctionInEffect + `
+		AND user_sanctions.kind IN (` + strings.Join(placeholders, ", ") + `)
+		ORDER BY user_sanctions.expires_at IS NULL DESC, user_sanctions.expires_at DESC
+		LIMIT 1`
+	sanction, err := scanSanction(db.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sanction, err
+}
+
+// sanctionUser places a sanction on an account, replacing any sanction of the same kind in
+// effect, and returns its id. Bans and suspensions also end all of the account's sessions.
+func sanctionUser(tx *sql.Tx, userID, moderatorID int, kind, reason string, expiresAt *time.Time) (int64, error) {
+	var role Role
+	err := tx.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return 0, errContentNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch user %d: %v", userID, err)
+	}
+	if role != RoleUser {
+		return 0, errCannotSanctionStaff
+	}
+
+	_, err = tx.Exec("UPDATE user_sanctions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND kind = ? AND "+sanctionInEffect,
+		userID, kind, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to replace sanction: %v", err)
+	}
+
+	var expires interface{}
+	if expiresAt != nil {
+		expires = *expiresAt
+	}
+	res, err := tx.Exec("INSERT INTO user_sanctions (user_id, kind, reason, expires_at, created_by) VALUES (?, ?, ?, ?, ?)",
+		userID, kind, reason, expires, moderatorID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store sanction: %v", err)
+	}
+
+	if kind != sanctionMute {
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+			return 0, fmt.Errorf("failed to end sessions: %v", err)
+		}
+	}
+	return res.LastInsertId()
+}
+
+// writeSanctionError responds with 403 and the sanction that stops the user
+func writeSanctionError(w http.ResponseWriter, message string, sanction *Sanction) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(struct {
+		Error    string    `json:"error"`
+		Sanction *Sanction `json:"sanction"`
+	}{message, sanction})
+}
+
+// SanctionUserHandler bans, suspends or mutes a user given by user_id. The sanction lasts
+// until expires_at, or for duration; suspensions need one of them, bans and mutes without
+// either are permanent.
+func SanctionUserHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			UserID    int        `json:"user_id"`
+			Kind      string     `json:"kind"`
+			Reason    string     `json:"reason"`
+			ExpiresAt *time.Time `json:"expires_at"` // RFC 3339
+			Duration  string     `json:"duration"`   // such as "72h", instead of expires_at
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.Kind != sanctionBan && req.Kind != sanctionSuspend && req.Kind != sanctionMute {
+			http.Error(w, "Invalid kind: must be ban, suspend or mute", http.StatusBadRequest)
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if req.Reason == "" {
+			http.Error(w, "A reason is required", http.StatusBadRequest)
+			return
+		}
+
+		expiresAt := req.ExpiresAt
+		if req.Duration != "" {
+			duration, err := time.ParseDuration(req.Duration)
+			if err != nil || duration <= 0 || expiresAt != nil {
+				http.Error(w, "Invalid duration", http.StatusBadRequest)
+				return
+			}
+			expires := time.Now().Add(duration)
+			expiresAt = &expires
+		}
+		if expiresAt != nil {
+			if !expiresAt.After(time.Now()) {
+				http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+				return
+			}
+			// Stored in local time like the session expiries, so the text comparisons in SQL hold
+			local := expiresAt.Local()
+			expiresAt = &local
+		} else if req.Kind == sanctionSuspend {
+			http.Error(w, "A suspension needs expires_at or duration", http.StatusBadRequest)
+			return
+		}
+
+		sanctionID, err := applySanction(db, CurrentUser(r), req.UserID, req.Kind, req.Reason, expiresAt)
+		switch {
+		case errors.Is(err, errContentNotFound):
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errCannotSanctionStaff):
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			log.Printf("Failed to sanction user: %v\n", err)
+			http.Error(w, "Failed to sanction user", http.StatusInternalServerError)
+			return
+		}
+
+		sanction, err := scanSanction(db.QueryRow(sanctionQuery+" WHERE user_sanctions.id = ?", time.Now(), sanctionID))
+		if err != nil {
+			log.Printf("Failed to fetch sanction: %v\n", err)
+			http.Error(w, "Failed to fetch sanction", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(sanction)
+	}
+}
+
+// applySanction sanctions a user and records it in the moderation log in one transaction
+func applySanction(db *sql.DB, moderator *SessionUser, userID int, kind, reason string, expiresAt *time.Time) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	sanctionID, err := sanctionUser(tx, userID, moderator.ID, kind, reason, expiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	details := reason
+	if expiresAt != nil {
+		details += " (until " + expiresAt.UTC().Format(time.RFC3339) + ")"
+	}
+	if err := recordModeration(tx, moderator.ID, kind, "user", userID, details); err != nil {
+		return 0, err
+	}
+	return sanctionID, tx.Commit()
+}
+
+// RevokeSanctionHandler lifts a sanction given by id before it expires
+func RevokeSanctionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ID int `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		err := revokeSanction(db, CurrentUser(r), req.ID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "No sanction in effect with this id", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to revoke sanction: %v\n", err)
+			http.Error(w, "Failed to revoke sanction", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": req.ID, "message": "Sanction revoked"})
+	}
+}
+
+// revokeSanction ends a sanction in effect and records it in the moderation log. It returns
+// sql.ErrNoRows when there is no such sanction in effect.
+func revokeSanction(db *sql.DB, moderator *SessionUser, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var kind string
+	err = tx.QueryRow("UPDATE user_sanctions SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND "+sanctionInEffect+" RETURNING user_id, kind",
+		id, time.Now()).Scan(&userID, &kind)
+	if err != nil {
+		return err
+	}
+	if err := recordModeration(tx, moderator.ID, "un"+kind, "user", userID, fmt.Sprintf("sanction %d", id)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListSanctionsHandler returns every sanction of a user given by user_id, newest first
+func ListSanctionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+		if err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := db.Query(sanctionQuery+`
+			WHERE user_sanctions.user_id = ?
+			ORDER BY user_sanctions.created_at DESC, user_sanctions.id DESC`, time.Now(), userID)
+		if err != nil {
+			log.Printf("Failed to fetch sanctions: %v\n", err)
+			http.Error(w, "Failed to fetch sanctions", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		sanctions := []*Sanction{}
+		for rows.Next() {
+			sanction, err := scanSanction(rows)
+			if err != nil {
+				log.Printf("Failed to scan sanction row: %v\n", err)
+				http.Error(w, "Failed to fetch sanctions", http.StatusInternalServerError)
+				return
+			}
+			sanctions = append(sanctions, sanction)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to fetch sanctions: %v\n", err)
+			http.Error(w, "Failed to fetch sanctions", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sanctions)
+	}
+}
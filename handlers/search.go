@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Markers snippet() wraps matches in. Being control characters they survive HTML escaping
+// and are replaced by <mark> tags afterwards.
+const (
+	snippetMatchStart = "\x02"
+	snippetMatchEnd   = "\x03"
+)
+
+// snippetTokens is the approximate length of a snippet in words
+const snippetTokens = 16
+
+// SearchResult is a post or comment matching a search query
+type SearchResult struct {
+	Type      string    `json:"type"` // "post" or "comment"
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"` // the post itself, or the post a comment belongs to
+	PostTitle string    `json:"post_title"`
+	AuthorID  int       `json:"author_id"`
+	Author    string    `json:"author"`
+	Snippet   string    `json:"snippet"` // HTML-escaped, with the matched terms wrapped in <mark>
+	Rank      float64   `json:"rank"`    // lower is more relevant
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// searchFilter narrows down a search beyond the text query
+type searchFilter struct {
+	Type       string // "post", "comment" or empty for both
+	Author     string
+	CategoryID int
+	From       string // inclusive start date, as YYYY-MM-DD
+	Until      string // exclusive end date, as YYYY-MM-DD
+	Newest     bool   // order by date instead of relevance
+}
+
+// errEmptyQuery is returned for a search query without any term
+var errEmptyQuery = errors.New("search query must contain at least one term")
+
+// ftsQuery turns what a user typed into an FTS5 query. Quoted text matches as a phrase, a
+// trailing * matches words starting with the term and OR between terms matches either of
+// them; otherwise every term must appear. Anything else FTS5 would read as syntax is
+// matched as plain text.
+func ftsQuery(input string) (string, error) {
+	var terms []string
+	pendingOr := false
+	rest := strings.TrimSpace(input)
+	for rest != "" {
+		var term string
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				term, rest = rest[1:], ""
+			} else {
+				term, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(rest, func(r rune) bool { return unicode.IsSpace(r) || r == '"' })
+			if end < 0 {
+				end = len(rest)
+			}
+			term, rest = rest[:end], rest[end:]
+			if term == "OR" {
+				pendingOr = len(terms) > 0
+				rest = strings.TrimSpace(rest)
+				continue
+			}
+		}
+		rest = strings.TrimSpace(rest)
+
+		prefix := strings.HasSuffix(term, "*")
+		term = strings.TrimSpace(strings.TrimRight(term, "*"))
+		if !strings.ContainsFunc(term, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+			continue
+		}
+
+		term = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		if pendingOr {
+			term = "OR " + term
+			pendingOr = false
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		return "", errEmptyQuery
+	}
+	return strings.Join(terms, " "), nil
+}
+
+// highlightSnippet escapes a snippet for HTML and turns its match markers into <mark> tags
+func highlightSnippet(snippet string) string {
+	return strings.NewReplacer(snippetMatchStart, "<mark>", snippetMatchEnd, "</mark>").Replace(html.EscapeString(snippet))
+}
+
+// encodeSearchCursor builds the opaque cursor for the search results after offset
+func encodeSearchCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("offset|" + strconv.Itoa(offset)))
+}
+
+// decodeSearchCursor parses a cursor built by encodeSearchCursor
+func decodeSearchCursor(value string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return 0, errors.New("invalid cursor")
+	}
+	offsetStr, found := strings.CutPrefix(string(raw), "offset|")
+	offset, err := strconv.Atoi(offsetStr)
+	if !found || err != nil || offset < 0 {
+		return 0, errors.New("invalid cursor")
+	}
+	return offset, nil
+}
+
+// parseSearchDate reads a YYYY-MM-DD date from the query string; until dates are moved to
+// the following day so the range includes the whole day
+func parseSearchDate(value string, until bool) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	date, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return "", fmt.Errorf("invalid date %q: use YYYY-MM-DD", value)
+	}
+	if until {
+		date = date.AddDate(0, 0, 1)
+	}
+	return date.Format(time.DateOnly), nil
+}
+
+// SearchHandler runs a full-text search over published posts and comments. The query q
+// supports "phrases", prefix* matching and OR. Results can be narrowed down with type
+// (post or comment), author (a username), category (id or slug) and a from/to date range,
+// and are ordered by relevance unless sort=newest. Pages continue with the cursor parameter.
+func SearchHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		params := r.URL.Query()
+		match, err := ftsQuery(params.Get("q"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		limit, err := parseLimit(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offset := 0
+		if value := params.Get("cursor"); value != "" {
+			if offset, err = decodeSearchCursor(value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		filter := searchFilter{Type: params.Get("type"), Author: params.Get("author")}
+		if filter.Type != "" && filter.Type != "post" && filter.Type != "comment" {
+			http.Error(w, "Invalid type: must be post or comment", http.StatusBadRequest)
+			return
+		}
+		switch params.Get("sort") {
+		case "", "relevance":
+		case "newest":
+			filter.Newest = true
+		default:
+			http.Error(w, "Invalid sort: must be relevance or newest", http.StatusBadRequest)
+			return
+		}
+		if filter.From, err = parseSearchDate(params.Get("from"), false); err == nil {
+			filter.Until, err = parseSearchDate(params.Get("to"), true)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ref := params.Get("category"); ref != "" {
+			filter.CategoryID, err = findCategoryID(db, ref)
+			if errors.Is(err, errUnknownCategory) {
+				http.Error(w, "Category not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to resolve category: %v\n", err)
+				http.Error(w, "Failed to search", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		results, err := querySearch(db, match, filter, limit+1, offset)
+		if err != nil {
+			log.Printf("Failed to search: %v\n", err)
+			http.Error(w, "Failed to search", http.StatusInternalServerError)
+			return
+		}
+
+		next := ""
+		if len(results) > limit {
+			results = results[:limit]
+			next = encodeSearchCursor(offset + limit)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Page{Items: results, NextCursor: next})
+	}
+}
+
+// querySearch fetches the published posts and comments matching an FTS5 query
+func querySearch(db *sql.DB, match string, filter searchFilter, limit, offset int) ([]SearchResult, error) {
+	snippet := func(table string, column int) string {
+		return fmt.Sprintf("snippet(%s, %d, '%s', '%s', '…', %d)", table, column, snippetMatchStart, snippetMatchEnd, snippetTokens)
+	}
+
+	var branches []string
+	var args []interface{}
+	if filter.Type != "comment" {
+		// Matches in the title weigh more than matches in the body
+		branches = append(branches, `
+			SELECT 'post' AS type, p.id AS id, p.id AS post_id, p.title AS post_title, p.user_id AS user_id,
+				`+snippet("posts_fts", -1)+` AS snippet, bm25(posts_fts, 5.0, 1.0) AS rank, p.created_at AS created_at
+			FROM posts_fts
+			JOIN posts p ON p.id = posts_fts.rowid
+			WHERE posts_fts MATCH ? AND p.deleted_at IS NULL AND p.status = 'approved'`)
+		args = append(args, match)
+	}
+	if filter.Type != "post" {
+		branches = append(branches, `
+			SELECT 'comment' AS type, c.id AS id, c.post_id AS post_id, p.title AS post_title, c.user_id AS user_id,
+				`+snippet("comments_fts", 0)+` AS snippet, bm25(comments_fts) AS rank, c.created_at AS created_at
+			FROM comments_fts
+			JOIN comments c ON c.id = comments_fts.rowid
+			JOIN posts p ON p.id = c.post_id
+			WHERE comments_fts MATCH ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL AND p.status = 'approved'`)
+		args = append(args, match)
+	}
+
+	query := `
+		SELECT r.type, r.id, r.post_id, r.post_title, r.user_id, COALESCE(u.username, ''), r.snippet, r.rank, r.created_at
+		FROM (` + strings.Join(branches, " UNION ALL ") + `) r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE 1 = 1`
+	if filter.Author != "" {
+		query += " AND u.username = ?"
+		args = append(args, filter.Author)
+	}
+	if filter.CategoryID != 0 {
+		query += " AND EXISTS (SELECT 1 FROM post_categories pc WHERE pc.post_id = r.post_id AND pc.category_id = ?)"
+		args = append(args, filter.CategoryID)
+	}
+	if filter.From != "" {
+		query += " AND r.created_at >= ?"
+		args = append(args, filter.From)
+	}
+	if filter.Until != "" {
+		query += " AND r.created_at < ?"
+		args = append(args, filter.Until)
+	}
+	if filter.Newest {
+		query += " ORDER BY r.created_at DESC, r.rank, r.type DESC, r.id DESC"
+	} else {
+		query += " ORDER BY r.rank, r.created_at DESC, r.type DESC, r.id DESC"
+	}
+	query += " LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		err := rows.Scan(&result.Type, &result.ID, &result.PostID, &result.PostTitle, &result.AuthorID, &result.Author,
+			&result.Snippet, &result.Rank, &result.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		result.Snippet = highlightSnippet(result.Snippet)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// sessionRenewInterval limits how often an active session's expiry is pushed forward
+const sessionRenewInterval = 5 * time.Minute
+
+// setSessionCookie writes the session token cookie with the given expiry
+func setSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true, // Prevent JavaScript access for security
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
+	})
+}
+
+// clearSessionCookie expires the session token cookie in the browser
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0), // Expire the cookie
+		HttpOnly: true,
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
+	})
+}
+
+// renewSession slides the session expiry forward when it is being actively used
+func renewSession(db *sql.DB, w http.ResponseWriter, user *SessionUser) error {
+	expiresAt := time.Now().Add(sessionDuration)
+	if expiresAt.Sub(user.ExpiresAt) < sessionRenewInterval {
+		return nil
+	}
+
+	_, err := db.Exec("UPDATE sessions SET expires_at = ?, last_seen_at = ? WHERE uuid = ?", expiresAt, time.Now(), user.SessionID)
+	if err != nil {
+		return err
+	}
+
+	user.ExpiresAt = expiresAt
+	setSessionCookie(w, user.SessionID, expiresAt)
+	return nil
+}
+
+// CheckSessionHandler returns the user behind the current session and renews it
+func CheckSessionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, err := userFromSession(db, r)
+		if err != nil {
+			log.Println("Session lookup failed:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			http.Error(w, "No active session", http.StatusUnauthorized)
+			return
+		}
+
+		if err := renewSession(db, w, user); err != nil {
+			log.Println("Failed to renew session:", err)
+		}
+
+		response := struct {
+			ID        int       `json:"id"`
+			Username  string    `json:"username"`
+			Email     string    `json:"email"`
+			Role      Role      `json:"role"`
+			Muted     bool      `json:"muted"`
+			Verified  bool      `json:"email_verified"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}{
+			ID:        user.ID,
+			Username:  user.Username,
+			Email:     user.Email,
+			Role:      user.Role,
+			Muted:     user.Muted,
+			Verified:  user.Verified,
+			ExpiresAt: user.ExpiresAt,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// SessionInfo describes one of a user's active sessions without exposing its token
+type SessionInfo struct {
+	ID         string     `json:"id"`
+	CreatedAt  *time.Time `json:"created_at"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	Current    bool       `json:"current"`
+}
+
+// publicSessionID derives a stable identifier for a session that cannot be used as a token
+func publicSessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// clientIP returns the remote address of the request without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ListSessionsHandler lists the current user's active sessions
+func ListSessionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user := CurrentUser(r)
+
+		query := `
+			SELECT uuid, created_at, last_seen_at, expires_at, COALESCE(user_agent, ''), COALESCE(ip_address, '')
+			FROM sessions
+			WHERE user_id = ? AND expires_at > ?
+			ORDER BY last_seen_at DESC`
+
+		rows, err := db.Query(query, user.ID, time.Now())
+		if err != nil {
+			log.Printf("Failed to fetch sessions: %v\n", err)
+			http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		sessions := []SessionInfo{}
+		for rows.Next() {
+			var token string
+			var createdAt, lastSeenAt sql.NullTime
+			var session SessionInfo
+			if err := rows.Scan(&token, &createdAt, &lastSeenAt, &session.ExpiresAt, &session.UserAgent, &session.IPAddress); err != nil {
+				log.Printf("Failed to scan session row: %v\n", err)
+				http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+				return
+			}
+			if createdAt.Valid {
+				session.CreatedAt = &createdAt.Time
+			}
+			if lastSeenAt.Valid {
+				session.LastSeenAt = &lastSeenAt.Time
+			}
+			session.ID = publicSessionID(token)
+			session.Current = token == user.SessionID
+			sessions = append(sessions, session)
+		}
+
+		if err := rows.Err(); err != nil {
+			log.Printf("Row iteration error: %v\n", err)
+			http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	}
+}
+
+// RevokeSessionHandler deletes one of the current user's sessions by its public id
+func RevokeSessionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var data struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if data.ID == "" {
+			http.Error(w, "Missing session id", http.StatusBadRequest)
+			return
+		}
+
+		user := CurrentUser(r)
+
+		// Session ids are derived from the token, so match them against the user's own sessions
+		rows, err := db.Query("SELECT uuid FROM sessions WHERE user_id = ?", user.ID)
+		if err != nil {
+			log.Printf("Failed to fetch sessions: %v\n", err)
+			http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+			return
+		}
+		var target string
+		for rows.Next() {
+			var token string
+			if err := rows.Scan(&token); err != nil {
+				rows.Close()
+				log.Printf("Failed to scan session row: %v\n", err)
+				http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+				return
+			}
+			if publicSessionID(token) == data.ID {
+				target = token
+			}
+		}
+		rows.Close()
+
+		if target == "" {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM sessions WHERE uuid = ? AND user_id = ?", target, user.ID); err != nil {
+			log.Printf("Failed to revoke session: %v\n", err)
+			http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Session revoked",
+			"current": target == user.SessionID,
+		})
+	}
+}
+
+// RevokeOtherSessionsHandler logs the current user out everywhere except the current session
+func RevokeOtherSessionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user := CurrentUser(r)
+
+		res, err := db.Exec("DELETE FROM sessions WHERE user_id = ? AND uuid != ?", user.ID, user.SessionID)
+		if err != nil {
+			log.Printf("Failed to revoke sessions: %v\n", err)
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+		revoked, _ := res.RowsAffected()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Other sessions revoked",
+			"revoked": revoked,
+		})
+	}
+}
+
+// StartSessionJanitor periodically purges expired sessions until the returned stop function is called
+func StartSessionJanitor(db *sql.DB, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	purge := func() {
+		res, err := db.Exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now())
+		if err != nil {
+			log.Println("Failed to purge expired sessions:", err)
+			return
+		}
+		if purged, _ := res.RowsAffected(); purged > 0 {
+			log.Printf("Purged %d expired sessions", purged)
+		}
+	}
+
+	go func() {
+		purge()
+		for {
+			select {
+			case <-ticker.C:
+				purge()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
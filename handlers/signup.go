@@ -2,61 +2,93 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"forum/db"
 	"forum/models"
 	"log"
 	"net/http"
+	"net/mail"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt" 
 )
 
-// InsertUser inserts a new user into the database
-func InsertUser(user models.User) error {
+var (
+	// errInvalidEmail is returned when registering with something that is not an email address
+	errInvalidEmail = errors.New("invalid email address")
+	// errInvalidUsername is returned when registering with a username containing @, which
+	// could be mistaken for another user's email address, or brackets, which are kept for
+	// deleted accounts
+	errInvalidUsername = errors.New("usernames cannot contain @, [ or ]")
+)
+
+// validEmail reports whether email is a plain address users may register or switch to.
+// Addresses under the reserved .invalid domain are kept for deleted accounts.
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return false
+	}
+	domain := strings.ToLower(email[strings.LastIndexByte(email, '@')+1:])
+	return domain != "invalid" && !strings.HasSuffix(domain, ".invalid")
+}
+
+// InsertUser inserts a new user into the database and returns its id. The email address
+// still has to be confirmed before the user can post.
+func InsertUser(user models.User) (int64, error) {
+	// Check that the email is a plain address
+	if !validEmail(user.Email) {
+		return 0, errInvalidEmail
+	}
+	if strings.ContainsAny(user.Username, "@[]") {
+		return 0, errInvalidUsername
+	}
+
 	// Check if the username already exists
 	var count int
 	err := db.DB.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", user.Username).Scan(&count)
 	if err != nil {
 		log.Printf("Error checking username existence: %v", err)
-		return fmt.Errorf("failed to check username existence: %v", err)
+		return 0, fmt.Errorf("failed to check username existence: %v", err)
 	}
 	if count > 0 {
-		return fmt.Errorf("username already exists")
+		return 0, fmt.Errorf("username already exists")
 	}
 
 	// Check if the email already exists
 	err = db.DB.QueryRow("SELECT COUNT(*) FROM users WHERE email = ?", user.Email).Scan(&count)
 	if err != nil {
 		log.Printf("Error checking email existence: %v", err)
-		return fmt.Errorf("failed to check email existence: %v", err)
+		return 0, fmt.Errorf("failed to check email existence: %v", err)
 	}
 	if count > 0 {
-		return fmt.Errorf("email already exists")
+		return 0, fmt.Errorf("email already exists")
 	}
 
 	// Hash the password before inserting
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcryptCost)
 	if err != nil {
 		log.Printf("Error hashing password: %v", err)
-		return fmt.Errorf("failed to hash password: %v", err)
+		return 0, fmt.Errorf("failed to hash password: %v", err)
 	}
 
 	// Insert user into the database
 	stmt, err := db.DB.Prepare("INSERT INTO users (email, username, password, created_at) VALUES (?, ?, ?, datetime('now'))")
 	if err != nil {
 		log.Printf("Error preparing SQL statement: %v", err)
-		return fmt.Errorf("failed to prepare statement: %v", err)
+		return 0, fmt.Errorf("failed to prepare statement: %v", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(user.Email, user.Username, string(hashedPassword))
+	res, err := stmt.Exec(user.Email, user.Username, string(hashedPassword))
 	if err != nil {
 		log.Printf("Error executing SQL statement: %v", err)
-		return fmt.Errorf("failed to insert user: %v", err)
+		return 0, fmt.Errorf("failed to insert user: %v", err)
 	}
 
 	log.Println("User inserted successfully")
-	return nil
+	return res.LastInsertId()
 }
 
 // RegisterUserHandler handles user registration
@@ -71,16 +103,31 @@ func RegisterUserHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Insert user into the database
-		err = InsertUser(user)
+		user.Email = strings.TrimSpace(user.Email)
+		userID, err := InsertUser(user)
+		if errors.Is(err, errInvalidEmail) {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errInvalidUsername) {
+			http.Error(w, "Invalid username: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			log.Printf("Error inserting user: %v", err)
 			http.Error(w, fmt.Sprintf("Error registering user: %v", err), http.StatusInternalServerError)
 			return
 		}
 
+		// Send the link confirming the address, which is needed to post, comment and react; a
+		// new link can be requested after logging in
+		if err := sendVerificationEmail(db.DB, int(userID), user.Username, user.Email); err != nil {
+			log.Printf("Error sending verification email: %v", err)
+		}
+
 		// Respond with success
 		w.WriteHeader(http.StatusCreated)
-		fmt.Fprintln(w, "User registered successfully")
+		fmt.Fprintln(w, "User registered successfully, check your email to confirm your address")
 		return
 	}
 
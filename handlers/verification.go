@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// sendVerificationEmail mails a new link confirming the address an account registered with.
+// Links sent earlier stop working, so only the latest email counts.
+func sendVerificationEmail(db *sql.DB, userID int, username, email string) error {
+	if _, err := db.Exec("DELETE FROM account_tokens WHERE user_id = ? AND purpose = ? AND used_at IS NULL", userID, tokenVerifyEmail); err != nil {
+		return fmt.Errorf("failed to discard earlier links: %v", err)
+	}
+	token, err := newAccountToken(db, userID, tokenVerifyEmail, email, emailTokenLifetime)
+	if err != nil {
+		return err
+	}
+	return sendTokenEmail(email, "Confirm your email address",
+		fmt.Sprintf("Welcome to the forum, %s! Open this link within %s to confirm your email address. You can post once it is confirmed:", username, lifetimeText(emailTokenLifetime)),
+		"/account/verify-email", token)
+}
+
+// ResendVerificationHandler sends the current user a new email verification link
+func ResendVerificationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user := CurrentUser(r)
+		if user.Verified {
+			http.Error(w, "Email address is already confirmed", http.StatusConflict)
+			return
+		}
+
+		if err := sendVerificationEmail(db, user.ID, user.Username, user.Email); err != nil {
+			log.Printf("Failed to send verification email: %v\n", err)
+			http.Error(w, "Failed to send the verification email", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Open the link sent to " + user.Email + " to confirm your address"})
+	}
+}
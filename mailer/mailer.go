@@ -0,0 +1,117 @@
+// Package mailer sends the emails the forum needs, such as verification and password
+// reset links, through SMTP or, during development, to a directory of files or the log.
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"forum/config"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// New returns the mailer selected by the configuration
+func New(cfg *config.Config) Mailer {
+	switch cfg.MailDriver {
+	case "smtp":
+		return &SMTPMailer{Addr: cfg.SMTPAddr, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword, From: cfg.MailFrom}
+	case "log":
+		return &LogMailer{From: cfg.MailFrom}
+	}
+	return &FileMailer{Dir: cfg.MailDir, From: cfg.MailFrom}
+}
+
+// headerValue removes line breaks so a value cannot add headers of its own
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// format renders a message in RFC 5322 form
+func (msg Message) format(from string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(&buf, "To: %s\r\n", headerValue(msg.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(msg.Subject)))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// SMTPMailer sends messages through an SMTP server, using STARTTLS when the server offers it
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string // no authentication when empty
+	Password string
+	From     string
+}
+
+// Send delivers msg to the SMTP server
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address %q: %v", m.Addr, err)
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	if err := smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, msg.format(m.From)); err != nil {
+		return fmt.Errorf("failed to send mail to %s: %v", msg.To, err)
+	}
+	return nil
+}
+
+// FileMailer writes each message to its own .eml file in Dir, for development and tests
+type FileMailer struct {
+	Dir  string
+	From string
+
+	sequence atomic.Int64
+}
+
+// Send writes msg to a new file
+func (m *FileMailer) Send(msg Message) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create mail directory: %v", err)
+	}
+	name := fmt.Sprintf("%s-%d.eml", time.Now().Format("20060102-150405.000000"), m.sequence.Add(1))
+	if err := os.WriteFile(filepath.Join(m.Dir, name), msg.format(m.From), 0o600); err != nil {
+		return fmt.Errorf("failed to write mail: %v", err)
+	}
+	return nil
+}
+
+// LogMailer writes messages to the log instead of sending them, for development only since
+// the log then holds live links such as password reset links
+type LogMailer struct {
+	From string
+}
+
+// Send logs msg
+func (m *LogMailer) Send(msg Message) error {
+	log.Printf("Mail to %s: %s\n%s\n", msg.To, msg.Subject, msg.Body)
+	return nil
+}
@@ -1,24 +1,77 @@
 package main
 
 import (
+    "errors"
+    "flag"
     "fmt"
     "html/template"
     "log"
+    "log/slog"
     "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    "forum/config"
     "forum/db"
     "forum/handlers"
 )
 
 func main() {
-    // Initialize the database
-    err := db.Initialize()
+    // Load configuration from defaults, config file, environment and flags
+    cfg, opts, err := config.Load(os.Args[1:])
+    if errors.Is(err, flag.ErrHelp) {
+        return
+    }
+    if err != nil {
+        log.Fatalf("Error loading configuration: %v", err)
+    }
+
+    if opts.PrintConfig {
+        if err := cfg.Print(os.Stdout); err != nil {
+            log.Fatalf("Error printing configuration: %v", err)
+        }
+        return
+    }
+
+    // Route the standard logger through slog so the configured level applies
+    level, _ := cfg.SlogLevel()
+    slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+    // "forum migrate ..." manages the schema instead of starting the server
+    if len(opts.Args) > 0 && opts.Args[0] == "migrate" {
+        os.Exit(runMigrateCommand(cfg, opts.Args[1:]))
+    }
+
+    // "forum role <user> <role>" changes an account's role, e.g. to bootstrap the first admin
+    if len(opts.Args) > 0 && opts.Args[0] == "role" {
+        os.Exit(runRoleCommand(cfg, opts.Args[1:]))
+    }
+
+    if err := cfg.ValidateServe(); err != nil {
+        log.Fatalf("Error loading configuration: %v", err)
+    }
+
+    handlers.Configure(cfg)
+
+    // Initialize the database and apply pending migrations
+    err = db.Initialize(cfg.DatabasePath)
     if err != nil {
         log.Fatalf("Error initializing database: %v", err)
     }
     defer db.Close()
 
+    // Render the Markdown of content that has no cached HTML; until then it is rendered on the fly
+    if err := handlers.RenderMissingContent(db.DB); err != nil {
+        log.Printf("Error rendering content: %v", err)
+    }
+
+    // Purge expired sessions in the background
+    stopJanitor := handlers.StartSessionJanitor(db.DB, time.Hour)
+    defer stopJanitor()
+
     // Serve static files (CSS, JS, images)
-    http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+    http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(cfg.StaticDir))))
 
     // Serve index page from templates
     http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -26,38 +79,120 @@ func main() {
             http.NotFound(w, r)
             return
         }
-        
-        tmpl, err := template.ParseFiles("templates/index.html")
-        if err != nil {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
-            return
-        }
-        
-        err = tmpl.Execute(w, nil)
-        if err != nil {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
-            return
-        }
+        servePage(w, filepath.Join(cfg.TemplateDir, "index.html"))
     })
 
-    // API routes
+    // API routes (mutating routes resolve the user from the session cookie via RequireAuth)
     http.HandleFunc("/register", handlers.RegisterUserHandler)
     http.HandleFunc("/login", handlers.LoginHandler(db.DB))
     http.HandleFunc("/logout", handlers.LogoutHandler(db.DB))
-    http.HandleFunc("/posts", handlers.GetPostsHandler(db.DB))
-    http.HandleFunc("/create-post", handlers.CreatePostHandler(db.DB))
-    http.HandleFunc("/comment", handlers.AddCommentHandler(db.DB))
-    http.HandleFunc("/get-comments", handlers.GetCommentsHandler(db.DB))
-    http.HandleFunc("/add-reaction", handlers.AddReactionHandler(db.DB))
+    http.HandleFunc("/check-session", handlers.CheckSessionHandler(db.DB))
+    http.HandleFunc("/sessions", handlers.RequireAuth(db.DB, handlers.ListSessionsHandler(db.DB)))
+    http.HandleFunc("/sessions/revoke", handlers.RequireAuth(db.DB, handlers.RevokeSessionHandler(db.DB)))
+    http.HandleFunc("/sessions/revoke-others", handlers.RequireAuth(db.DB, handlers.RevokeOtherSessionsHandler(db.DB)))
+    http.HandleFunc("/posts", handlers.WithUser(db.DB, handlers.GetPostsHandler(db.DB)))
+    http.HandleFunc("/create-post", handlers.RequireCanPost(db.DB, handlers.CreatePostHandler(db.DB)))
+    http.HandleFunc("/edit-post", handlers.RequireCanPost(db.DB, handlers.EditPostHandler(db.DB)))
+    http.HandleFunc("/delete-post", handlers.RequireAuth(db.DB, handlers.DeletePostHandler(db.DB)))
+    http.HandleFunc("/post-revisions", handlers.WithUser(db.DB, handlers.GetPostRevisionsHandler(db.DB)))
+    http.HandleFunc("/lock-post", handlers.RequirePermission(db.DB, handlers.PermModerateContent, handlers.LockPostHandler(db.DB)))
+    http.HandleFunc("/comment", handlers.RequireCanPost(db.DB, handlers.AddCommentHandler(db.DB)))
+    http.HandleFunc("/get-comments", handlers.WithUser(db.DB, handlers.GetCommentsHandler(db.DB)))
+    http.HandleFunc("/edit-comment", handlers.RequireCanPost(db.DB, handlers.EditCommentHandler(db.DB)))
+    http.HandleFunc("/delete-comment", handlers.RequireAuth(db.DB, handlers.DeleteCommentHandler(db.DB)))
+    http.HandleFunc("/comment-revisions", handlers.WithUser(db.DB, handlers.GetCommentRevisionsHandler(db.DB)))
+    http.HandleFunc("/lock-comment", handlers.RequirePermission(db.DB, handlers.PermModerateContent, handlers.LockCommentHandler(db.DB)))
+    http.HandleFunc("/add-reaction", handlers.RequireCanPost(db.DB, handlers.AddReactionHandler(db.DB)))
     http.HandleFunc("/reaction-counts", handlers.GetPostReactionCountsHandler(db.DB))
-    http.HandleFunc("/commentreaction", handlers.AddCommentReactionHandler(db.DB))
+    http.HandleFunc("/commentreaction", handlers.RequireCanPost(db.DB, handlers.AddCommentReactionHandler(db.DB)))
     http.HandleFunc("/commentreactioncounts", handlers.GetCommentReactionCountsHandler(db.DB))
-    http.HandleFunc("/category", handlers.GetPostsByCategoryHandler(db.DB))
+    http.HandleFunc("/notifications", handlers.RequireAuth(db.DB, handlers.ListNotificationsHandler(db.DB)))
+    http.HandleFunc("/notifications/unread-count", handlers.RequireAuth(db.DB, handlers.UnreadNotificationsHandler(db.DB)))
+    http.HandleFunc("/notifications/read", handlers.RequireAuth(db.DB, handlers.MarkNotificationsReadHandler(db.DB)))
+    http.HandleFunc("/notifications/preferences", handlers.RequireAuth(db.DB, handlers.NotificationPreferencesHandler(db.DB)))
+    http.HandleFunc("/notifications/preferences/update", handlers.RequireAuth(db.DB, handlers.UpdateNotificationPreferencesHandler(db.DB)))
+    http.HandleFunc("/inbox", func(w http.ResponseWriter, r *http.Request) {
+        servePage(w, filepath.Join(cfg.TemplateDir, "messages.html"))
+    })
+    http.HandleFunc("/messages", handlers.RequireAuth(db.DB, handlers.ListMessagesHandler(db.DB)))
+    http.HandleFunc("/messages/conversations", handlers.RequireAuth(db.DB, handlers.ListConversationsHandler(db.DB)))
+    http.HandleFunc("/messages/send", handlers.RequireCanPost(db.DB, handlers.SendMessageHandler(db.DB)))
+    http.HandleFunc("/messages/read", handlers.RequireAuth(db.DB, handlers.MarkMessagesReadHandler(db.DB)))
+    http.HandleFunc("/messages/socket", handlers.RequireAuth(db.DB, handlers.MessagesSocketHandler(db.DB)))
+    http.HandleFunc("/search", handlers.SearchHandler(db.DB))
+    http.HandleFunc("/events", handlers.EventsHandler(db.DB))
+    http.HandleFunc("/categories", handlers.ListCategoriesHandler(db.DB))
+    http.HandleFunc("/category", handlers.WithUser(db.DB, handlers.GetPostsByCategoryHandler(db.DB)))
+
+    // Reports and moderation
+    http.HandleFunc("/report", handlers.RequireAuth(db.DB, handlers.ReportHandler(db.DB)))
+    http.HandleFunc("/moderation/queue", handlers.RequirePermission(db.DB, handlers.PermModerateContent, handlers.ModerationQueueHandler(db.DB)))
+    http.HandleFunc("/moderation/action", handlers.RequirePermission(db.DB, handlers.PermModerateContent, handlers.ModerationActionHandler(db.DB)))
+    http.HandleFunc("/moderation/pending", handlers.RequirePermission(db.DB, handlers.PermModerateContent, handlers.PendingPostsHandler(db.DB)))
+    http.HandleFunc("/moderation/review", handlers.RequirePermission(db.DB, handlers.PermModerateContent, handlers.ReviewPostHandler(db.DB)))
+    http.HandleFunc("/moderation/sanction", handlers.RequirePermission(db.DB, handlers.PermModerateContent, handlers.SanctionUserHandler(db.DB)))
+    http.HandleFunc("/moderation/sanction/revoke", handlers.RequirePermission(db.DB, handlers.PermModerateContent, handlers.RevokeSanctionHandler(db.DB)))
+    http.HandleFunc("/moderation/sanctions", handlers.RequirePermission(db.DB, handlers.PermModerateContent, handlers.ListSanctionsHandler(db.DB)))
+    http.HandleFunc("/moderation/log", handlers.RequirePermission(db.DB, handlers.PermModerateContent, handlers.ModerationLogHandler(db.DB)))
+
+    // Profiles: browsers navigating to /users/{username} get the profile page, which fetches
+    // the JSON profile from the same URL
+    getProfile := handlers.GetProfileHandler(db.DB)
+    http.HandleFunc("/users/{username}", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Add("Vary", "Accept")
+        if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+            servePage(w, filepath.Join(cfg.TemplateDir, "profile.html"))
+            return
+        }
+        getProfile(w, r)
+    })
+    http.HandleFunc("/users/{username}/avatar", handlers.AvatarHandler(db.DB))
+    http.HandleFunc("/usernames", handlers.SearchUsernamesHandler(db.DB))
+    http.HandleFunc("/edit-profile", handlers.RequireCanPost(db.DB, handlers.EditProfileHandler(db.DB)))
+
+    // Account settings
+    http.HandleFunc("/account/password", handlers.RequireAuth(db.DB, handlers.ChangePasswordHandler(db.DB)))
+    http.HandleFunc("/account/email", handlers.RequireAuth(db.DB, handlers.ChangeEmailHandler(db.DB)))
+    http.HandleFunc("/account/verify-email", handlers.VerifyEmailHandler(db.DB))
+    http.HandleFunc("/account/resend-verification", handlers.RequireAuth(db.DB, handlers.ResendVerificationHandler(db.DB)))
+    http.HandleFunc("/account/forgot-password", handlers.ForgotPasswordHandler(db.DB))
+    // The reset link opens a page with the new password form, which posts back to the same URL
+    resetPassword := handlers.ResetPasswordHandler(db.DB)
+    http.HandleFunc("/account/reset-password", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodGet {
+            servePage(w, filepath.Join(cfg.TemplateDir, "reset-password.html"))
+            return
+        }
+        resetPassword(w, r)
+    })
+    http.HandleFunc("/account/delete", handlers.RequireAuth(db.DB, handlers.DeleteAccountHandler(db.DB)))
+
+    // Administration
+    http.HandleFunc("/admin/categories/create", handlers.RequirePermission(db.DB, handlers.PermManageCategories, handlers.CreateCategoryHandler(db.DB)))
+    http.HandleFunc("/admin/categories/update", handlers.RequirePermission(db.DB, handlers.PermManageCategories, handlers.UpdateCategoryHandler(db.DB)))
+    http.HandleFunc("/admin/categories/delete", handlers.RequirePermission(db.DB, handlers.PermManageCategories, handlers.DeleteCategoryHandler(db.DB)))
+    http.HandleFunc("/admin/users", handlers.RequirePermission(db.DB, handlers.PermManageUsers, handlers.ListUsersHandler(db.DB)))
+    http.HandleFunc("/admin/users/role", handlers.RequirePermission(db.DB, handlers.PermManageUsers, handlers.UpdateUserRoleHandler(db.DB)))
 
     // Start the server
-    fmt.Println("Server started on :8080")
-    err = http.ListenAndServe(":8080", nil)
+    fmt.Println("Server started on", cfg.Addr)
+    err = http.ListenAndServe(cfg.Addr, nil)
     if err != nil {
         log.Fatalf("Error starting server: %v", err)
     }
+}
+
+// servePage renders an HTML page from the template at path
+func servePage(w http.ResponseWriter, path string) {
+    tmpl, err := template.ParseFiles(path)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    err = tmpl.Execute(w, nil)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
 }
\ No newline at end of file
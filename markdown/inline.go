@@ -0,0 +1,550 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	autolinkPattern      = regexp.MustCompile(`^<([A-Za-z][A-Za-z0-9+.-]{1,31}:[^\x00-\x20<>]*)>`)
+	emailAutolinkPattern = regexp.MustCompile(`^<([A-Za-z0-9.!#$%&'*+/=?^_` + "`" + `{|}~-]+@[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*)>`)
+	mentionNamePattern   = regexp.MustCompile(`^[\w.-]+`)
+)
+
+// inlineNode is a piece of rendered inline content. Runs of * and _ stay delimiter nodes
+// until emphasis is resolved, when matched delimiters turn into tags.
+type inlineNode struct {
+	html string
+
+	delim     byte // '*' or '_' for delimiter runs, 0 otherwise
+	count     int  // delimiters of the run left unmatched
+	origCount int
+	canOpen   bool
+	canClose  bool
+	open      string // tags opened by the run
+	close     string // tags closed by the run
+
+	prevDelim, nextDelim *inlineNode // neighbouring delimiter runs that can still match
+}
+
+// inlineParser renders the inline content of a paragraph or heading
+type inlineParser struct {
+	src    string
+	opts   Options
+	inLink bool // link text cannot contain links or mentions
+
+	nodes    []*inlineNode
+	text     strings.Builder // literal text not yet added to nodes
+	brackets map[int]int     // position of the ] closing each [
+	codeEnds map[int]int     // position after the backtick run closing each code span
+}
+
+// renderInline renders inline Markdown
+func renderInline(src string, opts Options) string {
+	p := &inlineParser{src: src, opts: opts}
+	return p.render()
+}
+
+func (p *inlineParser) render() string {
+	p.matchCodeSpans()
+	p.matchBrackets()
+	p.parse()
+	p.processEmphasis()
+
+	var b strings.Builder
+	for _, node := range p.nodes {
+		if node.delim == 0 {
+			b.WriteString(node.html)
+			continue
+		}
+		b.WriteString(node.close)
+		b.WriteString(strings.Repeat(string(node.delim), node.count))
+		b.WriteString(node.open)
+	}
+	return b.String()
+}
+
+// matchCodeSpans finds the backtick run closing each code span. A run of backticks opens a
+// code span when a later run has exactly the same length.
+func (p *inlineParser) matchCodeSpans() {
+	p.codeEnds = map[int]int{}
+	open := map[int]int{} // position of the unmatched run of each length
+	for i := 0; i < len(p.src); {
+		switch p.src[i] {
+		case '\\':
+			i += 2
+		case '`':
+			n := backtickRun(p.src, i)
+			if start, ok := open[n]; ok {
+				p.codeEnds[start] = i + n
+				delete(open, n)
+				// Runs inside the span cannot open spans of their own
+				for length, position := range open {
+					if position > start {
+						delete(open, length)
+					}
+				}
+			} else {
+				open[n] = i
+			}
+			i += n
+		default:
+			i++
+		}
+	}
+}
+
+// backtickRun returns the length of the run of backticks starting at i
+func backtickRun(s string, i int) int {
+	n := 0
+	for i+n < len(s) && s[i+n] == '`' {
+		n++
+	}
+	return n
+}
+
+// matchBrackets finds the ] closing each [, skipping escaped brackets and code spans
+func (p *inlineParser) matchBrackets() {
+	p.brackets = map[int]int{}
+	var stack []int
+	for i := 0; i < len(p.src); {
+		switch p.src[i] {
+		case '\\':
+			i += 2
+			continue
+		case '`':
+			if end, ok := p.codeEnds[i]; ok {
+				i = end
+				continue
+			}
+			i += backtickRun(p.src, i)
+			continue
+		case '[':
+			stack = append(stack, i)
+		case ']':
+			if len(stack) > 0 {
+				p.brackets[stack[len(stack)-1]] = i
+				stack = stack[:len(stack)-1]
+			}
+		}
+		i++
+	}
+}
+
+// flushText turns pending literal text into a node
+func (p *inlineParser) flushText() {
+	if p.text.Len() == 0 {
+		return
+	}
+	p.nodes = append(p.nodes, &inlineNode{html: html.EscapeString(p.text.String())})
+	p.text.Reset()
+}
+
+func (p *inlineParser) addHTML(s string) {
+	p.flushText()
+	p.nodes = append(p.nodes, &inlineNode{html: s})
+}
+
+func (p *inlineParser) parse() {
+	src := p.src
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\\':
+			if i+1 < len(src) && src[i+1] == '\n' {
+				p.lineBreak(true)
+				i = skipSpaces(src, i+2)
+				continue
+			}
+			if i+1 < len(src) && isASCIIPunct(src[i+1]) {
+				p.text.WriteByte(src[i+1])
+				i += 2
+				continue
+			}
+			p.text.WriteByte(c)
+			i++
+
+		case c == '`':
+			n := backtickRun(src, i)
+			end, ok := p.codeEnds[i]
+			if !ok {
+				p.text.WriteString(src[i : i+n])
+				i += n
+				continue
+			}
+			p.addHTML("<code>" + html.EscapeString(codeSpanText(src[i+n:end-n])) + "</code>")
+			i = end
+
+		case c == '*' || c == '_':
+			n := 1
+			for i+n < len(src) && src[i+n] == c {
+				n++
+			}
+			p.addDelimiters(c, i, n)
+			i += n
+
+		case c == '[' && !p.inLink:
+			if end, ok := p.parseLink(i, false); ok {
+				i = end
+				continue
+			}
+			p.text.WriteByte(c)
+			i++
+
+		case c == '!' && !p.inLink && i+1 < len(src) && src[i+1] == '[':
+			// Images are not embedded; they become links to the image
+			if end, ok := p.parseLink(i+1, true); ok {
+				i = end
+				continue
+			}
+			p.text.WriteByte(c)
+			i++
+
+		case c == '<':
+			if end, ok := p.parseAutolink(i); ok {
+				i = end
+				continue
+			}
+			p.text.WriteByte(c)
+			i++
+
+		case c == '@' && !p.inLink && p.opts.MentionURL != nil:
+			if end, ok := p.parseMention(i); ok {
+				i = end
+				continue
+			}
+			p.text.WriteByte(c)
+			i++
+
+		case c == '\n':
+			pending := p.text.String()
+			trimmed := strings.TrimRight(pending, " ")
+			p.text.Reset()
+			p.text.WriteString(trimmed)
+			p.lineBreak(len(pending)-len(trimmed) >= 2)
+			i = skipSpaces(src, i+1)
+
+		default:
+			p.text.WriteByte(c)
+			i++
+		}
+	}
+	p.flushText()
+}
+
+// lineBreak adds a hard or soft line break
+func (p *inlineParser) lineBreak(hard bool) {
+	if hard {
+		p.addHTML("<br>\n")
+	} else {
+		p.text.WriteByte('\n')
+	}
+}
+
+func skipSpaces(s string, i int) int {
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	return i
+}
+
+// codeSpanText normalizes the content of a code span: line breaks become spaces, and one
+// space is stripped from both ends when it pads something other than spaces
+func codeSpanText(s string) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if len(s) >= 2 && s[0] == ' ' && s[len(s)-1] == ' ' && strings.Trim(s, " ") != "" {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
+
+func isASCIIPunct(c byte) bool {
+	return c < utf8.RuneSelf && strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+func isPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// addDelimiters adds a run of n * or _ starting at i, deciding from its surroundings whether
+// it can open or close emphasis
+func (p *inlineParser) addDelimiters(c byte, i, n int) {
+	before, after := ' ', ' ' // the start and end of the text count as whitespace
+	if i > 0 {
+		before, _ = utf8.DecodeLastRuneInString(p.src[:i])
+	}
+	if i+n < len(p.src) {
+		after, _ = utf8.DecodeRuneInString(p.src[i+n:])
+	}
+
+	leftFlanking := !unicode.IsSpace(after) && (!isPunct(after) || unicode.IsSpace(before) || isPunct(before))
+	rightFlanking := !unicode.IsSpace(before) && (!isPunct(before) || unicode.IsSpace(after) || isPunct(after))
+
+	node := &inlineNode{delim: c, count: n, origCount: n}
+	if c == '*' {
+		node.canOpen, node.canClose = leftFlanking, rightFlanking
+	} else {
+		// Underscores inside words do not emphasize
+		node.canOpen = leftFlanking && (!rightFlanking || isPunct(before))
+		node.canClose = rightFlanking && (!leftFlanking || isPunct(after))
+	}
+	p.flushText()
+	p.nodes = append(p.nodes, node)
+}
+
+// processEmphasis matches delimiter runs into emphasis and strong emphasis, following the
+// CommonMark algorithm
+func (p *inlineParser) processEmphasis() {
+	var first, last *inlineNode
+	for _, node := range p.nodes {
+		if node.delim == 0 {
+			continue
+		}
+		if last != nil {
+			last.nextDelim, node.prevDelim = node, last
+		} else {
+			first = node
+		}
+		last = node
+	}
+
+	unlink := func(node *inlineNode) {
+		if node.prevDelim != nil {
+			node.prevDelim.nextDelim = node.nextDelim
+		}
+		if node.nextDelim != nil {
+			node.nextDelim.prevDelim = node.prevDelim
+		}
+	}
+
+	// Where the search for an opener stopped last time, so it is not repeated
+	type bottomKey struct {
+		delim   byte
+		canOpen bool
+		mod3    int
+	}
+	bottoms := map[bottomKey]*inlineNode{}
+
+	closer := first
+	for closer != nil {
+		if !closer.canClose {
+			closer = closer.nextDelim
+			continue
+		}
+
+		key := bottomKey{closer.delim, closer.canOpen, closer.origCount % 3}
+		bottom := bottoms[key]
+		var opener *inlineNode
+		for o := closer.prevDelim; o != nil && o != bottom; o = o.prevDelim {
+			if o.delim != closer.delim || !o.canOpen {
+				continue
+			}
+			// A run that can both open and close only pairs up with one whose length does
+			// not sum with its own to a multiple of three
+			if (o.canClose || closer.canOpen) && (o.origCount+closer.origCount)%3 == 0 &&
+				!(o.origCount%3 == 0 && closer.origCount%3 == 0) {
+				continue
+			}
+			opener = o
+			break
+		}
+
+		if opener == nil {
+			bottoms[key] = closer.prevDelim
+			next := closer.nextDelim
+			if !closer.canOpen {
+				unlink(closer)
+			}
+			closer = next
+			continue
+		}
+
+		use, tag := 1, "em"
+		if opener.count >= 2 && closer.count >= 2 {
+			use, tag = 2, "strong"
+		}
+		opener.count -= use
+		closer.count -= use
+		opener.open = "<" + tag + ">" + opener.open
+		closer.close += "</" + tag + ">"
+
+		// Runs between the pair can no longer match
+		opener.nextDelim, closer.prevDelim = closer, opener
+		if opener.count == 0 {
+			unlink(opener)
+		}
+		if closer.count == 0 {
+			next := closer.nextDelim
+			unlink(closer)
+			closer = next
+		}
+	}
+}
+
+// parseLink parses an inline link [text](destination "title") starting at the [ at i and
+// returns where it ends. Images have the destination linked with their text.
+func (p *inlineParser) parseLink(i int, image bool) (int, bool) {
+	src := p.src
+	closeBracket, ok := p.brackets[i]
+	if !ok || closeBracket+1 >= len(src) || src[closeBracket+1] != '(' {
+		return 0, false
+	}
+
+	j := skipLinkSpace(src, closeBracket+2)
+	var dest string
+	if j < len(src) && src[j] == '<' {
+		end := j + 1
+		for end < len(src) && src[end] != '>' && src[end] != '<' && src[end] != '\n' {
+			if src[end] == '\\' && end+1 < len(src) {
+				end++
+			}
+			end++
+		}
+		if end >= len(src) || src[end] != '>' {
+			return 0, false
+		}
+		dest = src[j+1 : end]
+		j = end + 1
+	} else {
+		start, depth := j, 0
+		for j < len(src) && src[j] > ' ' {
+			if src[j] == '\\' && j+1 < len(src) && isASCIIPunct(src[j+1]) {
+				j += 2
+				continue
+			}
+			if src[j] == '(' {
+				depth++
+			} else if src[j] == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+			j++
+		}
+		if depth != 0 {
+			return 0, false
+		}
+		dest = src[start:j]
+	}
+
+	var title string
+	afterSpace := skipLinkSpace(src, j)
+	if afterSpace > j && afterSpace < len(src) && strings.IndexByte(`"'(`, src[afterSpace]) >= 0 {
+		closing := src[afterSpace]
+		if closing == '(' {
+			closing = ')'
+		}
+		end := afterSpace + 1
+		for end < len(src) && src[end] != closing {
+			if src[end] == '\\' && end+1 < len(src) {
+				end++
+			}
+			end++
+		}
+		if end >= len(src) {
+			return 0, false
+		}
+		title = src[afterSpace+1 : end]
+		j = end + 1
+	}
+	j = skipLinkSpace(src, j)
+	if j >= len(src) || src[j] != ')' {
+		return 0, false
+	}
+
+	text := &inlineParser{src: src[i+1 : closeBracket], opts: p.opts, inLink: true}
+	inner := text.render()
+	if image && inner == "" {
+		inner = html.EscapeString(dest)
+	}
+
+	dest = strings.ReplaceAll(unescapeBackslashes(dest), " ", "%20")
+	if !safeURL(dest) {
+		// Unsafe links keep their text
+		p.addHTML(inner)
+		return j + 1, true
+	}
+	link := `<a href="` + html.EscapeString(dest) + `"`
+	if title != "" {
+		link += ` title="` + html.EscapeString(unescapeBackslashes(title)) + `"`
+	}
+	p.addHTML(link + ">" + inner + "</a>")
+	return j + 1, true
+}
+
+// skipLinkSpace skips spaces, tabs and at most one line break
+func skipLinkSpace(s string, i int) int {
+	newline := false
+	for i < len(s) {
+		switch {
+		case s[i] == ' ' || s[i] == '\t':
+		case s[i] == '\n' && !newline:
+			newline = true
+		default:
+			return i
+		}
+		i++
+	}
+	return i
+}
+
+// unescapeBackslashes removes the backslashes escaping punctuation
+func unescapeBackslashes(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseAutolink parses <scheme:...> or <address@example.com> at i
+func (p *inlineParser) parseAutolink(i int) (int, bool) {
+	rest := p.src[i:]
+	if m := autolinkPattern.FindStringSubmatch(rest); m != nil {
+		if p.inLink || !safeURL(m[1]) {
+			p.addHTML(html.EscapeString(m[1]))
+		} else {
+			p.addHTML(`<a href="` + html.EscapeString(m[1]) + `">` + html.EscapeString(m[1]) + "</a>")
+		}
+		return i + len(m[0]), true
+	}
+	if m := emailAutolinkPattern.FindStringSubmatch(rest); m != nil {
+		if p.inLink {
+			p.addHTML(html.EscapeString(m[1]))
+		} else {
+			p.addHTML(`<a href="mailto:` + html.EscapeString(m[1]) + `">` + html.EscapeString(m[1]) + "</a>")
+		}
+		return i + len(m[0]), true
+	}
+	return 0, false
+}
+
+// parseMention links @username at i when the options know the user. As when mentions are
+// stored, the @ must not follow a letter, digit, underscore or another @.
+func (p *inlineParser) parseMention(i int) (int, bool) {
+	if i > 0 {
+		if c := p.src[i-1]; c == '@' || c == '_' || c < utf8.RuneSelf && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))) {
+			return 0, false
+		}
+	}
+	name := strings.TrimRight(mentionNamePattern.FindString(p.src[i+1:]), ".-")
+	if name == "" {
+		return 0, false
+	}
+	url := p.opts.MentionURL(name)
+	if url == "" {
+		return 0, false
+	}
+	p.addHTML(`<a class="mention" href="` + html.EscapeString(url) + `">@` + html.EscapeString(name) + "</a>")
+	return i + 1 + len(name), true
+}
@@ -0,0 +1,452 @@
+// Package markdown renders the subset of CommonMark the forum supports to HTML: paragraphs,
+// headings, emphasis, code spans and blocks, links, block quotes, lists and thematic breaks.
+// Raw HTML, images and reference links are not supported; raw HTML is shown as text and
+// images as links. The output is passed through Sanitize, so only allowlisted markup
+// reaches browsers.
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Options adjust how Render treats forum-specific syntax
+type Options struct {
+	// MentionURL returns the page an @username mention links to, or "" to leave it as text.
+	// Mentions are not linked when MentionURL is nil.
+	MentionURL func(username string) string
+}
+
+// maxNesting limits how deeply block quotes and lists nest; deeper markers are shown as text
+const maxNesting = 16
+
+// blockKind is the type of a block
+type blockKind int
+
+const (
+	paragraphBlock blockKind = iota
+	headingBlock
+	codeBlock
+	quoteBlock
+	listBlock
+	ruleBlock
+)
+
+// block is a parsed block of a document
+type block struct {
+	kind     blockKind
+	text     string     // inline source of paragraphs and headings, code of code blocks
+	level    int        // heading level
+	language string     // language named on the opening fence of a code block
+	children []*block   // blocks of a block quote
+	items    [][]*block // blocks of each list item
+	ordered  bool
+	start    int  // number of the first item of an ordered list
+	loose    bool // whether list items are separated by blank lines, wrapping their paragraphs in <p>
+}
+
+var (
+	fencePattern      = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})(.*)$")
+	headingPattern    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*))?$`)
+	rulePattern       = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	setextPattern     = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	quotePattern      = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	listItemPattern   = regexp.MustCompile(`^( {0,3})([-+*]|\d{1,9}[.)])([ \t]*)(.*)$`)
+	languagePattern   = regexp.MustCompile(`^[\w+#.-]+$`)
+	headingEndPattern = regexp.MustCompile(`(?:^|[ \t]+)#+[ \t]*$`)
+)
+
+// Render converts Markdown source to sanitized HTML
+func Render(source string, opts Options) string {
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	source = strings.ReplaceAll(source, "\r", "\n")
+	source = strings.ReplaceAll(source, "\x00", "�")
+
+	lines := strings.Split(source, "\n")
+	for i, line := range lines {
+		lines[i] = expandIndent(line)
+	}
+
+	var b strings.Builder
+	r := renderer{opts: opts}
+	r.blocks(&b, parseBlocks(lines, 0), false)
+	return Sanitize(b.String())
+}
+
+// expandIndent replaces the tabs in the indentation of a line with spaces, to tab stops of four
+func expandIndent(line string) string {
+	if !strings.HasPrefix(strings.TrimLeft(line, " "), "\t") {
+		return line
+	}
+	column := 0
+	for i, c := range line {
+		switch c {
+		case ' ':
+			column++
+		case '\t':
+			column += 4 - column%4
+		default:
+			return strings.Repeat(" ", column) + line[i:]
+		}
+	}
+	return ""
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// indentation returns the number of spaces a line starts with
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// listMarker is the marker starting a list item
+type listMarker struct {
+	ordered bool
+	bullet  byte // '-', '+' or '*' for bullet lists; '.' or ')' for ordered lists
+	number  int
+	indent  int    // where the content of the item starts
+	content string // the rest of the first line
+}
+
+// parseListMarker recognizes a line starting a list item
+func parseListMarker(line string) (listMarker, bool) {
+	m := listItemPattern.FindStringSubmatch(line)
+	if m == nil || (m[3] == "" && m[4] != "") {
+		return listMarker{}, false
+	}
+	marker := listMarker{bullet: m[2][len(m[2])-1], content: m[4]}
+	if len(m[2]) > 1 || (m[2][0] >= '0' && m[2][0] <= '9') {
+		marker.ordered = true
+		marker.number, _ = strconv.Atoi(m[2][:len(m[2])-1])
+	}
+
+	// The content starts after the spaces following the marker, unless there are more than
+	// four of them, in which case the content is indented code starting after the first one
+	start := len(m[1]) + len(m[2])
+	column := start
+	for _, c := range m[3] {
+		if c == '\t' {
+			column += 4 - column%4
+		} else {
+			column++
+		}
+	}
+	switch {
+	case m[4] == "":
+		marker.indent = start + 1
+	case column-start > 4:
+		marker.indent = start + 1
+		marker.content = strings.Repeat(" ", column-start-1) + m[4]
+	default:
+		marker.indent = column
+	}
+	return marker, true
+}
+
+// startsBlock reports whether a line starts a block that interrupts a paragraph
+func startsBlock(line string, depth int) bool {
+	if fencePattern.MatchString(line) || headingPattern.MatchString(line) || rulePattern.MatchString(line) {
+		return true
+	}
+	if depth >= maxNesting {
+		return false
+	}
+	if quotePattern.MatchString(line) {
+		return true
+	}
+	// Only lists starting at 1 and with content interrupt paragraphs, so numbers and
+	// dashes that happen to begin a wrapped line do not start lists
+	marker, ok := parseListMarker(line)
+	return ok && strings.TrimSpace(marker.content) != "" && (!marker.ordered || marker.number == 1)
+}
+
+// parseBlocks splits lines into blocks. depth is how deeply they are nested in quotes and lists.
+func parseBlocks(lines []string, depth int) []*block {
+	var blocks []*block
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if isBlank(line) {
+			i++
+			continue
+		}
+
+		if m := fencePattern.FindStringSubmatch(line); m != nil && !(m[2][0] == '`' && strings.Contains(m[3], "`")) {
+			b, n := parseFencedCode(lines[i:], len(m[1]), m[2], m[3])
+			blocks = append(blocks, b)
+			i += n
+			continue
+		}
+
+		if indentation(line) >= 4 {
+			b, n := parseIndentedCode(lines[i:])
+			blocks = append(blocks, b)
+			i += n
+			continue
+		}
+
+		if m := headingPattern.FindStringSubmatch(line); m != nil {
+			text := headingEndPattern.ReplaceAllString(strings.TrimRight(m[2], " \t"), "")
+			blocks = append(blocks, &block{kind: headingBlock, level: len(m[1]), text: strings.TrimSpace(text)})
+			i++
+			continue
+		}
+
+		if rulePattern.MatchString(line) {
+			blocks = append(blocks, &block{kind: ruleBlock})
+			i++
+			continue
+		}
+
+		if depth < maxNesting {
+			if quotePattern.MatchString(line) {
+				b, n := parseQuote(lines[i:], depth)
+				blocks = append(blocks, b)
+				i += n
+				continue
+			}
+			if marker, ok := parseListMarker(line); ok {
+				b, n := parseList(lines[i:], marker, depth)
+				blocks = append(blocks, b)
+				i += n
+				continue
+			}
+		}
+
+		b, n := parseParagraph(lines[i:], depth)
+		blocks = append(blocks, b)
+		i += n
+	}
+	return blocks
+}
+
+// parseFencedCode reads a code block from its opening fence to the matching closing fence,
+// or to the end of the container
+func parseFencedCode(lines []string, indent int, fence, info string) (*block, int) {
+	b := &block{kind: codeBlock}
+	if fields := strings.Fields(info); len(fields) > 0 && languagePattern.MatchString(fields[0]) {
+		b.language = fields[0]
+	}
+
+	var code []string
+	n := 1
+	for ; n < len(lines); n++ {
+		line := lines[n]
+		if closesFence(line, fence) {
+			n++
+			break
+		}
+		// Content lines lose as much indentation as the opening fence had
+		strip := indentation(line)
+		if strip > indent {
+			strip = indent
+		}
+		code = append(code, line[strip:])
+	}
+	b.text = joinCode(code)
+	return b, n
+}
+
+// closesFence reports whether line is a fence at least as long as the opening one, made of
+// the same character
+func closesFence(line, fence string) bool {
+	if indentation(line) > 3 {
+		return false
+	}
+	marker := strings.TrimRight(strings.TrimLeft(line, " "), " \t")
+	return len(marker) >= len(fence) && strings.Trim(marker, fence[:1]) == ""
+}
+
+// parseIndentedCode reads a code block of lines indented by four or more spaces
+func parseIndentedCode(lines []string) (*block, int) {
+	var code []string
+	n := 0
+	for ; n < len(lines); n++ {
+		line := lines[n]
+		if isBlank(line) {
+			code = append(code, "")
+			continue
+		}
+		if indentation(line) < 4 {
+			break
+		}
+		code = append(code, line[4:])
+	}
+	// Blank lines after the code belong to whatever follows
+	for len(code) > 0 && code[len(code)-1] == "" {
+		code = code[:len(code)-1]
+	}
+	return &block{kind: codeBlock, text: joinCode(code)}, n
+}
+
+func joinCode(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// parseQuote reads a block quote: lines starting with > and the lines of a paragraph
+// continuing without one
+func parseQuote(lines []string, depth int) (*block, int) {
+	var content []string
+	n := 0
+	for ; n < len(lines); n++ {
+		line := lines[n]
+		if m := quotePattern.FindStringSubmatch(line); m != nil {
+			content = append(content, expandIndent(m[1]))
+			continue
+		}
+		// A lazy continuation line
+		if isBlank(line) || len(content) == 0 || isBlank(content[len(content)-1]) || startsBlock(line, depth) {
+			break
+		}
+		content = append(content, line)
+	}
+	return &block{kind: quoteBlock, children: parseBlocks(content, depth+1)}, n
+}
+
+// parseList reads the items of a list for as long as they use the same kind of marker
+func parseList(lines []string, first listMarker, depth int) (*block, int) {
+	list := &block{kind: listBlock, ordered: first.ordered, start: first.number}
+	marker := first
+	var item []string
+	blankBefore := false // whether the previous line was blank
+	n := 0
+
+	endItem := func() {
+		// Blank lines ending an item belong to whatever follows
+		for len(item) > 0 && isBlank(item[len(item)-1]) {
+			item = item[:len(item)-1]
+		}
+		list.items = append(list.items, parseBlocks(item, depth+1))
+	}
+
+	item = append(item, marker.content)
+	for n = 1; n < len(lines); n++ {
+		line := lines[n]
+		if isBlank(line) {
+			item = append(item, "")
+			blankBefore = true
+			continue
+		}
+
+		if indentation(line) >= marker.indent {
+			if blankBefore && len(strings.TrimSpace(strings.Join(item, ""))) > 0 {
+				list.loose = true
+			}
+			item = append(item, line[marker.indent:])
+			blankBefore = false
+			continue
+		}
+
+		if next, ok := parseListMarker(line); ok && next.ordered == first.ordered && next.bullet == first.bullet &&
+			!rulePattern.MatchString(line) {
+			endItem()
+			if blankBefore {
+				list.loose = true
+			}
+			marker = next
+			item = []string{marker.content}
+			blankBefore = false
+			continue
+		}
+
+		// A lazy continuation of the item's last paragraph
+		if !blankBefore && !startsBlock(line, depth) && !isBlank(item[len(item)-1]) {
+			item = append(item, strings.TrimLeft(line, " "))
+			continue
+		}
+		break
+	}
+	endItem()
+
+	// Blank lines after the list belong to whatever follows
+	for n > 1 && isBlank(lines[n-1]) {
+		n--
+	}
+	return list, n
+}
+
+// parseParagraph reads the lines of a paragraph, which a setext underline turns into a heading
+func parseParagraph(lines []string, depth int) (*block, int) {
+	text := []string{strings.TrimLeft(lines[0], " ")}
+	n := 1
+	for ; n < len(lines); n++ {
+		line := lines[n]
+		if m := setextPattern.FindStringSubmatch(line); m != nil {
+			level := 1
+			if m[1][0] == '-' {
+				level = 2
+			}
+			return &block{kind: headingBlock, level: level, text: strings.TrimSpace(strings.Join(text, "\n"))}, n + 1
+		}
+		if isBlank(line) || startsBlock(line, depth) {
+			break
+		}
+		text = append(text, strings.TrimLeft(line, " "))
+	}
+	return &block{kind: paragraphBlock, text: strings.TrimSpace(strings.Join(text, "\n"))}, n
+}
+
+// renderer writes blocks as HTML
+type renderer struct {
+	opts Options
+}
+
+// blocks writes a sequence of blocks. Paragraphs of tight list items are written without <p>.
+func (r renderer) blocks(b *strings.Builder, blocks []*block, tight bool) {
+	for i, bl := range blocks {
+		switch bl.kind {
+		case paragraphBlock:
+			if tight {
+				b.WriteString(renderInline(bl.text, r.opts))
+				if i < len(blocks)-1 {
+					b.WriteString("\n")
+				}
+			} else {
+				b.WriteString("<p>" + renderInline(bl.text, r.opts) + "</p>\n")
+			}
+		case headingBlock:
+			tag := "h" + strconv.Itoa(bl.level)
+			b.WriteString("<" + tag + ">" + renderInline(bl.text, r.opts) + "</" + tag + ">\n")
+		case codeBlock:
+			b.WriteString("<pre><code")
+			if bl.language != "" {
+				b.WriteString(` class="language-` + html.EscapeString(bl.language) + `"`)
+			}
+			b.WriteString(">" + html.EscapeString(bl.text) + "</code></pre>\n")
+		case quoteBlock:
+			b.WriteString("<blockquote>\n")
+			r.blocks(b, bl.children, false)
+			b.WriteString("</blockquote>\n")
+		case listBlock:
+			r.list(b, bl)
+		case ruleBlock:
+			b.WriteString("<hr>\n")
+		}
+	}
+}
+
+func (r renderer) list(b *strings.Builder, list *block) {
+	tag := "ul"
+	if list.ordered {
+		tag = "ol"
+		if list.start != 1 {
+			b.WriteString(`<ol start="` + strconv.Itoa(list.start) + `">` + "\n")
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+	for _, item := range list.items {
+		b.WriteString("<li>")
+		r.blocks(b, item, !list.loose)
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+}
@@ -0,0 +1,299 @@
+package markdown
+
+import "testing"
+
+// testOptions links mentions of the users ann and bob.smith only
+var testOptions = Options{MentionURL: func(username string) string {
+	if username == "ann" || username == "bob.smith" {
+		return "/users/" + username
+	}
+	return ""
+}}
+
+type renderTest struct {
+	name string
+	in   string
+	want string
+}
+
+func runRenderTests(t *testing.T, tests []renderTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.in, testOptions); got != tt.want {
+				t.Errorf("Render(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderRawHTML(t *testing.T) {
+	runRenderTests(t, []renderTest{
+		{
+			name: "script",
+			in:   "<script>alert(1)</script>",
+			want: "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n",
+		},
+		{
+			name: "event handler",
+			in:   "<img src=x onerror=alert(1)>",
+			want: "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n",
+		},
+		{
+			name: "allowed tag written as HTML",
+			in:   `a <b onclick="x">bold</b> c`,
+			want: "<p>a &lt;b onclick=&#34;x&#34;&gt;bold&lt;/b&gt; c</p>\n",
+		},
+		{
+			name: "HTML block",
+			in:   "<div>\n<script>\nalert(1)\n</script>\n</div>",
+			want: "<p>&lt;div&gt;\n&lt;script&gt;\nalert(1)\n&lt;/script&gt;\n&lt;/div&gt;</p>\n",
+		},
+		{
+			name: "link written as HTML",
+			in:   `<a href="javascript:alert(1)">x</a>`,
+			want: "<p>&lt;a href=&#34;javascript:alert(1)&#34;&gt;x&lt;/a&gt;</p>\n",
+		},
+		{
+			name: "escaped angle bracket",
+			in:   `\<script>`,
+			want: "<p>&lt;script&gt;</p>\n",
+		},
+		{
+			name: "entities are shown as typed",
+			in:   "&lt;script&gt; &#60;script&#62;",
+			want: "<p>&amp;lt;script&amp;gt; &amp;#60;script&amp;#62;</p>\n",
+		},
+		{
+			name: "script in a code span",
+			in:   "`<script>alert(1)</script>`",
+			want: "<p><code>&lt;script&gt;alert(1)&lt;/script&gt;</code></p>\n",
+		},
+		{
+			name: "script in a fenced code block",
+			in:   "```html\n<script>alert(1)</script>\n```",
+			want: "<pre><code class=\"language-html\">&lt;script&gt;alert(1)&lt;/script&gt;\n</code></pre>\n",
+		},
+		{
+			name: "markup in a fence info string",
+			in:   "```\"><script>x\ncode\n```",
+			want: "<pre><code>code\n</code></pre>\n",
+		},
+	})
+}
+
+func TestRenderLinkSchemes(t *testing.T) {
+	runRenderTests(t, []renderTest{
+		{
+			name: "javascript link",
+			in:   "[x](javascript:alert(1))",
+			want: "<p>x</p>\n",
+		},
+		{
+			name: "mixed case javascript link",
+			in:   "[x](JaVaScRiPt:alert(1))",
+			want: "<p>x</p>\n",
+		},
+		{
+			name: "javascript link padded with spaces",
+			in:   "[x](  javascript:alert(1) )",
+			want: "<p>x</p>\n",
+		},
+		{
+			name: "javascript link in angle brackets",
+			in:   "[x](<javascript:alert(1)>)",
+			want: "<p>x</p>\n",
+		},
+		{
+			name: "colon written as an entity",
+			in:   "[x](javascript&#58;alert(1))",
+			want: "<p><a href=\"javascript&amp;#58;alert(1)\">x</a></p>\n",
+		},
+		{
+			name: "letter written as an entity",
+			in:   "[x](&#x6A;avascript:alert(1))",
+			want: "<p><a href=\"&amp;#x6A;avascript:alert(1)\">x</a></p>\n",
+		},
+		{
+			name: "scheme split by a line break",
+			in:   "[x](java\nscript:alert(1))",
+			want: "<p>[x](java\nscript:alert(1))</p>\n",
+		},
+		{
+			name: "vbscript link",
+			in:   "[x](vbscript:msgbox(1))",
+			want: "<p>x</p>\n",
+		},
+		{
+			name: "data link",
+			in:   "[x](data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==)",
+			want: "<p>x</p>\n",
+		},
+		{
+			name: "javascript image",
+			in:   "![img](javascript:alert(1))",
+			want: "<p>img</p>\n",
+		},
+		{
+			name: "data image",
+			in:   "![img](data:image/png;base64,iVBORw0KGgo=)",
+			want: "<p>img</p>\n",
+		},
+		{
+			name: "image becomes a link",
+			in:   "![a cat](https://example.com/cat.png)",
+			want: "<p><a href=\"https://example.com/cat.png\" rel=\"nofollow ugc\">a cat</a></p>\n",
+		},
+		{
+			name: "javascript autolink",
+			in:   "<javascript:alert(1)>",
+			want: "<p>javascript:alert(1)</p>\n",
+		},
+		{
+			name: "autolink",
+			in:   "<https://example.com/a?b=1&c=2>",
+			want: "<p><a href=\"https://example.com/a?b=1&amp;c=2\" rel=\"nofollow ugc\">https://example.com/a?b=1&amp;c=2</a></p>\n",
+		},
+		{
+			name: "relative link",
+			in:   "[x](/relative/path)",
+			want: "<p><a href=\"/relative/path\">x</a></p>\n",
+		},
+		{
+			name: "mailto link",
+			in:   "[x](mailto:ann@example.com)",
+			want: "<p><a href=\"mailto:ann@example.com\" rel=\"nofollow ugc\">x</a></p>\n",
+		},
+		{
+			name: "quote in a destination",
+			in:   `[x](https://example.com/"onmouseover="alert(1))`,
+			want: "<p><a href=\"https://example.com/&#34;onmouseover=&#34;alert(1)\" rel=\"nofollow ugc\">x</a></p>\n",
+		},
+		{
+			name: "escaped quote in a title",
+			in:   `[x](https://example.com "t\"itle onmouseover=alert(1)")`,
+			want: "<p><a href=\"https://example.com\" title=\"t&#34;itle onmouseover=alert(1)\" rel=\"nofollow ugc\">x</a></p>\n",
+		},
+		{
+			name: "attribute after a title",
+			in:   `[x](https://example.com "a" onmouseover="alert(1)")`,
+			want: "<p>[x](https://example.com &#34;a&#34; onmouseover=&#34;alert(1)&#34;)</p>\n",
+		},
+	})
+}
+
+func TestRenderNesting(t *testing.T) {
+	runRenderTests(t, []renderTest{
+		{
+			name: "strong in emphasis",
+			in:   "*a **b** c*",
+			want: "<p><em>a <strong>b</strong> c</em></p>\n",
+		},
+		{
+			name: "emphasis in strong",
+			in:   "**a *b* c**",
+			want: "<p><strong>a <em>b</em> c</strong></p>\n",
+		},
+		{
+			name: "emphasis and strong together",
+			in:   "***both***",
+			want: "<p><em><strong>both</strong></em></p>\n",
+		},
+		{
+			name: "unclosed delimiters",
+			in:   "*unclosed **mix",
+			want: "<p>*unclosed **mix</p>\n",
+		},
+		{
+			name: "link in emphasis with emphasis inside",
+			in:   "*a [link *em*](https://example.com) b*",
+			want: "<p><em>a <a href=\"https://example.com\" rel=\"nofollow ugc\">link <em>em</em></a> b</em></p>\n",
+		},
+		{
+			name: "strong link text",
+			in:   "[**bold link**](https://example.com)",
+			want: "<p><a href=\"https://example.com\" rel=\"nofollow ugc\"><strong>bold link</strong></a></p>\n",
+		},
+		{
+			name: "link in link text",
+			in:   "[a [b](https://x.io) c](https://y.io)",
+			want: "<p><a href=\"https://y.io\" rel=\"nofollow ugc\">a [b](https://x.io) c</a></p>\n",
+		},
+	})
+}
+
+func TestRenderCode(t *testing.T) {
+	runRenderTests(t, []renderTest{
+		{
+			name: "code span",
+			in:   "`*not em*`",
+			want: "<p><code>*not em*</code></p>\n",
+		},
+		{
+			name: "code span with a backtick",
+			in:   "``a ` b``",
+			want: "<p><code>a ` b</code></p>\n",
+		},
+		{
+			name: "indented code block",
+			in:   "    <b>indented</b>",
+			want: "<pre><code>&lt;b&gt;indented&lt;/b&gt;\n</code></pre>\n",
+		},
+		{
+			name: "fenced code block",
+			in:   "```go\nfmt.Println(\"*hi*\")\n```",
+			want: "<pre><code class=\"language-go\">fmt.Println(&#34;*hi*&#34;)\n</code></pre>\n",
+		},
+	})
+}
+
+func TestRenderMentions(t *testing.T) {
+	runRenderTests(t, []renderTest{
+		{
+			name: "known users",
+			in:   "hi @ann and @bob.smith.",
+			want: "<p>hi <a class=\"mention\" href=\"/users/ann\">@ann</a> and <a class=\"mention\" href=\"/users/bob.smith\">@bob.smith</a>.</p>\n",
+		},
+		{
+			name: "followed by punctuation",
+			in:   "@ann's post",
+			want: "<p><a class=\"mention\" href=\"/users/ann\">@ann</a>&#39;s post</p>\n",
+		},
+		{
+			name: "unknown user",
+			in:   "@nobody here",
+			want: "<p>@nobody here</p>\n",
+		},
+		{
+			name: "after a letter",
+			in:   "email@ann and x@ann",
+			want: "<p>email@ann and x@ann</p>\n",
+		},
+		{
+			name: "after another @",
+			in:   "@@ann",
+			want: "<p>@@ann</p>\n",
+		},
+		{
+			name: "longer username",
+			in:   "@ann_",
+			want: "<p>@ann_</p>\n",
+		},
+		{
+			name: "in link text",
+			in:   "[see @ann](https://example.com)",
+			want: "<p><a href=\"https://example.com\" rel=\"nofollow ugc\">see @ann</a></p>\n",
+		},
+		{
+			name: "in a code span",
+			in:   "`@ann`",
+			want: "<p><code>@ann</code></p>\n",
+		},
+	})
+}
+
+func TestRenderWithoutMentionURL(t *testing.T) {
+	if got, want := Render("@ann", Options{}), "<p>@ann</p>\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
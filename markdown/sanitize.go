@@ -0,0 +1,271 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// allowedAttributes lists the tags Sanitize keeps and the attributes each of them may carry
+var allowedAttributes = map[string][]string{
+	"p": nil, "br": nil, "hr": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"em": nil, "strong": nil, "code": {"class"}, "pre": nil, "blockquote": nil,
+	"ul": nil, "ol": {"start"}, "li": nil,
+	"a": {"href", "title", "class"},
+}
+
+// voidTags have no content and no end tag
+var voidTags = map[string]bool{"br": true, "hr": true}
+
+// droppedTags are removed together with their content rather than unwrapped
+var droppedTags = map[string]bool{
+	"script": true, "style": true, "textarea": true, "title": true, "iframe": true, "object": true,
+	"noscript": true, "noembed": true, "noframes": true, "template": true, "xmp": true, "svg": true, "math": true,
+}
+
+// allowedSchemes are the URL schemes links may use; URLs without a scheme are relative
+var allowedSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+var (
+	languageClassPattern = regexp.MustCompile(`^language-[\w+#.-]+$`)
+	startPattern         = regexp.MustCompile(`^\d{1,9}$`)
+)
+
+// urlScheme returns the lowercased scheme of u, or "" for relative URLs
+func urlScheme(u string) string {
+	u = strings.TrimSpace(u)
+	colon := strings.IndexByte(u, ':')
+	if colon < 0 {
+		return ""
+	}
+	// A colon after the path, query or fragment has begun is not a scheme separator
+	if i := strings.IndexAny(u, "/?#"); i >= 0 && i < colon {
+		return ""
+	}
+	return strings.ToLower(u[:colon])
+}
+
+// safeURL reports whether a link may point to u: relative URLs and those with an allowed scheme
+func safeURL(u string) bool {
+	scheme := urlScheme(u)
+	return scheme == "" || allowedSchemes[scheme]
+}
+
+// allowedAttribute reports whether an attribute of an allowed tag may keep its value
+func allowedAttribute(tag, name, value string) bool {
+	switch name {
+	case "href":
+		return safeURL(value)
+	case "title":
+		return true
+	case "class":
+		if tag == "a" {
+			return value == "mention"
+		}
+		return languageClassPattern.MatchString(value)
+	case "start":
+		return startPattern.MatchString(value)
+	}
+	return false
+}
+
+// attribute is a parsed attribute of a tag
+type attribute struct {
+	name, value string
+}
+
+// Sanitize keeps only allowlisted tags and attributes of an HTML fragment. Other tags are
+// removed while their text is kept, except for the content of scripts, styles and the like,
+// which is removed too. Links may only use http, https and mailto URLs or relative ones, and
+// those leaving the site are marked rel="nofollow ugc". Text is re-escaped and every tag left
+// open is closed, so the result is well-formed.
+func Sanitize(fragment string) string {
+	var b strings.Builder
+	var open []string // allowed tags left open, innermost last
+
+	writeText := func(text string) {
+		b.WriteString(html.EscapeString(html.UnescapeString(text)))
+	}
+
+	for i := 0; i < len(fragment); {
+		lt := strings.IndexByte(fragment[i:], '<')
+		if lt < 0 {
+			writeText(fragment[i:])
+			break
+		}
+		writeText(fragment[i : i+lt])
+		i += lt
+
+		rest := fragment[i:]
+		switch {
+		case strings.HasPrefix(rest, "<!--"):
+			end := strings.Index(rest[4:], "-->")
+			if end < 0 {
+				return closeTags(&b, open)
+			}
+			i += 4 + end + 3
+
+		case strings.HasPrefix(rest, "<!") || strings.HasPrefix(rest, "<?") ||
+			(strings.HasPrefix(rest, "</") && len(rest) > 2 && !isASCIILetter(rest[2])):
+			// Doctypes, processing instructions and other bogus comments
+			end := strings.IndexByte(rest, '>')
+			if end < 0 {
+				return closeTags(&b, open)
+			}
+			i += end + 1
+
+		case strings.HasPrefix(rest, "</") && len(rest) > 2:
+			name, _, end, ok := parseTag(rest[2:])
+			if !ok {
+				writeText(rest)
+				return closeTags(&b, open)
+			}
+			i += 2 + end
+			for j := len(open) - 1; j >= 0; j-- {
+				if open[j] == name {
+					for _, tag := range reversed(open[j:]) {
+						b.WriteString("</" + tag + ">")
+					}
+					open = open[:j]
+					break
+				}
+			}
+
+		case len(rest) > 1 && isASCIILetter(rest[1]):
+			name, attrs, end, ok := parseTag(rest[1:])
+			if !ok {
+				writeText(rest)
+				return closeTags(&b, open)
+			}
+			i += 1 + end
+
+			if droppedTags[name] {
+				closing := strings.Index(strings.ToLower(fragment[i:]), "</"+name)
+				if closing < 0 {
+					return closeTags(&b, open)
+				}
+				i += closing
+				continue
+			}
+			allowed, ok := allowedAttributes[name]
+			if !ok {
+				continue
+			}
+			b.WriteString(startTag(name, attrs, allowed))
+			if !voidTags[name] {
+				open = append(open, name)
+			}
+
+		default:
+			b.WriteString("&lt;")
+			i++
+		}
+	}
+	return closeTags(&b, open)
+}
+
+// startTag writes the start tag of an allowed tag with the attributes it may keep
+func startTag(name string, attrs []attribute, allowed []string) string {
+	var b strings.Builder
+	b.WriteString("<" + name)
+	seen := map[string]bool{}
+	external := false
+	for _, attr := range attrs {
+		if seen[attr.name] || !contains(allowed, attr.name) || !allowedAttribute(name, attr.name, attr.value) {
+			continue
+		}
+		seen[attr.name] = true
+		if attr.name == "href" {
+			external = urlScheme(attr.value) != "" || strings.HasPrefix(strings.TrimSpace(attr.value), "//")
+		}
+		b.WriteString(" " + attr.name + `="` + html.EscapeString(attr.value) + `"`)
+	}
+	if name == "a" && external {
+		b.WriteString(` rel="nofollow ugc"`)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// parseTag parses the name and attributes of a tag after its < or </, returning where the
+// tag ends. Names are lowercased and attribute values unescaped.
+func parseTag(s string) (name string, attrs []attribute, end int, ok bool) {
+	i := 0
+	for i < len(s) && (isASCIILetter(s[i]) || s[i] >= '0' && s[i] <= '9') {
+		i++
+	}
+	name = strings.ToLower(s[:i])
+
+	for i < len(s) {
+		switch c := s[i]; {
+		case c == '>':
+			return name, attrs, i + 1, true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '/':
+			i++
+		default:
+			start := i
+			for i < len(s) && !strings.ContainsRune(" \t\n\r\f/>=", rune(s[i])) {
+				i++
+			}
+			attr := attribute{name: strings.ToLower(s[start:i])}
+			j := i
+			for j < len(s) && strings.ContainsRune(" \t\n\r\f", rune(s[j])) {
+				j++
+			}
+			if j < len(s) && s[j] == '=' {
+				j++
+				for j < len(s) && strings.ContainsRune(" \t\n\r\f", rune(s[j])) {
+					j++
+				}
+				if j < len(s) && (s[j] == '"' || s[j] == '\'') {
+					closing := strings.IndexByte(s[j+1:], s[j])
+					if closing < 0 {
+						return "", nil, 0, false
+					}
+					attr.value = s[j+1 : j+1+closing]
+					j += closing + 2
+				} else {
+					start := j
+					for j < len(s) && !strings.ContainsRune(" \t\n\r\f>", rune(s[j])) {
+						j++
+					}
+					attr.value = s[start:j]
+				}
+				i = j
+			}
+			attr.value = html.UnescapeString(attr.value)
+			attrs = append(attrs, attr)
+		}
+	}
+	return "", nil, 0, false
+}
+
+// closeTags closes the tags left open and returns the sanitized fragment
+func closeTags(b *strings.Builder, open []string) string {
+	for _, tag := range reversed(open) {
+		b.WriteString("</" + tag + ">")
+	}
+	return b.String()
+}
+
+func reversed(tags []string) []string {
+	r := make([]string, len(tags))
+	for i, tag := range tags {
+		r[len(tags)-1-i] = tag
+	}
+	return r
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
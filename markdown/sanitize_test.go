@@ -0,0 +1,62 @@
+package markdown
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"script", "<script>alert(1)</script>ok", "ok"},
+		{"uppercase script", "<SCRIPT>alert(1)</SCRIPT>ok", "ok"},
+		{"script split by a script", "<scr<script>ipt>alert(1)</script>", "ipt&gt;alert(1)"},
+		{"script in svg", "<svg><script>alert(1)</script></svg>after", "after"},
+		{"script in textarea", "<textarea><script>alert(1)</script></textarea>after", "after"},
+		{"style", "<style>body{}</style>after", "after"},
+		{"iframe", `<iframe src="https://evil"></iframe>after`, "after"},
+		{"image", "<img src=x onerror=alert(1)>", ""},
+		{"event handlers", `<p onclick="alert(1)" onmouseover=alert(1)>x</p>`, "<p>x</p>"},
+		{"comment", "<!-- <script>alert(1)</script> -->after", "after"},
+		{"unterminated comment", "<!-- unterminated <script>", ""},
+		{"doctype", "<!DOCTYPE html><p>x</p>", "<p>x</p>"},
+
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"mixed case javascript link", `<A HREF="JaVaScRiPt:alert(1)">x</A>`, "<a>x</a>"},
+		{"javascript link after a space", `<a href=" javascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"letter written as an entity", `<a href="&#106;avascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"tab written as an entity", `<a href="java&#x09;script:alert(1)">x</a>`, "<a>x</a>"},
+		{"scheme written as entities", `<a href="&#x6A;&#x61;&#x76;&#x61;&#x73;&#x63;&#x72;&#x69;&#x70;&#x74;&#x3A;alert(1)">x</a>`, "<a>x</a>"},
+		{"colon written as a named entity", `<a href="javascript&colon;alert(1)">x</a>`, "<a>x</a>"},
+		{"data link", `<a href="data:text/html,<script>alert(1)</script>">x</a>`, "<a>x</a>"},
+		{"colon in a relative path", `<a href="/ok:still-relative">x</a>`, `<a href="/ok:still-relative">x</a>`},
+		{"protocol-relative link", `<a href="//evil.example">x</a>`, `<a href="//evil.example" rel="nofollow ugc">x</a>`},
+		{"first of repeated attributes", `<a href="https://example.com" href="javascript:alert(1)">x</a>`,
+			`<a href="https://example.com" rel="nofollow ugc">x</a>`},
+		{"unsafe repeated attribute skipped", `<a href="javascript:alert(1)" href="https://example.com">x</a>`,
+			`<a href="https://example.com" rel="nofollow ugc">x</a>`},
+		{"quotes in a title", `<a title="a&quot; onclick=&quot;alert(1)">x</a>`, `<a title="a&#34; onclick=&#34;alert(1)">x</a>`},
+		{"unquoted handler", `<a href='x' onclick=alert(1)//>x</a>`, `<a href="x">x</a>`},
+		{"angle bracket in a value", `<a href="x>y">z</a>`, `<a href="x&gt;y">z</a>`},
+
+		{"mention class", `<a class="mention" href="/users/ann">@ann</a>`, `<a class="mention" href="/users/ann">@ann</a>`},
+		{"other link class", `<a class="evil">x</a>`, "<a>x</a>"},
+		{"language class", `<code class="language-go">x</code>`, `<code class="language-go">x</code>`},
+		{"invalid language class", `<code class="language-go onclick=x">x</code>`, "<code>x</code>"},
+		{"list start", `<ol start="3"><li>x</li></ol>`, `<ol start="3"><li>x</li></ol>`},
+		{"invalid list start", `<ol start="3 onclick=x"><li>x</li></ol>`, "<ol><li>x</li></ol>"},
+
+		{"unclosed tags", "<p>unclosed <strong>tags", "<p>unclosed <strong>tags</strong></p>"},
+		{"stray end tags", "</p></em>stray closers", "stray closers"},
+		{"misnested tags", "<em><strong>misnested</em></strong>", "<em><strong>misnested</strong></em>"},
+		{"lone angle brackets", "a < b and c > d", "a &lt; b and c &gt; d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sanitize(tt.in); got != tt.want {
+				t.Errorf("Sanitize(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"forum/config"
+	"forum/db"
+	"os"
+	"strconv"
+)
+
+const migrateUsage = `usage: forum [flags] migrate <command>
+
+commands:
+  up          apply all pending migrations
+  down [n]    roll back the last n applied migrations (default 1)
+  status      list migrations and whether they are applied`
+
+// runMigrateCommand handles "forum migrate ..." and returns the process exit code
+func runMigrateCommand(cfg *config.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	if err := db.Open(cfg.DatabasePath); err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err)
+		return 1
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		if err := db.Migrate(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error applying migrations:", err)
+			return 1
+		}
+		fmt.Println("Database is up to date")
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				fmt.Fprintln(os.Stderr, "Invalid number of migrations to roll back:", args[1])
+				return 2
+			}
+			steps = n
+		}
+		if err := db.Rollback(steps); err != nil {
+			fmt.Fprintln(os.Stderr, "Error rolling back migrations:", err)
+			return 1
+		}
+
+	case "status":
+		statuses, err := db.Status()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading migration status:", err)
+			return 1
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", status.Version, status.Name, applied)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"forum/config"
+	"forum/db"
+	"forum/handlers"
+	"os"
+)
+
+const roleUsage = `usage: forum [flags] role <username|email> <user|moderator|admin>
+
+Sets the role of an account, for example to create the first admin.`
+
+// runRoleCommand handles "forum role ..." and returns the process exit code
+func runRoleCommand(cfg *config.Config, args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, roleUsage)
+		return 2
+	}
+
+	role, err := handlers.ParseRole(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	// The role column only exists once migrations ran
+	if err := db.Initialize(cfg.DatabasePath); err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+		return 1
+	}
+	defer db.Close()
+
+	id, err := handlers.SetUserRole(db.DB, args[0], role)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error setting role:", err)
+		return 1
+	}
+	fmt.Printf("User %s (id %d) is now %s\n", args[0], id, role)
+	return 0
+}
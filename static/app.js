@@ -1,10 +1,16 @@
 // Global state
 let currentUser = null;
+const loadedPosts = {}; // posts shown in the feed, by id
 
-// Initialize the application
-document.addEventListener('DOMContentLoaded', function() {
-    loadPosts(); // Load posts when page loads
-});
+// Infinite scroll state for the posts feed
+let nextPostsCursor = null;
+let loadingPosts = false;
+
+// While a search query is set the feed shows search results instead of posts
+let searchQuery = '';
+
+// Stream of new posts, comments and reactions, following the category filter
+let liveEvents = null;
 
 // UI Helper Functions
 function showLoginForm() {
@@ -52,8 +58,7 @@ async function handleCreatePost(event) {
             body: JSON.stringify({
                 title,
                 content,
-                categories,
-                userId: currentUser.id // Include user ID if needed
+                categories
             }),
             credentials: 'include' // Important for sending cookies
         });
@@ -63,7 +68,10 @@ async function handleCreatePost(event) {
             document.getElementById('postTitle').value = '';
             document.getElementById('postContent').value = '';
             categoriesSelect.selectedIndex = -1;
-            alert('Post created successfully!');
+            const data = await response.json();
+            alert(data.status === 'pending'
+                ? 'Your post was submitted and will appear once a moderator approves it.'
+                : 'Post created successfully!');
             loadPosts();
         } else {
             const errorData = await response.json();
@@ -75,20 +83,37 @@ async function handleCreatePost(event) {
     }
 }
 
+// Populate the category filter and the create-post form from the server
+async function loadCategories() {
+    try {
+        const response = await fetch('/categories');
+        if (!response.ok) {
+            throw new Error('Failed to fetch categories');
+        }
+        const categories = await response.json();
+
+        const filter = document.getElementById('categoryFilter');
+        const postCategories = document.getElementById('postCategories');
+        filter.innerHTML = '<option value="">All Categories</option>';
+        postCategories.innerHTML = '';
+
+        categories.forEach(category => {
+            filter.innerHTML += `<option value="${escapeHtml(category.slug)}">${escapeHtml(category.name)} (${category.post_count})</option>`;
+            postCategories.innerHTML += `<option value="${escapeHtml(category.slug)}">${escapeHtml(category.name)}</option>`;
+        });
+    } catch (error) {
+        console.error('Error:', error);
+    }
+}
+
 // Filter functions
+// The category, "my posts" and "liked posts" filters can be combined
+const postFilters = { category: '', created: false, liked: false };
+
 function filterPosts() {
-    const category = document.getElementById('categoryFilter').value;
-    if (category) {
-        fetch(`/category?category=${encodeURIComponent(category)}`)
-            .then(response => response.json())
-            .then(posts => displayPosts(posts))
-            .catch(error => {
-                console.error('Error:', error);
-                alert('Failed to filter posts');
-            });
-    } else {
-        loadPosts();
-    }
+    postFilters.category = document.getElementById('categoryFilter').value;
+    subscribeToEvents();
+    loadPosts();
 }
 
 function showCreatedPosts() {
@@ -96,7 +121,8 @@ function showCreatedPosts() {
         alert('Please login to view your posts');
         return;
     }
-    // Add logic to fetch and display user's created posts
+    postFilters.created = !postFilters.created;
+    loadPosts();
 }
 
 function showLikedPosts() {
@@ -104,7 +130,36 @@ function showLikedPosts() {
         alert('Please login to view liked posts');
         return;
     }
-    // Add logic to fetch and display user's liked posts
+    postFilters.liked = !postFilters.liked;
+    loadPosts();
+}
+
+function handleSearch(event) {
+    event.preventDefault();
+    searchQuery = document.getElementById('searchInput').value.trim();
+    loadPosts();
+}
+
+// Search results honour the category and "my posts" filters
+function searchParams() {
+    const params = new URLSearchParams({ q: searchQuery });
+    if (postFilters.category) params.set('category', postFilters.category);
+    if (postFilters.created && currentUser) params.set('author', currentUser.username);
+    return params.toString();
+}
+
+function postsQuery() {
+    const params = new URLSearchParams();
+    if (postFilters.category) params.set('category', postFilters.category);
+    if (postFilters.created) params.set('created', 'true');
+    if (postFilters.liked) params.set('liked', 'true');
+    return params.toString();
+}
+
+// Explain a ban, suspension or mute to the affected user
+function describeSanction(sanction) {
+    const until = sanction.expires_at ? `until ${new Date(sanction.expires_at).toLocaleString()}` : 'permanently';
+    return `${sanction.reason} (${until})`;
 }
 
 // API Functions
@@ -125,14 +180,24 @@ async function handleLogin(event) {
 
         if (response.ok) {
             const data = await response.json();
-            currentUser = { username: data.username }; // Store the username from the backend response
+            currentUser = { username: data.username, role: data.role, email_verified: data.email_verified }; // Store the username, role and verification from the backend response
             document.getElementById('loginForm').style.display = 'none';
-            alert('Login successful!');
+            if (data.mute) {
+                alert(`Login successful, but your account is muted: ${describeSanction(data.mute)}`);
+            } else if (!data.email_verified) {
+                alert('Login successful! Confirm your email address with the link we sent you before posting.');
+            } else {
+                alert('Login successful!');
+            }
             loadPosts(); // Reload posts or any other relevant content
             updateUIForLoggedInUser(); // Update UI to reflect logged-in state
         } else {
-            const errorData = await response.json();
-            alert(errorData.error || 'Login failed. Please check your credentials.');
+            const errorData = await response.json().catch(() => ({}));
+            if (errorData.sanction) {
+                alert(`${errorData.error}: ${describeSanction(errorData.sanction)}`);
+            } else {
+                alert(errorData.error || 'Login failed. Please check your credentials.');
+            }
         }
     } catch (error) {
         console.error('Error:', error);
@@ -144,11 +209,18 @@ function updateUIForLoggedInUser() {
     const navLinks = document.querySelector('.nav-links');
     if (currentUser && currentUser.username) {
         // User is logged in
+        const resend = currentUser.email_verified === false
+            ? '<button class="btn" onclick="resendVerification()">Resend confirmation email</button>'
+            : '';
         navLinks.innerHTML = `
             <span>Welcome, ${currentUser.username}</span>
+            <button class="btn" id="notificationsButton" onclick="toggleNotifications()">Notifications</button>
+            <a href="/inbox" class="btn">Messages</a>
+            ${resend}
             <button class="btn" onclick="showCreatePostForm()">Create Post</button>
             <button class="btn" onclick="handleLogout()">Logout</button>
         `;
+        updateUnreadNotifications();
     } else {
         // User is logged out, show Login and Register links styled correctly
         navLinks.innerHTML = `
@@ -159,6 +231,81 @@ function updateUIForLoggedInUser() {
 }
 
 
+// Show how many notifications are unread on the notifications button
+async function updateUnreadNotifications() {
+    const button = document.getElementById('notificationsButton');
+    if (!button) return;
+    try {
+        const response = await fetch('/notifications/unread-count');
+        if (!response.ok) return;
+        const data = await response.json();
+        button.textContent = data.unread > 0 ? `Notifications (${data.unread})` : 'Notifications';
+    } catch (error) {
+        console.error('Error fetching notifications:', error);
+    }
+}
+
+async function toggleNotifications() {
+    const panel = document.getElementById('notificationsPanel');
+    if (panel.style.display !== 'none') {
+        panel.style.display = 'none';
+        return;
+    }
+    try {
+        const response = await fetch('/notifications?limit=20');
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
+        const page = await response.json();
+        displayNotifications(page.items);
+        panel.style.display = 'block';
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to load notifications.');
+    }
+}
+
+function displayNotifications(notifications) {
+    const list = document.getElementById('notificationsList');
+    if (notifications.length === 0) {
+        list.innerHTML = '<p>No notifications yet.</p>';
+        return;
+    }
+    list.innerHTML = notifications.map(n => `
+        <div class="notification${n.read ? '' : ' unread'}" data-id="${n.id}" onclick="markNotificationsRead([${n.id}])">
+            <p>${escapeHtml(n.message)}</p>
+            <span>${new Date(n.created_at).toLocaleString()}</span>
+        </div>
+    `).join('');
+}
+
+// Mark the notifications with the given ids as read, or all of them without ids
+async function markNotificationsRead(ids) {
+    try {
+        const response = await fetch('/notifications/read', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(ids ? { ids } : { all: true }),
+        });
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
+        if (ids) {
+            ids.forEach(id => {
+                const item = document.querySelector(`.notification[data-id="${id}"]`);
+                if (item) item.classList.remove('unread');
+            });
+        } else {
+            document.querySelectorAll('.notification.unread').forEach(item => item.classList.remove('unread'));
+        }
+        updateUnreadNotifications();
+    } catch (error) {
+        console.error('Error:', error);
+    }
+}
+
 async function checkLoginStatus() {
     try {
         const response = await fetch('/check-session', {
@@ -174,6 +321,55 @@ async function checkLoginStatus() {
     }
 }
 
+// Send a new link confirming the current user's email address
+async function resendVerification() {
+    try {
+        const response = await fetch('/account/resend-verification', { method: 'POST' });
+        if (response.ok) {
+            const data = await response.json();
+            alert(data.message);
+        } else {
+            alert(await response.text());
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to send the confirmation email.');
+    }
+}
+
+// Ask for the account's email address and have a password reset link sent to it
+async function handleForgotPassword() {
+    const email = prompt('Email address of your account:', document.getElementById('loginEmail').value);
+    if (!email) return;
+
+    try {
+        const response = await fetch('/account/forgot-password', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ email }),
+        });
+        if (response.ok) {
+            const data = await response.json();
+            alert(data.message);
+        } else {
+            alert(await response.text());
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to request a password reset.');
+    }
+}
+
+// Confirm the result of an email verification link, which redirects here
+function showEmailVerified() {
+    const params = new URLSearchParams(window.location.search);
+    const purpose = params.get('email_verified');
+    if (!purpose) return;
+
+    history.replaceState(null, '', window.location.pathname);
+    alert(purpose === 'email_change' ? 'Your email address was changed.' : 'Your email address is confirmed. You can now post.');
+}
+
 async function handleRegister(event) {
     event.preventDefault();
     const email = document.getElementById('registerEmail').value;
@@ -190,7 +386,7 @@ async function handleRegister(event) {
         });
 
         if (response.ok) {
-            alert('Registration successful! Please login.');
+            alert('Registration successful! Confirm your email address with the link we sent you, then login.');
             showLoginForm();
         } else {
             const errorData = await response.json();
@@ -240,97 +436,416 @@ async function handleCreatePost(event) {
     }
 }
 
+// Load the first page of posts, replacing whatever is displayed
 async function loadPosts() {
+    nextPostsCursor = null;
+    await fetchPostsPage(false);
+}
+
+// Append the next page of posts when the user scrolls to the bottom of the feed
+async function loadMorePosts() {
+    if (!nextPostsCursor) return;
+    await fetchPostsPage(true);
+}
+
+async function fetchPostsPage(append) {
+    if (loadingPosts) return;
+    loadingPosts = true;
+
     try {
-        const response = await fetch('/posts');
+        const searching = searchQuery !== '';
+        const params = new URLSearchParams(searching ? searchParams() : postsQuery());
+        if (append && nextPostsCursor) params.set(searching ? 'cursor' : 'before', nextPostsCursor);
+        const response = await fetch(`${searching ? '/search' : '/posts'}?${params.toString()}`, { credentials: 'include' });
         if (!response.ok) {
-            throw new Error('Failed to fetch posts');
+            throw new Error(searching ? await response.text() : 'Failed to fetch posts');
+        }
+        const page = await response.json();
+        nextPostsCursor = page.next_cursor || null;
+        if (searching) {
+            displaySearchResults(page.items, append);
+        } else {
+            displayPosts(page.items, append);
         }
-        const posts = await response.json();
-        displayPosts(posts);
     } catch (error) {
         console.error('Error:', error);
         alert('Failed to load posts.');
+    } finally {
+        loadingPosts = false;
     }
 }
 
-function displayPosts(posts) {
+function setupInfiniteScroll() {
+    const sentinel = document.getElementById('postsSentinel');
+    if (!sentinel || !('IntersectionObserver' in window)) return;
+
+    const observer = new IntersectionObserver(entries => {
+        if (entries.some(entry => entry.isIntersecting)) {
+            loadMorePosts();
+        }
+    });
+    observer.observe(sentinel);
+}
+
+function displayPosts(posts, append = false) {
     const container = document.getElementById('postsContainer');
     if (!container) return;
 
-    container.innerHTML = '';
+    if (!append) {
+        container.innerHTML = '';
+    }
     if (!Array.isArray(posts) || posts.length === 0) {
-        container.innerHTML = '<p>No posts available.</p>';
+        if (!append) {
+            container.innerHTML = '<p>No posts available.</p>';
+        }
+        return;
+    }
+
+    posts.forEach(post => container.appendChild(postElement(post)));
+}
+
+function postElement(post) {
+    loadedPosts[post.id] = post;
+    const element = document.createElement('div');
+    element.className = 'post';
+    element.id = `post-${post.id}`;
+element.innerHTML = `
+        <div class="post-header">
+            <h3>${post.locked ? '🔒 ' : ''}${escapeHtml(post.title)}</h3>
+            ${post.status && post.status !== 'approved' ? `<span class="status-badge">${escapeHtml(post.status)}</span>` : ''}
+            <span>Posted by ${authorLink(post.author)}</span>
+            ${editedMarker('post', post)}
+        </div>
+        <div class="post-categories">
+            ${post.categories ? post.categories.map(category => 
+                `<span class="category-tag">${escapeHtml(category.name)}</span>`
+            ).join('') : ''}
+        </div>
+        <div class="content">${post.content_html}</div>
+        <div class="reaction-buttons" id="post-reactions-${post.id}">
+            <button class="reaction-btn like-btn ${post.viewer_reaction === 'LIKE' ? 'active' : ''}" onclick="handleReaction(${post.id}, 'like')">
+                👍 <span>${post.likes || 0}</span>
+            </button>
+            <button class="reaction-btn dislike-btn ${post.viewer_reaction === 'DISLIKE' ? 'active' : ''}" onclick="handleReaction(${post.id}, 'dislike')">
+                👎 <span>${post.dislikes || 0}</span>
+            </button>
+            <button class="reaction-btn comment-count" onclick="toggleComments(${post.id})">
+                💬 <span>${post.comment_count || 0}</span>
+            </button>
+            ${isOwnContent(post) && !post.locked ? `
+                <button class="reaction-btn" onclick="editPost(${post.id})">Edit</button>
+            ` : ''}
+            ${isOwnContent(post) || canModerate() ? `
+                <button class="reaction-btn" onclick="deletePost(${post.id})">Delete</button>
+            ` : ''}
+            ${currentUser && !isOwnContent(post) ? `
+                <button class="reaction-btn" onclick="reportContent('post', ${post.id})">Report</button>
+            ` : ''}
+            ${canModerate() ? `
+                <button class="reaction-btn" onclick="lockContent('post', ${post.id}, ${!post.locked})">${post.locked ? 'Unlock' : 'Lock'}</button>
+            ` : ''}
+        </div>
+        <div class="comments" id="comments-${post.id}" style="display: none;">
+            <div class="comment-list"></div>
+            ${currentUser && !post.locked ? `
+                <form onsubmit="handleAddComment(event, ${post.id})" class="comment-form">
+                    <div class="form-group">
+                        <textarea required placeholder="Add a comment..." class="comment-input"></textarea>
+                    </div>
+                    <button type="submit" class="btn btn-secondary">Comment</button>
+                </form>
+            ` : ''}
+        </div>
+    `;
+    return element;
+}
+
+// Snippets come from the server already escaped, with the matched terms in <mark> tags
+function displaySearchResults(results, append = false) {
+    const container = document.getElementById('postsContainer');
+    if (!container) return;
+
+    if (!append) {
+        container.innerHTML = '';
+    }
+    if (!Array.isArray(results) || results.length === 0) {
+        if (!append) {
+            container.innerHTML = `<p>No results for "${escapeHtml(searchQuery)}".</p>`;
+        }
         return;
     }
 
-    posts.forEach(post => {
-        const postElement = document.createElement('div');
-        postElement.className = 'post';
-        postElement.innerHTML = `
+    results.forEach(result => {
+        const resultElement = document.createElement('div');
+        resultElement.className = 'post search-result';
+        resultElement.innerHTML = `
             <div class="post-header">
-                <h3>${escapeHtml(post.title)}</h3>
-                <span>Posted by ${escapeHtml(post.username)}</span>
-            </div>
-            <div class="post-categories">
-                ${post.categories ? post.categories.map(category => 
-                    `<span class="category-tag">${escapeHtml(category)}</span>`
-                ).join('') : ''}
-            </div>
-            <p>${escapeHtml(post.content)}</p>
-            <div class="reaction-buttons">
-                <button class="reaction-btn" onclick="handleReaction(${post.id}, 'like')">
-                    👍 <span>${post.likes || 0}</span>
-                </button>
-                <button class="reaction-btn" onclick="handleReaction(${post.id}, 'dislike')">
-                    👎 <span>${post.dislikes || 0}</span>
-                </button>
-            </div>
-            <div class="comments" id="comments-${post.id}">
-                ${renderComments(post.comments)}
-                ${currentUser ? `
-                    <form onsubmit="handleAddComment(event, ${post.id})" class="comment-form">
-                        <div class="form-group">
-                            <textarea required placeholder="Add a comment..." class="comment-input"></textarea>
-                        </div>
-                        <button type="submit" class="btn btn-secondary">Comment</button>
-                    </form>
-                ` : ''}
+                <h3>${result.type === 'comment' ? 'Comment on ' : ''}${escapeHtml(result.post_title)}</h3>
+                <span>By ${authorLink(result.author)} on ${new Date(result.created_at).toLocaleDateString()}</span>
             </div>
+            <p>${result.snippet}</p>
         `;
-        container.appendChild(postElement);
+        container.appendChild(resultElement);
     });
 }
 
-function escapeHtml(unsafe) {
-    if (!unsafe) return '';
-    return unsafe
-        .replace(/&/g, "&amp;")
-        .replace(/</g, "&lt;")
-        .replace(/>/g, "&gt;")
-        .replace(/"/g, "&quot;")
-        .replace(/'/g, "&#039;");
+// Usernames link to their profile page, except the placeholder for deleted accounts
+function authorLink(username) {
+    if (!username) return '';
+    if (username === '[deleted]') return escapeHtml(username);
+    return `<a class="author-link" href="/users/${encodeURIComponent(username)}">${escapeHtml(username)}</a>`;
+}
+
+// Comments are only fetched when a post's comment section is opened
+async function toggleComments(postId) {
+    const section = document.getElementById(`comments-${postId}`);
+    if (!section) return;
+
+    if (section.style.display !== 'none') {
+        section.style.display = 'none';
+        return;
+    }
+    section.style.display = 'block';
+    await loadComments(postId);
+}
+
+async function loadComments(postId) {
+    const list = document.querySelector(`#comments-${postId} .comment-list`);
+    if (!list) return;
+
+    try {
+        const response = await fetch(`/get-comments?post_id=${postId}`);
+        if (!response.ok) {
+            throw new Error('Failed to fetch comments');
+        }
+        const page = await response.json();
+        list.innerHTML = renderComments(page.items);
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to load comments.');
+    }
 }
 
 function renderComments(comments) {
     if (!comments || !Array.isArray(comments) || comments.length === 0) return '';
     
-    return comments.map(comment => `
-        <div class="comment">
-            <p>${escapeHtml(comment.content)}</p>
-            <small>By ${escapeHtml(comment.username)}</small>
-            <div class="reaction-buttons">
-                <button class="reaction-btn" onclick="handleCommentReaction(${comment.id}, 'like')">
+    return comments.map(comment => comment.deleted ? `
+        <div class="comment deleted" id="comment-${comment.id}">
+            <p><em>[deleted]</em></p>
+            <div class="replies" id="replies-${comment.id}">
+                ${renderComments(comment.replies)}
+            </div>
+        </div>
+    ` : `
+        <div class="comment" id="comment-${comment.id}" data-content="${escapeHtml(comment.content)}">
+            <div class="content">${comment.content_html}</div>
+            <small>By ${authorLink(comment.author)} ${editedMarker('comment', comment)} ${comment.locked ? '🔒' : ''}</small>
+            <div class="reaction-buttons" id="comment-reactions-${comment.id}">
+                <button class="reaction-btn like-btn" onclick="handleCommentReaction(${comment.id}, 'like')">
                     👍 <span>${comment.likes || 0}</span>
                 </button>
-                <button class="reaction-btn" onclick="handleCommentReaction(${comment.id}, 'dislike')">
+                <button class="reaction-btn dislike-btn" onclick="handleCommentReaction(${comment.id}, 'dislike')">
                     👎 <span>${comment.dislikes || 0}</span>
                 </button>
+                ${currentUser && !comment.locked ? `
+                    <button class="reaction-btn" onclick="toggleReplyForm(${comment.id})">Reply</button>
+                ` : ''}
+                ${isOwnContent(comment) && !comment.locked ? `
+                    <button class="reaction-btn" onclick="editComment(${comment.post_id}, ${comment.id})">Edit</button>
+                ` : ''}
+                ${isOwnContent(comment) || canModerate() ? `
+                    <button class="reaction-btn" onclick="deleteComment(${comment.post_id}, ${comment.id})">Delete</button>
+                ` : ''}
+                ${currentUser && !isOwnContent(comment) ? `
+                    <button class="reaction-btn" onclick="reportContent('comment', ${comment.id})">Report</button>
+                ` : ''}
+                ${canModerate() ? `
+                    <button class="reaction-btn" onclick="lockContent('comment', ${comment.id}, ${!comment.locked}, ${comment.post_id})">${comment.locked ? 'Unlock' : 'Lock'}</button>
+                ` : ''}
+            </div>
+            ${currentUser ? `
+                <form onsubmit="handleAddComment(event, ${comment.post_id}, ${comment.id})" class="comment-form reply-form" id="reply-form-${comment.id}" style="display: none;">
+                    <div class="form-group">
+                        <textarea required placeholder="Write a reply..." class="comment-input"></textarea>
+                    </div>
+                    <button type="submit" class="btn btn-secondary">Reply</button>
+                </form>
+            ` : ''}
+            <div class="replies" id="replies-${comment.id}">
+                ${renderComments(comment.replies)}
+                ${comment.collapsed_count ? `
+                    <button class="btn-link" onclick="loadReplies(${comment.post_id}, ${comment.id})">
+                        Show ${comment.collapsed_count} more ${comment.collapsed_count === 1 ? 'reply' : 'replies'}
+                    </button>
+                ` : ''}
             </div>
         </div>
     `).join('');
 }
 
+// Whether the logged in user wrote a post or comment
+function isOwnContent(item) {
+    return currentUser && item.author === currentUser.username;
+}
+
+// Moderators and admins can delete and lock anyone's posts and comments
+function canModerate() {
+    return currentUser && (currentUser.role === 'moderator' || currentUser.role === 'admin');
+}
+
+async function lockContent(kind, id, locked, postId) {
+    await submitChange(`/lock-${kind}`, { [`${kind}_id`]: id, locked }, `Failed to ${locked ? 'lock' : 'unlock'} ${kind}.`);
+    if (kind === 'comment') {
+        loadComments(postId);
+    } else {
+        loadPosts();
+    }
+}
+
+// Flag a post or comment for the moderators
+async function reportContent(kind, id) {
+    const reason = prompt(`Why are you reporting this ${kind}?`);
+    if (!reason) return;
+
+    try {
+        const response = await fetch('/report', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ [`${kind}_id`]: id, reason }),
+        });
+        if (response.status === 409) {
+            alert(`You already reported this ${kind}.`);
+            return;
+        }
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        alert('Thank you, the moderators will review your report.');
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to send report.');
+    }
+}
+
+function editedMarker(kind, item) {
+    if (!item.edited) return '';
+    return `<button class="btn-link edited-marker" onclick="showRevisions('${kind}', ${item.id})" title="Edited ${new Date(item.edited_at).toLocaleString()}">(edited)</button>`;
+}
+
+async function editPost(postId) {
+    const post = loadedPosts[postId];
+    if (!post) return;
+
+    const title = prompt('Title', post.title);
+    if (title === null) return;
+    const content = prompt('Content', post.content);
+    if (content === null) return;
+
+    await submitChange('/edit-post', { post_id: postId, title, content }, 'Failed to edit post.');
+    loadPosts();
+}
+
+async function deletePost(postId) {
+    if (!confirm('Delete this post?')) return;
+    await submitChange('/delete-post', { post_id: postId }, 'Failed to delete post.');
+    loadPosts();
+}
+
+async function editComment(postId, commentId) {
+    const element = document.getElementById(`comment-${commentId}`);
+    const content = prompt('Comment', element ? element.dataset.content : '');
+    if (content === null) return;
+
+    await submitChange('/edit-comment', { comment_id: commentId, content }, 'Failed to edit comment.');
+    loadComments(postId);
+}
+
+async function deleteComment(postId, commentId) {
+    if (!confirm('Delete this comment?')) return;
+    await submitChange('/delete-comment', { comment_id: commentId }, 'Failed to delete comment.');
+    loadComments(postId);
+}
+
+async function submitChange(url, body, failureMessage) {
+    try {
+        const response = await fetch(url, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify(body),
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert(failureMessage);
+    }
+}
+
+// Show the previous versions of an edited post or comment
+async function showRevisions(kind, id) {
+    try {
+        const response = await fetch(`/${kind}-revisions?${kind}_id=${id}`);
+        if (!response.ok) {
+            throw new Error('Failed to fetch revisions');
+        }
+        const page = await response.json();
+        const history = page.items.map(revision =>
+            `${new Date(revision.created_at).toLocaleString()} (${revision.editor})\n` +
+            (revision.title ? `${revision.title}\n` : '') + revision.content
+        ).join('\n\n');
+        alert(history || 'No previous versions.');
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to load revision history.');
+    }
+}
+
+function toggleReplyForm(commentId) {
+    const form = document.getElementById(`reply-form-${commentId}`);
+    if (form) {
+        form.style.display = form.style.display === 'none' ? 'block' : 'none';
+    }
+}
+
+// Expand a collapsed thread by loading every reply below a comment
+async function loadReplies(postId, commentId) {
+    const container = document.getElementById(`replies-${commentId}`);
+    if (!container) return;
+
+    try {
+        const response = await fetch(`/get-comments?post_id=${postId}&parent_id=${commentId}&limit=100`);
+        if (!response.ok) {
+            throw new Error('Failed to fetch replies');
+        }
+        const page = await response.json();
+        container.innerHTML = renderComments(page.items);
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to load replies.');
+    }
+}
+
+// Reflect the counts and the viewer's reaction returned after toggling a reaction
+function updateReactionButtons(containerId, result) {
+    const container = document.getElementById(containerId);
+    if (!container) return;
+
+    const like = container.querySelector('.like-btn');
+    const dislike = container.querySelector('.dislike-btn');
+    like.querySelector('span').textContent = result.likes;
+    dislike.querySelector('span').textContent = result.dislikes;
+    // Live updates carry the counts only, leaving the viewer's own reaction as it is
+    if ('viewer_reaction' in result) {
+        like.classList.toggle('active', result.viewer_reaction === 'LIKE');
+        dislike.classList.toggle('active', result.viewer_reaction === 'DISLIKE');
+    }
+}
+
 async function handleReaction(postId, type) {
     if (!currentUser) {
         alert('Please login to react to posts');
@@ -343,13 +858,13 @@ async function handleReaction(postId, type) {
             headers: {
                 'Content-Type': 'application/json',
             },
-            body: JSON.stringify({ postId, type }),
+            body: JSON.stringify({ post_id: postId, reaction_type: type.toUpperCase() }),
         });
 
         if (!response.ok) {
             throw new Error('Failed to add reaction');
         }
-        loadPosts();
+        updateReactionButtons(`post-reactions-${postId}`, await response.json());
     } catch (error) {
         console.error('Error:', error);
         alert('Failed to add reaction.');
@@ -368,20 +883,20 @@ async function handleCommentReaction(commentId, type) {
             headers: {
                 'Content-Type': 'application/json',
             },
-            body: JSON.stringify({ commentId, type }),
+            body: JSON.stringify({ comment_id: commentId, reaction_type: type.toUpperCase() }),
         });
 
         if (!response.ok) {
             throw new Error('Failed to add comment reaction');
         }
-        loadPosts();
+        updateReactionButtons(`comment-reactions-${commentId}`, await response.json());
     } catch (error) {
         console.error('Error:', error);
         alert('Failed to add comment reaction.');
     }
 }
 
-async function handleAddComment(event, postId) {
+async function handleAddComment(event, postId, parentId = null) {
     event.preventDefault();
     if (!currentUser) {
         alert('Please login to comment');
@@ -402,7 +917,7 @@ async function handleAddComment(event, postId) {
             headers: {
                 'Content-Type': 'application/json'
             },
-            body: JSON.stringify({ postId, content }),
+            body: JSON.stringify({ post_id: postId, parent_id: parentId || 0, content }),
         });
 
         if (!response.ok) {
@@ -410,13 +925,180 @@ async function handleAddComment(event, postId) {
         }
 
         textarea.value = '';
-        loadPosts();
+        loadComments(postId);
     } catch (error) {
         console.error('Error:', error);
         alert('Failed to add comment.');
     }
 }
 
+// Live updates: the server streams new posts, comments and reaction counts, which are
+// patched into whatever part of the page shows them
+function subscribeToEvents() {
+    if (!('EventSource' in window)) return;
+    if (liveEvents) liveEvents.close();
+
+    const params = new URLSearchParams();
+    if (postFilters.category) params.set('category', postFilters.category);
+    liveEvents = new EventSource(`/events?${params.toString()}`);
+    liveEvents.addEventListener('post', event => showNewPost(JSON.parse(event.data)));
+    liveEvents.addEventListener('comment', event => showNewComment(JSON.parse(event.data)));
+    liveEvents.addEventListener('reaction', event => showReactionCounts(JSON.parse(event.data)));
+    // Sent when the stream missed events, e.g. after the server restarted
+    liveEvents.addEventListener('reset', () => loadPosts());
+}
+
+// New posts go on top of the feed, unless it shows search results or only the user's own
+// or liked posts
+function showNewPost(post) {
+    if (searchQuery || postFilters.created || postFilters.liked || loadedPosts[post.id]) return;
+    const container = document.getElementById('postsContainer');
+    if (!container) return;
+
+    if (!container.querySelector('.post')) {
+        container.innerHTML = '';
+    }
+    container.prepend(postElement(post));
+}
+
+function showNewComment(comment) {
+    const post = loadedPosts[comment.post_id];
+    if (post) {
+        post.comment_count = (post.comment_count || 0) + 1;
+        const count = document.querySelector(`#post-${comment.post_id} .comment-count span`);
+        if (count) count.textContent = post.comment_count;
+    }
+
+    // Comments are only added to threads that are open and do not show them yet
+    const section = document.getElementById(`comments-${comment.post_id}`);
+    if (!section || section.style.display === 'none' || document.getElementById(`comment-${comment.id}`)) return;
+    const list = comment.parent_id
+        ? document.getElementById(`replies-${comment.parent_id}`)
+        : section.querySelector('.comment-list');
+    if (list) {
+        list.insertAdjacentHTML('beforeend', renderComments([comment]));
+    }
+}
+
+function showReactionCounts(counts) {
+    if (counts.comment_id) {
+        updateReactionButtons(`comment-reactions-${counts.comment_id}`, counts);
+    } else {
+        updateReactionButtons(`post-reactions-${counts.post_id}`, counts);
+    }
+}
+
+// Mention autocomplete: typing @ and the start of a username in a post or comment offers
+// matching users
+const mentionInputs = '#postContent, .comment-input';
+let mentionTarget = null;
+let mentionSuggestions = [];
+let mentionIndex = 0;
+let mentionRequest = 0; // only the response to the latest request is shown
+
+// The part of a username typed after an @ right before the caret, or null
+function mentionPrefix(textarea) {
+    const match = textarea.value.slice(0, textarea.selectionStart).match(/(?:^|[^\w@])@([\w.-]*)$/);
+    return match ? match[1] : null;
+}
+
+async function updateMentionSuggestions(textarea) {
+    const prefix = mentionPrefix(textarea);
+    if (prefix === null) {
+        hideMentionSuggestions();
+        return;
+    }
+
+    const request = ++mentionRequest;
+    try {
+        const response = await fetch(`/usernames?prefix=${encodeURIComponent(prefix)}`);
+        if (!response.ok || request !== mentionRequest) return;
+        const users = await response.json();
+        mentionTarget = textarea;
+        mentionSuggestions = users.map(user => user.username);
+        mentionIndex = 0;
+        showMentionSuggestions();
+    } catch (error) {
+        console.error('Error:', error);
+    }
+}
+
+function showMentionSuggestions() {
+    if (mentionSuggestions.length === 0) {
+        hideMentionSuggestions();
+        return;
+    }
+    let list = document.getElementById('mentionSuggestions');
+    if (!list) {
+        list = document.createElement('ul');
+        list.id = 'mentionSuggestions';
+        list.className = 'mention-suggestions';
+        document.body.appendChild(list);
+    }
+
+    const rect = mentionTarget.getBoundingClientRect();
+    list.style.left = `${rect.left + window.scrollX}px`;
+    list.style.top = `${rect.bottom + window.scrollY}px`;
+    // mousedown keeps the focus in the textarea
+    list.innerHTML = mentionSuggestions.map((username, i) => `
+        <li class="${i === mentionIndex ? 'active' : ''}" onmousedown="event.preventDefault(); completeMention(${i})">@${escapeHtml(username)}</li>
+    `).join('');
+    list.style.display = 'block';
+}
+
+function hideMentionSuggestions() {
+    mentionRequest++;
+    mentionSuggestions = [];
+    const list = document.getElementById('mentionSuggestions');
+    if (list) list.style.display = 'none';
+}
+
+// Replace the typed prefix with the chosen username
+function completeMention(index) {
+    const textarea = mentionTarget;
+    const username = mentionSuggestions[index];
+    if (!textarea || !username) return;
+
+    const caret = textarea.selectionStart;
+    const before = textarea.value.slice(0, caret).replace(/@[\w.-]*$/, `@${username} `);
+    textarea.value = before + textarea.value.slice(caret);
+    textarea.selectionStart = textarea.selectionEnd = before.length;
+    textarea.focus();
+    hideMentionSuggestions();
+}
+
+document.addEventListener('input', event => {
+    if (event.target.matches(mentionInputs)) {
+        updateMentionSuggestions(event.target);
+    }
+});
+
+document.addEventListener('keydown', event => {
+    if (event.target !== mentionTarget || mentionSuggestions.length === 0) return;
+    switch (event.key) {
+    case 'ArrowDown':
+    case 'ArrowUp':
+        event.preventDefault();
+        mentionIndex = (mentionIndex + (event.key === 'ArrowDown' ? 1 : -1) + mentionSuggestions.length) % mentionSuggestions.length;
+        showMentionSuggestions();
+        break;
+    case 'Enter':
+    case 'Tab':
+        event.preventDefault();
+        completeMention(mentionIndex);
+        break;
+    case 'Escape':
+        hideMentionSuggestions();
+        break;
+    }
+});
+
+document.addEventListener('focusout', event => {
+    if (event.target === mentionTarget) {
+        hideMentionSuggestions();
+    }
+});
+
 function handleLogout() {
     // Clear the currentUser data
     currentUser = null;
@@ -430,6 +1112,10 @@ function handleLogout() {
 
 // Update the DOMContentLoaded event listener
 document.addEventListener('DOMContentLoaded', function() {
+    showEmailVerified();
     checkLoginStatus(); // Check if user is already logged in
+    loadCategories();
     loadPosts();
+    setupInfiniteScroll();
+    subscribeToEvents();
 });
\ No newline at end of file
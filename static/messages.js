@@ -0,0 +1,353 @@
+// Private messages: conversations are loaded over REST, while new messages, typing
+// indicators, read receipts and presence arrive over a WebSocket
+let viewer = null;
+let socket = null;
+const conversations = {}; // the viewer's conversations, by id
+
+// The open thread: an existing conversation, or a user the first message will go to
+let activeConversation = null;
+let pendingRecipient = null;
+let olderMessagesCursor = null;
+
+// Typing indicators are re-sent while typing and expire when they stop coming
+const typingInterval = 3000;
+const typingTimeout = 6000;
+let lastTypingSent = 0;
+let typingStopTimer = null;
+let typingHideTimer = null;
+
+function connectSocket() {
+    const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    socket = new WebSocket(`${protocol}//${location.host}/messages/socket`);
+    socket.onmessage = event => handleSocketEvent(JSON.parse(event.data));
+    socket.onclose = () => {
+        socket = null;
+        // Reconnect, then catch up on whatever was missed in the meantime
+        setTimeout(async () => {
+            connectSocket();
+            await loadConversations();
+            if (activeConversation) openConversation(activeConversation);
+        }, 3000);
+    };
+}
+
+function sendSocketRequest(request) {
+    if (!socket || socket.readyState !== WebSocket.OPEN) return false;
+    socket.send(JSON.stringify(request));
+    return true;
+}
+
+function handleSocketEvent(event) {
+    switch (event.type) {
+    case 'message':
+        showIncomingMessage(event.data);
+        break;
+    case 'typing':
+        showTyping(event.data);
+        break;
+    case 'read':
+        showReadReceipt(event.data);
+        break;
+    case 'presence':
+        showPresence(event.data);
+        break;
+    case 'error':
+        alert(event.data);
+        break;
+    }
+}
+
+async function loadConversations() {
+    try {
+        const response = await fetch('/messages/conversations?limit=100');
+        if (!response.ok) {
+            throw new Error('Failed to fetch conversations');
+        }
+        const page = await response.json();
+        page.items.forEach(conversation => conversations[conversation.id] = conversation);
+        displayConversations();
+    } catch (error) {
+        console.error('Error:', error);
+    }
+}
+
+function displayConversations() {
+    const list = Object.values(conversations)
+        .sort((a, b) => new Date(b.last_message_at) - new Date(a.last_message_at) || b.id - a.id);
+    const container = document.getElementById('conversations');
+    if (list.length === 0) {
+        container.innerHTML = '<p>No conversations yet.</p>';
+        return;
+    }
+    container.innerHTML = list.map(conversation => `
+        <div class="conversation ${conversation.id === activeConversation ? 'active' : ''} ${conversation.unread_count ? 'unread' : ''}"
+            onclick="openConversation(${conversation.id})">
+            <strong>${presenceDot(conversation.with)} ${escapeHtml(conversation.with.username)}</strong>
+            ${conversation.unread_count ? `<span class="unread-count">${conversation.unread_count}</span>` : ''}
+            <p>${conversation.last_message.sender === viewer.username ? 'You: ' : ''}${escapeHtml(conversation.last_message.content)}</p>
+        </div>
+    `).join('');
+}
+
+function presenceDot(presence) {
+    return `<span class="presence ${presence.online ? 'online' : ''}" title="${presence.online ? 'Online' : lastSeenText(presence)}"></span>`;
+}
+
+function lastSeenText(presence) {
+    return presence.last_seen_at ? `Last seen ${new Date(presence.last_seen_at).toLocaleString()}` : 'Offline';
+}
+
+function showThreadHeader(presence) {
+    document.getElementById('threadHeader').innerHTML = `
+        <a class="author-link" href="/users/${encodeURIComponent(presence.username)}">${escapeHtml(presence.username)}</a>
+        <span class="profile-meta">${presence.online ? 'Online' : escapeHtml(lastSeenText(presence))}</span>
+    `;
+}
+
+async function openConversation(conversationId) {
+    const conversation = conversations[conversationId];
+    if (!conversation) return;
+
+    activeConversation = conversationId;
+    pendingRecipient = null;
+    olderMessagesCursor = null;
+    showThreadHeader(conversation.with);
+    document.getElementById('typingIndicator').textContent = '';
+    document.getElementById('threadMessages').innerHTML = '';
+    document.getElementById('messageForm').style.display = 'flex';
+    await loadMessages();
+    markRead();
+    displayConversations();
+}
+
+// Fetch the latest messages of the open conversation, or the page before those shown
+async function loadMessages(older = false) {
+    const params = new URLSearchParams({ conversation_id: activeConversation });
+    if (older && olderMessagesCursor) params.set('before', olderMessagesCursor);
+    try {
+        const response = await fetch(`/messages?${params.toString()}`);
+        if (!response.ok) {
+            throw new Error('Failed to fetch messages');
+        }
+        const page = await response.json();
+        olderMessagesCursor = page.next_cursor || null;
+
+        const container = document.getElementById('threadMessages');
+        const html = page.items.slice().reverse().map(renderMessage).join('');
+        const loadOlder = container.querySelector('.load-older');
+        if (loadOlder) loadOlder.remove();
+        if (older) {
+            container.insertAdjacentHTML('afterbegin', html);
+        } else {
+            container.innerHTML = html;
+            container.scrollTop = container.scrollHeight;
+        }
+        if (olderMessagesCursor) {
+            container.insertAdjacentHTML('afterbegin', '<button class="btn-link load-older" onclick="loadMessages(true)">Load older messages</button>');
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to load messages.');
+    }
+}
+
+function renderMessage(message) {
+    const own = message.sender === viewer.username;
+    return `
+        <div class="message ${own ? 'own' : ''}" id="message-${message.id}" data-id="${message.id}">
+            <p>${escapeHtml(message.content)}</p>
+            <small>
+                ${new Date(message.created_at).toLocaleString()}
+                ${own ? `<span class="receipt">${message.read_at ? 'Seen' : ''}</span>` : ''}
+            </small>
+        </div>
+    `;
+}
+
+function appendMessage(message) {
+    const container = document.getElementById('threadMessages');
+    if (document.getElementById(`message-${message.id}`)) return;
+    container.insertAdjacentHTML('beforeend', renderMessage(message));
+    container.scrollTop = container.scrollHeight;
+}
+
+async function showIncomingMessage(message) {
+    const own = message.sender === viewer.username;
+    const conversation = conversations[message.conversation_id];
+    if (!conversation) {
+        // The first message of a new conversation
+        await loadConversations();
+    } else {
+        conversation.last_message = message;
+        conversation.last_message_at = message.created_at;
+        if (!own) {
+            conversation.unread_count++;
+        }
+    }
+
+    // The first message to a user opens the conversation it started
+    const other = own ? conversations[message.conversation_id]?.with.username : message.sender;
+    if (pendingRecipient && other === pendingRecipient) {
+        await openConversation(message.conversation_id);
+        return;
+    }
+
+    if (message.conversation_id === activeConversation) {
+        appendMessage(message);
+        if (!own) {
+            document.getElementById('typingIndicator').textContent = '';
+            markRead();
+        }
+    }
+    displayConversations();
+}
+
+function showTyping(indicator) {
+    if (indicator.conversation_id !== activeConversation) return;
+    const element = document.getElementById('typingIndicator');
+    clearTimeout(typingHideTimer);
+    element.textContent = indicator.typing ? `${indicator.user} is typing...` : '';
+    if (indicator.typing) {
+        typingHideTimer = setTimeout(() => element.textContent = '', typingTimeout);
+    }
+}
+
+function showReadReceipt(receipt) {
+    const conversation = conversations[receipt.conversation_id];
+    if (receipt.reader === viewer.username) {
+        // Read in another tab
+        if (conversation) conversation.unread_count = 0;
+        displayConversations();
+        return;
+    }
+    if (receipt.conversation_id !== activeConversation) return;
+    document.querySelectorAll('#threadMessages .message.own').forEach(element => {
+        if (Number(element.dataset.id) <= receipt.message_id) {
+            element.querySelector('.receipt').textContent = 'Seen';
+        }
+    });
+}
+
+function showPresence(presence) {
+    Object.values(conversations).forEach(conversation => {
+        if (conversation.with.username === presence.username) {
+            conversation.with = presence;
+            if (conversation.id === activeConversation) showThreadHeader(presence);
+        }
+    });
+    displayConversations();
+}
+
+// Mark the open conversation read up to its last message
+function markRead() {
+    const conversation = conversations[activeConversation];
+    if (!conversation || !conversation.unread_count) return;
+    conversation.unread_count = 0;
+    const request = { conversation_id: activeConversation };
+    if (!sendSocketRequest({ type: 'read', ...request })) {
+        fetch('/messages/read', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(request),
+        });
+    }
+}
+
+function handleTyping() {
+    if (!activeConversation) return;
+    const now = Date.now();
+    if (now - lastTypingSent > typingInterval) {
+        lastTypingSent = now;
+        sendSocketRequest({ type: 'typing', conversation_id: activeConversation, typing: true });
+    }
+    clearTimeout(typingStopTimer);
+    typingStopTimer = setTimeout(stopTyping, typingInterval);
+}
+
+function stopTyping() {
+    clearTimeout(typingStopTimer);
+    if (!activeConversation || !lastTypingSent) return;
+    lastTypingSent = 0;
+    sendSocketRequest({ type: 'typing', conversation_id: activeConversation, typing: false });
+}
+
+async function handleSendMessage(event) {
+    event.preventDefault();
+    const input = document.getElementById('messageInput');
+    const content = input.value.trim();
+    if (!content) return;
+
+    const request = activeConversation
+        ? { conversation_id: activeConversation, content }
+        : { to: pendingRecipient, content };
+    stopTyping();
+    input.value = '';
+
+    // The message comes back over the socket like any other
+    if (sendSocketRequest({ type: 'message', ...request })) return;
+    try {
+        const response = await fetch('/messages/send', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(request),
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        showIncomingMessage(await response.json());
+    } catch (error) {
+        console.error('Error:', error);
+        input.value = content;
+        alert(`Failed to send message: ${error.message}`);
+    }
+}
+
+// Open the conversation with a user, or an empty thread whose first message starts it
+function messageUser(username) {
+    const existing = Object.values(conversations).find(conversation => conversation.with.username === username);
+    if (existing) {
+        openConversation(existing.id);
+        return;
+    }
+    activeConversation = null;
+    pendingRecipient = username;
+    showThreadHeader({ username, online: false });
+    document.getElementById('typingIndicator').textContent = '';
+    document.getElementById('threadMessages').innerHTML = '<p>No messages yet.</p>';
+    document.getElementById('messageForm').style.display = 'flex';
+    displayConversations();
+}
+
+function startConversation(event) {
+    event.preventDefault();
+    const input = document.getElementById('newConversationUser');
+    const username = input.value.trim().replace(/^@/, '');
+    if (!username) return;
+    input.value = '';
+    messageUser(username);
+}
+
+document.addEventListener('DOMContentLoaded', async function() {
+    try {
+        const response = await fetch('/check-session', { credentials: 'include' });
+        if (response.ok) {
+            viewer = await response.json();
+        }
+    } catch (error) {
+        console.error('Error checking login status:', error);
+    }
+    if (!viewer) {
+        document.getElementById('messagesLogin').style.display = 'block';
+        return;
+    }
+
+    document.getElementById('messenger').style.display = 'flex';
+    connectSocket();
+    await loadConversations();
+
+    // Profiles link to /inbox?to={username}
+    const to = new URLSearchParams(location.search).get('to');
+    if (to && to !== viewer.username) {
+        messageUser(to);
+    }
+});
@@ -0,0 +1,221 @@
+// The username is the last segment of /users/{username}
+const profileUsername = decodeURIComponent(location.pathname.split('/').filter(Boolean).pop());
+let viewer = null;
+
+async function loadProfile() {
+    try {
+        const response = await fetch(`/users/${encodeURIComponent(profileUsername)}`, {
+            headers: { 'Accept': 'application/json' },
+        });
+        if (response.status === 404) {
+            document.getElementById('profile').innerHTML = '<p>User not found.</p>';
+            return;
+        }
+        if (!response.ok) {
+            throw new Error('Failed to fetch profile');
+        }
+        displayProfile(await response.json());
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to load profile.');
+    }
+}
+
+function displayProfile(profile) {
+    document.title = `${profile.display_name || profile.username} - Forum`;
+    document.getElementById('profile').innerHTML = `
+        <img class="avatar" src="${escapeHtml(profile.avatar_url)}" alt="" width="96" height="96">
+        <div>
+            <h2>${escapeHtml(profile.display_name || profile.username)}</h2>
+            <p class="profile-meta">
+                @${escapeHtml(profile.username)}${profile.role !== 'user' ? ` · ${escapeHtml(profile.role)}` : ''}
+                · joined ${new Date(profile.joined_at).toLocaleDateString()}
+            </p>
+            <p class="profile-bio">${escapeHtml(profile.bio)}</p>
+            <p class="profile-meta">
+                ${profile.post_count} posts · ${profile.comment_count} comments · ${profile.reputation} reputation
+            </p>
+            ${viewer && viewer.username === profile.username ? `
+                <div class="account-actions">
+                    <button class="btn" onclick="showEditProfileForm()">Edit profile</button>
+                    <button class="btn" onclick="showNotificationPreferences()">Notifications</button>
+                    <button class="btn" onclick="changePassword()">Change password</button>
+                    <button class="btn" onclick="changeEmail()">Change email</button>
+                    <button class="btn" onclick="deleteAccount()">Delete account</button>
+                </div>
+            ` : ''}
+            ${viewer && viewer.username !== profile.username ? `
+                <div class="account-actions">
+                    <a class="btn" href="/inbox?to=${encodeURIComponent(profile.username)}">Send message</a>
+                </div>
+            ` : ''}
+        </div>
+    `;
+    document.getElementById('profileDisplayName').value = profile.display_name;
+    document.getElementById('profileBio').value = profile.bio;
+
+    const activity = document.getElementById('activity');
+    if (profile.recent_activity.length === 0) {
+        activity.innerHTML = '<p>No activity yet.</p>';
+        return;
+    }
+    activity.innerHTML = profile.recent_activity.map(item => `
+        <div class="post">
+            <div class="post-header">
+                <h3>${item.type === 'comment' ? 'Commented on ' : ''}${escapeHtml(item.post_title)}</h3>
+                <span>${new Date(item.created_at).toLocaleString()}</span>
+            </div>
+            <p>${escapeHtml(item.excerpt)}</p>
+        </div>
+    `).join('');
+}
+
+function showEditProfileForm() {
+    const form = document.getElementById('editProfileForm');
+    form.style.display = form.style.display === 'none' ? 'block' : 'none';
+}
+
+async function handleEditProfile(event) {
+    event.preventDefault();
+    try {
+        const response = await fetch('/edit-profile', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                display_name: document.getElementById('profileDisplayName').value,
+                bio: document.getElementById('profileBio').value,
+            }),
+        });
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
+        document.getElementById('editProfileForm').style.display = 'none';
+        displayProfile(await response.json());
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to update profile.');
+    }
+}
+
+// Labels of the events users choose notifications for, in display order
+const notificationEventLabels = {
+    comment: 'Comments on my posts',
+    reply: 'Replies to my comments',
+    reaction: 'Likes and dislikes of my posts and comments',
+    mention: 'Mentions of my @username',
+    moderation: 'Review of my posts',
+};
+
+async function showNotificationPreferences() {
+    const form = document.getElementById('notificationPreferences');
+    if (form.style.display !== 'none') {
+        form.style.display = 'none';
+        return;
+    }
+    try {
+        const response = await fetch('/notifications/preferences');
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
+        displayNotificationPreferences(await response.json());
+        form.style.display = 'block';
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to load notification settings.');
+    }
+}
+
+function displayNotificationPreferences(preferences) {
+    document.getElementById('notificationPreferencesRows').innerHTML = Object.keys(notificationEventLabels).map(event => `
+        <tr>
+            <td>${notificationEventLabels[event]}</td>
+            <td><input type="checkbox" data-event="${event}" data-channel="site" ${preferences[event].site ? 'checked' : ''}></td>
+            <td><input type="checkbox" data-event="${event}" data-channel="email" ${preferences[event].email ? 'checked' : ''}></td>
+        </tr>
+    `).join('');
+}
+
+async function handleNotificationPreferences(event) {
+    event.preventDefault();
+    const preferences = {};
+    document.querySelectorAll('#notificationPreferencesRows input').forEach(input => {
+        preferences[input.dataset.event] = preferences[input.dataset.event] || {};
+        preferences[input.dataset.event][input.dataset.channel] = input.checked;
+    });
+
+    const result = await submitAccountChange('/notifications/preferences/update', preferences);
+    if (result) {
+        displayNotificationPreferences(result);
+        alert('Notification settings saved.');
+    }
+}
+
+// Send an account settings change and return the parsed response, or null after telling the user why it failed
+async function submitAccountChange(url, body) {
+    try {
+        const response = await fetch(url, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body),
+        });
+        if (!response.ok) {
+            alert(await response.text());
+            return null;
+        }
+        return await response.json();
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to update account.');
+        return null;
+    }
+}
+
+async function changePassword() {
+    const currentPassword = prompt('Current password:');
+    if (currentPassword === null) return;
+    const newPassword = prompt('New password:');
+    if (newPassword === null) return;
+
+    const result = await submitAccountChange('/account/password', { current_password: currentPassword, new_password: newPassword });
+    if (result) {
+        alert('Password changed. Your other sessions were logged out.');
+    }
+}
+
+async function changeEmail() {
+    const newEmail = prompt('New email address:');
+    if (newEmail === null) return;
+    const password = prompt('Current password:');
+    if (password === null) return;
+
+    const result = await submitAccountChange('/account/email', { password, new_email: newEmail });
+    if (result) {
+        alert(result.message);
+    }
+}
+
+async function deleteAccount() {
+    if (!confirm('Delete your account? This cannot be undone.')) return;
+    const password = prompt('Enter your password to confirm:');
+    if (password === null) return;
+
+    const result = await submitAccountChange('/account/delete', { password });
+    if (result) {
+        alert('Your account was deleted.');
+        location.href = '/';
+    }
+}
+
+document.addEventListener('DOMContentLoaded', async function() {
+    try {
+        const response = await fetch('/check-session', { credentials: 'include' });
+        if (response.ok) {
+            viewer = await response.json();
+        }
+    } catch (error) {
+        console.error('Error checking login status:', error);
+    }
+    loadProfile();
+});
@@ -0,0 +1,29 @@
+// Reset page opened from the link in a password reset email, which carries the token
+const resetToken = new URLSearchParams(window.location.search).get('token');
+
+async function handleResetPassword(event) {
+    event.preventDefault();
+    const newPassword = document.getElementById('newPassword').value;
+    if (newPassword !== document.getElementById('confirmPassword').value) {
+        alert('The passwords do not match.');
+        return;
+    }
+
+    try {
+        const response = await fetch('/account/reset-password', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ token: resetToken, new_password: newPassword }),
+        });
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
+        const data = await response.json();
+        alert(data.message);
+        window.location.href = '/';
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Failed to reset the password.');
+    }
+}
@@ -0,0 +1,371 @@
+// Package websocket implements the server side of the WebSocket protocol (RFC 6455) as far as
+// the forum needs it: text and binary messages, pings and the closing handshake. Extensions
+// and subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types, as frame opcodes
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// Close codes sent in close frames
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005 // never sent; reported when the peer's close frame had no code
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseTooBig          = 1009
+)
+
+// acceptGUID is appended to the client's key to derive Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const maxControlPayload = 125
+
+// ErrClosed is returned when writing to a connection after the close frame was sent
+var ErrClosed = errors.New("websocket: connection closed")
+
+// CloseError is returned by ReadMessage once the peer closed the connection, or when the
+// connection was failed because the peer broke the protocol
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Conn is an upgraded WebSocket connection. ReadMessage must only be called from one
+// goroutine at a time, while writes may be made from any goroutine.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// MaxMessageSize is the size in bytes above which a message is refused with CloseTooBig;
+	// zero means no limit
+	MaxMessageSize int64
+	// ReadTimeout is how long to wait for the next frame; zero means forever. Peers answering
+	// pings keep an otherwise idle connection alive.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds every write; zero means no limit
+	WriteTimeout time.Duration
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// Upgrade performs the opening handshake of a WebSocket request and takes over its
+// connection. Browsers send cookies with cross-site WebSocket requests, so requests whose
+// Origin is not the host they were sent to are refused. On failure an HTTP error has been
+// written and the error is returned.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: method not GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("websocket: not an upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: invalid key")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "Forbidden: cross-origin WebSocket request", http.StatusForbidden)
+			return nil, errors.New("websocket: origin not allowed")
+		}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSockets are not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not support hijacking")
+	}
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "Failed to upgrade connection", http.StatusInternalServerError)
+		return nil, err
+	}
+	// Clear the deadlines the HTTP server may have set for the request
+	netConn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	// The reader may already hold frames the client sent right after its request
+	return &Conn{conn: netConn, reader: rw.Reader}, nil
+}
+
+// acceptKey derives the Sec-WebSocket-Accept value for a client's key
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether the comma separated header contains token, ignoring case
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// frame is a single frame read from the peer, with its payload unmasked
+type frame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+// readFrame reads the next frame, checking the parts of its header the server can check
+// before the payload. limit is the most payload a data frame may carry, or negative for no
+// limit.
+func (c *Conn) readFrame(limit int64) (frame, error) {
+	if c.ReadTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{fin: header[0]&0x80 != 0, opcode: int(header[0] & 0x0f)}
+	if header[0]&0x70 != 0 {
+		return f, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return f, c.fail(CloseProtocolError, "client frames must be masked")
+	}
+
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return f, err
+		}
+		length = int64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return f, err
+		}
+		if extended[0]&0x80 != 0 {
+			return f, c.fail(CloseProtocolError, "invalid frame length")
+		}
+		length = int64(binary.BigEndian.Uint64(extended[:]))
+	}
+
+	if f.opcode >= opClose {
+		if !f.fin || length > maxControlPayload {
+			return f, c.fail(CloseProtocolError, "invalid control frame")
+		}
+	} else if limit >= 0 && length > limit {
+		return f, c.fail(CloseTooBig, "message too big")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return f, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// ReadMessage returns the next text or binary message, answering pings and reassembling
+// fragmented messages on the way. Once the peer closed the connection, or broke the
+// protocol, it returns a *CloseError; the connection should then be closed.
+func (c *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	for {
+		limit := int64(-1)
+		if c.MaxMessageSize > 0 {
+			limit = c.MaxMessageSize - int64(len(data))
+		}
+		f, err := c.readFrame(limit)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, f.payload); err != nil && err != ErrClosed {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.closed(f.payload)
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			messageType = f.opcode
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+
+		data = append(data, f.payload...)
+		if !f.fin {
+			continue
+		}
+		if messageType == TextMessage && !utf8.Valid(data) {
+			return 0, nil, c.fail(CloseInvalidPayload, "invalid UTF-8 in text message")
+		}
+		return messageType, data, nil
+	}
+}
+
+// closed answers the peer's close frame and returns the code and reason it carried
+func (c *Conn) closed(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close frame")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !utf8.Valid(payload[2:]) {
+			return c.fail(CloseInvalidPayload, "invalid UTF-8 in close reason")
+		}
+	}
+
+	code := closeErr.Code
+	if code == CloseNoStatus {
+		code = CloseNormal
+	}
+	if err := c.WriteClose(code, ""); err != nil && err != ErrClosed {
+		return err
+	}
+	return closeErr
+}
+
+// fail sends a close frame for a protocol violation of the peer and returns it as an error
+func (c *Conn) fail(code int, reason string) error {
+	c.WriteClose(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// WriteMessage sends data as a single text or binary message
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return errors.New("websocket: invalid message type")
+	}
+	return c.writeFrame(messageType, data)
+}
+
+// WritePing sends a ping, which the peer answers with a pong
+func (c *Conn) WritePing() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// WriteClose starts or completes the closing handshake. Nothing can be written afterwards.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeFrame(opClose, payload)
+}
+
+// writeFrame sends an unmasked, unfragmented frame, as servers do
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | byte(opcode)
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	if c.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close closes the underlying connection without a closing handshake
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientFrame encodes a masked frame as a client sends it. length is the payload length
+// announced in the header, which may differ from len(payload) to simulate a lying peer.
+func clientFrame(fin bool, opcode int, payload []byte, length int) []byte {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	b := []byte{first}
+	switch {
+	case length <= 125:
+		b = append(b, 0x80|byte(length))
+	case length <= 0xffff:
+		b = append(b, 0x80|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, 0x80|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+	mask := []byte{1, 2, 3, 4}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// readFrom returns the result of reading one message from a connection whose peer sends
+// the given bytes
+func readFrom(t *testing.T, maxMessageSize int64, sent []byte) (int, []byte, error) {
+	t.Helper()
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go client.Write(sent)
+	// Drain whatever the server answers, such as close frames, so its writes do not block
+	go io.Copy(io.Discard, client)
+
+	// A server waiting for a payload that never comes fails instead of hanging
+	c := &Conn{conn: server, reader: bufio.NewReader(server), MaxMessageSize: maxMessageSize, ReadTimeout: 5 * time.Second}
+	return c.ReadMessage()
+}
+
+func TestReadMessageSizeLimit(t *testing.T) {
+	const limit = 16 << 10
+	full := bytes.Repeat([]byte("a"), limit)
+
+	tests := []struct {
+		name     string
+		sent     []byte
+		wantSize int // size of the message read, or -1 when it must be refused as too big
+	}{
+		{
+			name:     "single frame at the limit",
+			sent:     clientFrame(true, TextMessage, full, limit),
+			wantSize: limit,
+		},
+		{
+			name:     "single frame over the limit",
+			sent:     clientFrame(true, TextMessage, nil, limit+1),
+			wantSize: -1,
+		},
+		{
+			name: "fragments adding up to the limit",
+			sent: append(clientFrame(false, TextMessage, full[:limit/2], limit/2),
+				clientFrame(true, opContinuation, full[limit/2:], limit/2)...),
+			wantSize: limit,
+		},
+		{
+			name: "continuation after a fragment filling the limit",
+			sent: append(clientFrame(false, TextMessage, full, limit),
+				clientFrame(true, opContinuation, nil, 200<<10)...),
+			wantSize: -1,
+		},
+		{
+			name: "continuation after a fragment filling the limit, announcing a huge length",
+			sent: append(clientFrame(false, TextMessage, full, limit),
+				clientFrame(true, opContinuation, nil, 1<<62)...),
+			wantSize: -1,
+		},
+		{
+			name: "empty continuation after a fragment filling the limit",
+			sent: append(clientFrame(false, TextMessage, full, limit),
+				clientFrame(true, opContinuation, nil, 0)...),
+			wantSize: limit,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, data, err := readFrom(t, limit, tt.sent)
+			if tt.wantSize < 0 {
+				var closeErr *CloseError
+				if !errors.As(err, &closeErr) || closeErr.Code != CloseTooBig {
+					t.Fatalf("got %d bytes and error %v, want close error %d", len(data), err, CloseTooBig)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(data) != tt.wantSize {
+				t.Fatalf("got %d bytes, want %d", len(data), tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestReadMessageWithoutLimit(t *testing.T) {
+	payload := bytes.Repeat([]byte("b"), 100<<10)
+	_, data, err := readFrom(t, 0, clientFrame(true, BinaryMessage, payload, len(payload)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatalf("got %d bytes, want %d", len(data), len(payload))
+	}
+}